@@ -0,0 +1,103 @@
+package awsapi
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	autoScalingService = "autoscaling"
+	autoScalingVersion = "2011-01-01"
+)
+
+// LifecycleAction identifies the lifecycle action of an instance.
+type LifecycleAction struct {
+	AutoScalingGroupName string
+	LifecycleHookName    string
+	InstanceID           string
+}
+
+func (la LifecycleAction) params() url.Values {
+	return url.Values{
+		"AutoScalingGroupName": {la.AutoScalingGroupName},
+		"LifecycleHookName":    {la.LifecycleHookName},
+		"InstanceId":           {la.InstanceID},
+	}
+}
+
+// SetInstanceHealth sets the health status of the instance to Healthy or Unhealthy.
+func (c *Client) SetInstanceHealth(ctx context.Context, instanceID, status string, respectGracePeriod bool) error {
+	params := url.Values{
+		"InstanceId":   {instanceID},
+		"HealthStatus": {status},
+	}
+	if respectGracePeriod {
+		params.Set("ShouldRespectGracePeriod", "true")
+	}
+	return c.query(ctx, autoScalingService, autoScalingVersion, "SetInstanceHealth", params, nil)
+}
+
+// CompleteLifecycleAction lets the auto scaling group carry on with the lifecycle
+// action. result is CONTINUE or ABANDON.
+func (c *Client) CompleteLifecycleAction(ctx context.Context, action LifecycleAction, result string) error {
+	params := action.params()
+	params.Set("LifecycleActionResult", result)
+	return c.query(ctx, autoScalingService, autoScalingVersion, "CompleteLifecycleAction", params, nil)
+}
+
+// RecordLifecycleActionHeartbeat restarts the timeout of the lifecycle action.
+func (c *Client) RecordLifecycleActionHeartbeat(ctx context.Context, action LifecycleAction) error {
+	return c.query(ctx, autoScalingService, autoScalingVersion, "RecordLifecycleActionHeartbeat", action.params(), nil)
+}
+
+// AutoScalingGroupName finds the group the instance is in. The configured name is
+// used first, then the instance tags in the metadata and finally the auto scaling API.
+func (c *Client) AutoScalingGroupName(ctx context.Context) (string, error) {
+	c.lock.Lock()
+	name := c.asgName
+	c.lock.Unlock()
+	if name != "" {
+		return name, nil
+	}
+
+	name, err := c.imds.Get(ctx, "meta-data/tags/instance/aws:autoscaling:groupName")
+	if err != nil && err != ErrNotFound {
+		return "", fmt.Errorf("failed to discover the auto scaling group. Error: %s", err)
+	}
+	name = strings.TrimSpace(name)
+	if name == "" {
+		// Tags are only in the metadata if they have been enabled on the instance.
+		name, err = c.describeAutoScalingGroupName(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to discover the auto scaling group. Error: %s", err)
+		}
+	}
+
+	c.lock.Lock()
+	c.asgName = name
+	c.lock.Unlock()
+	return name, nil
+}
+
+func (c *Client) describeAutoScalingGroupName(ctx context.Context) (string, error) {
+	instanceID, err := c.InstanceID(ctx)
+	if err != nil {
+		return "", err
+	}
+	resp := struct {
+		Instances []struct {
+			AutoScalingGroupName string
+		} `xml:"DescribeAutoScalingInstancesResult>AutoScalingInstances>member"`
+	}{}
+	params := url.Values{"InstanceIds.member.1": {instanceID}}
+	err = c.query(ctx, autoScalingService, autoScalingVersion, "DescribeAutoScalingInstances", params, &resp)
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Instances) == 0 {
+		return "", fmt.Errorf("instance %s is not in an auto scaling group", instanceID)
+	}
+	return resp.Instances[0].AutoScalingGroupName, nil
+}
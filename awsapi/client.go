@@ -0,0 +1,286 @@
+// Package awsapi is a small client for the few AWS APIs that the agent uses.
+// It signs requests itself so that the agent does not need the AWS CLI or SDK.
+// The region, instance and credentials are discovered the same way as the AWS CLI.
+package awsapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/morfien101/asg-healthcheck-agent/config"
+)
+
+const defaultAPITimeout = 30 * time.Second
+
+// APIError is an error returned by an AWS API.
+type APIError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s: %s (status code %d)", e.Code, e.Message, e.StatusCode)
+}
+
+// Client makes calls to the AWS APIs on behalf of the instance it is running on.
+type Client struct {
+	region      string
+	asgName     string
+	endpoints   map[string]string
+	imds        *IMDS
+	credentials *credentialChain
+	http        *http.Client
+	instanceID  string
+	lock        sync.Mutex
+}
+
+// New creates a client. Anything not set in the configuration is discovered
+// when it is first needed.
+func New(cfg config.AWSConfig) *Client {
+	imds := NewIMDS(cfg.IMDSEndpoint)
+	c := &Client{
+		region:    cfg.Region,
+		asgName:   cfg.AutoScalingGroupName,
+		endpoints: cfg.Endpoints,
+		imds:      imds,
+		http:      &http.Client{Timeout: defaultAPITimeout},
+	}
+	c.credentials = &credentialChain{imds: imds, http: c.http, stsEndpoint: c.stsEndpoint}
+	return c
+}
+
+var (
+	defaultClient = New(config.AWSConfig{})
+	defaultLock   sync.RWMutex
+)
+
+// Setup replaces the client given back by Default.
+// It should be called each time the configuration is loaded.
+func Setup(cfg config.AWSConfig) {
+	defaultLock.Lock()
+	defer defaultLock.Unlock()
+	defaultClient = New(cfg)
+}
+
+// Default returns the client made from the configuration.
+func Default() *Client {
+	defaultLock.RLock()
+	defer defaultLock.RUnlock()
+	return defaultClient
+}
+
+// IMDS returns the client used for the instance metadata service.
+func (c *Client) IMDS() *IMDS {
+	return c.imds
+}
+
+// Region is the configured region, then AWS_REGION or AWS_DEFAULT_REGION
+// and finally the region the instance is in. The lock is not held while the
+// instance metadata is read.
+func (c *Client) Region(ctx context.Context) (string, error) {
+	c.lock.Lock()
+	region := c.region
+	c.lock.Unlock()
+	if region != "" {
+		return region, nil
+	}
+	for _, env := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region = os.Getenv(env); region != "" {
+			break
+		}
+	}
+	if region == "" {
+		found, err := c.imds.Get(ctx, "meta-data/placement/region")
+		if err != nil {
+			return "", fmt.Errorf("failed to discover the region. Error: %s", err)
+		}
+		region = strings.TrimSpace(found)
+	}
+	c.lock.Lock()
+	c.region = region
+	c.lock.Unlock()
+	return region, nil
+}
+
+// InstanceID is the ID of the instance the agent is running on. The lock is
+// not held while the instance metadata is read.
+func (c *Client) InstanceID(ctx context.Context) (string, error) {
+	c.lock.Lock()
+	id := c.instanceID
+	c.lock.Unlock()
+	if id != "" {
+		return id, nil
+	}
+	found, err := c.imds.Get(ctx, "meta-data/instance-id")
+	if err != nil {
+		return "", fmt.Errorf("failed to discover the instance ID. Error: %s", err)
+	}
+	id = strings.TrimSpace(found)
+	c.lock.Lock()
+	c.instanceID = id
+	c.lock.Unlock()
+	return id, nil
+}
+
+// stsEndpoint is the URL of STS in the region, or the global endpoint if the
+// region can not be found.
+func (c *Client) stsEndpoint(ctx context.Context) string {
+	region, err := c.Region(ctx)
+	if err != nil {
+		if endpoint, ok := c.endpoints["sts"]; ok && endpoint != "" {
+			return strings.TrimRight(endpoint, "/")
+		}
+		return "https://sts.amazonaws.com"
+	}
+	return c.endpoint("sts", region)
+}
+
+// endpoint is the URL of the service in the region, unless it has been overridden.
+func (c *Client) endpoint(service, region string) string {
+	if endpoint, ok := c.endpoints[service]; ok && endpoint != "" {
+		return strings.TrimRight(endpoint, "/")
+	}
+	host := fmt.Sprintf("%s.%s.amazonaws.com", service, region)
+	if strings.HasPrefix(region, "cn-") {
+		host += ".cn"
+	}
+	return "https://" + host
+}
+
+// send signs the request and gives back the body of a successful response.
+func (c *Client) send(ctx context.Context, service string, req *http.Request, body []byte, region string) ([]byte, int, error) {
+	creds, err := c.credentials.get(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	sign(req, body, creds, region, service, time.Now())
+	resp, err := c.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(ioLimit(resp))
+	if err != nil {
+		return nil, resp.StatusCode, err
+	}
+	return data, resp.StatusCode, nil
+}
+
+// query calls an API that uses the AWS query protocol, like auto scaling.
+// The XML response is decoded into out if it is not nil.
+func (c *Client) query(ctx context.Context, service, version, action string, params url.Values, out interface{}) error {
+	region, err := c.Region(ctx)
+	if err != nil {
+		return err
+	}
+	if params == nil {
+		params = url.Values{}
+	}
+	params.Set("Action", action)
+	params.Set("Version", version)
+	body := []byte(params.Encode())
+	req, err := http.NewRequest(http.MethodPost, c.endpoint(service, region)+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+
+	data, status, err := c.send(ctx, service, req, body, region)
+	if err != nil {
+		return fmt.Errorf("%s failed. Error: %s", action, err)
+	}
+	if status != http.StatusOK {
+		return queryError(status, data)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := xml.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("failed to read the %s response. Error: %s", action, err)
+	}
+	return nil
+}
+
+// call makes a request to an API that uses the AWS JSON protocol, like ECS.
+// in is sent as the body and the response is decoded into out if it is not nil.
+func (c *Client) call(ctx context.Context, service, target string, in, out interface{}) error {
+	region, err := c.Region(ctx)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.endpoint(service, region)+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", target)
+
+	action := target[strings.LastIndex(target, ".")+1:]
+	data, status, err := c.send(ctx, service, req, body, region)
+	if err != nil {
+		return fmt.Errorf("%s failed. Error: %s", action, err)
+	}
+	if status != http.StatusOK {
+		return jsonError(status, data)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("failed to read the %s response. Error: %s", action, err)
+	}
+	return nil
+}
+
+func jsonError(status int, data []byte) error {
+	apiErr := &APIError{StatusCode: status, Code: "Unknown", Message: strings.TrimSpace(string(data))}
+	doc := struct {
+		Type         string `json:"__type"`
+		Message      string `json:"message"`
+		MessageUpper string `json:"Message"`
+	}{}
+	if err := json.Unmarshal(data, &doc); err == nil && doc.Type != "" {
+		// The type can be prefixed with the namespace, eg: com.amazonaws.ecs#ClusterNotFoundException
+		apiErr.Code = doc.Type[strings.LastIndex(doc.Type, "#")+1:]
+		apiErr.Message = doc.Message
+		if apiErr.Message == "" {
+			apiErr.Message = doc.MessageUpper
+		}
+	}
+	return apiErr
+}
+
+func queryError(status int, data []byte) error {
+	apiErr := &APIError{StatusCode: status, Code: "Unknown", Message: strings.TrimSpace(string(data))}
+	doc := struct {
+		Error struct {
+			Code    string
+			Message string
+		}
+	}{}
+	if err := xml.Unmarshal(data, &doc); err == nil && doc.Error.Code != "" {
+		apiErr.Code = doc.Error.Code
+		apiErr.Message = doc.Error.Message
+	}
+	return apiErr
+}
+
+func ioLimit(resp *http.Response) io.Reader {
+	return io.LimitReader(resp.Body, maxResponseBytes)
+}
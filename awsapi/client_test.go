@@ -0,0 +1,331 @@
+package awsapi
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/morfien101/asg-healthcheck-agent/config"
+)
+
+// stub pretends to be the instance metadata service and the query APIs.
+type stub struct {
+	*httptest.Server
+	metadata  map[string]string
+	errorCode string
+	calls     []url.Values
+	headers   []http.Header
+	lock      sync.Mutex
+}
+
+func newStub() *stub {
+	s := &stub{metadata: map[string]string{
+		"meta-data/instance-id":      "i-0123456789",
+		"meta-data/placement/region": "eu-west-1",
+	}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+func (s *stub) handle(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch {
+	case r.Method == http.MethodPut && r.URL.Path == "/latest/api/token":
+		w.Write([]byte("token"))
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/latest/"):
+		if r.Header.Get("X-aws-ec2-metadata-token") != "token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		value, ok := s.metadata[strings.TrimPrefix(r.URL.Path, "/latest/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(value))
+	case r.Method == http.MethodGet && r.URL.Path == "/container-credentials":
+		if r.Header.Get("Authorization") != "container-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, `{"AccessKeyId":"AKIDCONTAINER","SecretAccessKey":"g","Token":"h","Expiration":"%s"}`,
+			time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	case r.Method == http.MethodPost:
+		r.ParseForm()
+		s.calls = append(s.calls, r.PostForm)
+		s.headers = append(s.headers, r.Header)
+		if s.errorCode != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "<ErrorResponse><Error><Type>Sender</Type><Code>%s</Code><Message>broken</Message></Error></ErrorResponse>", s.errorCode)
+			return
+		}
+		if r.PostForm.Get("Action") == "DescribeAutoScalingInstances" {
+			w.Write([]byte(`<DescribeAutoScalingInstancesResponse><DescribeAutoScalingInstancesResult><AutoScalingInstances><member>
+<InstanceId>i-0123456789</InstanceId><AutoScalingGroupName>from-api</AutoScalingGroupName>
+</member></AutoScalingInstances></DescribeAutoScalingInstancesResult></DescribeAutoScalingInstancesResponse>`))
+			return
+		}
+		if r.PostForm.Get("Action") == "AssumeRoleWithWebIdentity" && r.PostForm.Get("WebIdentityToken") == "web-token" {
+			fmt.Fprintf(w, `<AssumeRoleWithWebIdentityResponse><AssumeRoleWithWebIdentityResult><Credentials>
+<AccessKeyId>AKIDWEB</AccessKeyId><SecretAccessKey>i</SecretAccessKey><SessionToken>j</SessionToken><Expiration>%s</Expiration>
+</Credentials></AssumeRoleWithWebIdentityResult></AssumeRoleWithWebIdentityResponse>`, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+			return
+		}
+		w.Write([]byte("<Response></Response>"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s *stub) client() *Client {
+	return New(config.AWSConfig{
+		IMDSEndpoint: s.URL,
+		Endpoints:    map[string]string{"autoscaling": s.URL},
+	})
+}
+
+// setEnv sets environment variables, unsetting empty ones. The returned function restores them.
+func setEnv(env map[string]string) func() {
+	old := map[string]*string{}
+	for key, value := range env {
+		if current, ok := os.LookupEnv(key); ok {
+			old[key] = &current
+		} else {
+			old[key] = nil
+		}
+		if value == "" {
+			os.Unsetenv(key)
+		} else {
+			os.Setenv(key, value)
+		}
+	}
+	return func() {
+		for key, value := range old {
+			if value == nil {
+				os.Unsetenv(key)
+			} else {
+				os.Setenv(key, *value)
+			}
+		}
+	}
+}
+
+func testCredentials() func() {
+	return setEnv(map[string]string{
+		"AWS_ACCESS_KEY_ID":     "AKIDTEST",
+		"AWS_SECRET_ACCESS_KEY": "secret",
+		"AWS_SESSION_TOKEN":     "",
+		"AWS_REGION":            "",
+		"AWS_DEFAULT_REGION":    "",
+	})
+}
+
+func TestSetInstanceHealth(t *testing.T) {
+	defer testCredentials()()
+	s := newStub()
+	defer s.Close()
+
+	err := s.client().SetInstanceHealth(context.Background(), "i-0123456789", config.ASGUnhealthy, true)
+	if err != nil {
+		t.Fatalf("SetInstanceHealth failed. Error: %s", err)
+	}
+	if len(s.calls) != 1 {
+		t.Fatalf("Expected 1 call, got %d", len(s.calls))
+	}
+	call := s.calls[0]
+	for key, value := range map[string]string{
+		"Action":                   "SetInstanceHealth",
+		"Version":                  autoScalingVersion,
+		"InstanceId":               "i-0123456789",
+		"HealthStatus":             "Unhealthy",
+		"ShouldRespectGracePeriod": "true",
+	} {
+		if call.Get(key) != value {
+			t.Errorf("Expected %s to be %s, got %s", key, value, call.Get(key))
+		}
+	}
+	auth := s.headers[0].Get("Authorization")
+	if !strings.Contains(auth, "AKIDTEST/") || !strings.Contains(auth, "/eu-west-1/autoscaling/aws4_request") {
+		t.Errorf("Request was not signed for the discovered region, got %s", auth)
+	}
+}
+
+func TestLifecycleActions(t *testing.T) {
+	defer testCredentials()()
+	s := newStub()
+	defer s.Close()
+	client := s.client()
+
+	action := LifecycleAction{AutoScalingGroupName: "asg", LifecycleHookName: "drain", InstanceID: "i-0123456789"}
+	if err := client.RecordLifecycleActionHeartbeat(context.Background(), action); err != nil {
+		t.Fatalf("RecordLifecycleActionHeartbeat failed. Error: %s", err)
+	}
+	if err := client.CompleteLifecycleAction(context.Background(), action, config.LifecycleActionAbandon); err != nil {
+		t.Fatalf("CompleteLifecycleAction failed. Error: %s", err)
+	}
+	if s.calls[0].Get("Action") != "RecordLifecycleActionHeartbeat" || s.calls[1].Get("Action") != "CompleteLifecycleAction" {
+		t.Fatalf("Unexpected calls %v", s.calls)
+	}
+	if s.calls[1].Get("LifecycleActionResult") != "ABANDON" ||
+		s.calls[1].Get("AutoScalingGroupName") != "asg" ||
+		s.calls[1].Get("LifecycleHookName") != "drain" {
+		t.Errorf("Unexpected CompleteLifecycleAction parameters %v", s.calls[1])
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	defer testCredentials()()
+	s := newStub()
+	defer s.Close()
+	s.errorCode = "ValidationError"
+
+	err := s.client().SetInstanceHealth(context.Background(), "i-0123456789", config.ASGUnhealthy, false)
+	apiErr, ok := err.(*APIError)
+	if !ok {
+		t.Fatalf("Expected an APIError, got %v", err)
+	}
+	if apiErr.Code != "ValidationError" || apiErr.Message != "broken" || apiErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("Unexpected error %+v", apiErr)
+	}
+}
+
+func TestAutoScalingGroupName(t *testing.T) {
+	defer testCredentials()()
+	s := newStub()
+	defer s.Close()
+
+	name, err := s.client().AutoScalingGroupName(context.Background())
+	if err != nil || name != "from-api" {
+		t.Errorf("Expected the group from the API, got %q. Error: %v", name, err)
+	}
+
+	s.metadata["meta-data/tags/instance/aws:autoscaling:groupName"] = "from-tags"
+	calls := len(s.calls)
+	name, err = s.client().AutoScalingGroupName(context.Background())
+	if err != nil || name != "from-tags" {
+		t.Errorf("Expected the group from the tags, got %q. Error: %v", name, err)
+	}
+	if len(s.calls) != calls {
+		t.Errorf("Did not expect the API to be called when the tags are available")
+	}
+
+	client := New(config.AWSConfig{IMDSEndpoint: s.URL, AutoScalingGroupName: "configured"})
+	if name, _ := client.AutoScalingGroupName(context.Background()); name != "configured" {
+		t.Errorf("Expected the configured group, got %q", name)
+	}
+}
+
+func TestCredentialChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "awsapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	credsFile := filepath.Join(dir, "credentials")
+	err = ioutil.WriteFile(credsFile, []byte("[default]\naws_access_key_id = AKIDDEFAULT\naws_secret_access_key = a\n\n[agent]\n# comment\naws_access_key_id=AKIDAGENT\naws_secret_access_key=b\naws_session_token=c\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("web-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer setEnv(map[string]string{
+		"AWS_WEB_IDENTITY_TOKEN_FILE":            "",
+		"AWS_ROLE_ARN":                           "",
+		"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI": "",
+		"AWS_CONTAINER_CREDENTIALS_FULL_URI":     "",
+		"AWS_CONTAINER_AUTHORIZATION_TOKEN":      "",
+		"AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE": "",
+	})()
+	s := newStub()
+	defer s.Close()
+	s.metadata["meta-data/iam/security-credentials/"] = "agent-role\n"
+	s.metadata["meta-data/iam/security-credentials/agent-role"] = fmt.Sprintf(
+		`{"Code":"Success","AccessKeyId":"AKIDROLE","SecretAccessKey":"d","Token":"e","Expiration":"%s"}`,
+		time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+	)
+
+	tests := []struct {
+		name     string
+		env      map[string]string
+		expected string
+	}{
+		{
+			name:     "environment",
+			env:      map[string]string{"AWS_ACCESS_KEY_ID": "AKIDENV", "AWS_SECRET_ACCESS_KEY": "f", "AWS_SHARED_CREDENTIALS_FILE": credsFile},
+			expected: "AKIDENV",
+		},
+		{
+			name:     "shared file default profile",
+			env:      map[string]string{"AWS_ACCESS_KEY_ID": "", "AWS_SHARED_CREDENTIALS_FILE": credsFile, "AWS_PROFILE": ""},
+			expected: "AKIDDEFAULT",
+		},
+		{
+			name:     "shared file named profile",
+			env:      map[string]string{"AWS_ACCESS_KEY_ID": "", "AWS_SHARED_CREDENTIALS_FILE": credsFile, "AWS_PROFILE": "agent"},
+			expected: "AKIDAGENT",
+		},
+		{
+			name: "web identity",
+			env: map[string]string{"AWS_ACCESS_KEY_ID": "", "AWS_SHARED_CREDENTIALS_FILE": filepath.Join(dir, "missing"),
+				"AWS_WEB_IDENTITY_TOKEN_FILE": tokenFile, "AWS_ROLE_ARN": "arn:aws:iam::123456789012:role/agent",
+				"AWS_CONTAINER_CREDENTIALS_FULL_URI": s.URL + "/container-credentials"},
+			expected: "AKIDWEB",
+		},
+		{
+			name: "container",
+			env: map[string]string{"AWS_ACCESS_KEY_ID": "", "AWS_SHARED_CREDENTIALS_FILE": filepath.Join(dir, "missing"),
+				"AWS_CONTAINER_CREDENTIALS_FULL_URI": s.URL + "/container-credentials", "AWS_CONTAINER_AUTHORIZATION_TOKEN": "container-token"},
+			expected: "AKIDCONTAINER",
+		},
+		{
+			name:     "instance role",
+			env:      map[string]string{"AWS_ACCESS_KEY_ID": "", "AWS_SHARED_CREDENTIALS_FILE": filepath.Join(dir, "missing")},
+			expected: "AKIDROLE",
+		},
+	}
+	for _, test := range tests {
+		restore := setEnv(test.env)
+		cc := &credentialChain{imds: NewIMDS(s.URL), stsEndpoint: func(context.Context) string { return s.URL }}
+		creds, err := cc.get(context.Background())
+		restore()
+		if err != nil {
+			t.Errorf("%s: failed to get credentials. Error: %s", test.name, err)
+			continue
+		}
+		if creds.AccessKeyID != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, creds.AccessKeyID)
+		}
+	}
+}
+
+func TestIMDSNotFound(t *testing.T) {
+	s := newStub()
+	defer s.Close()
+	if _, err := NewIMDS(s.URL).Get(context.Background(), "meta-data/missing"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestJSONError(t *testing.T) {
+	err := jsonError(http.StatusBadRequest, []byte(`{"__type":"com.amazonaws.ecs#ClusterNotFoundException","message":"Cluster not found."}`))
+	apiErr, ok := err.(*APIError)
+	if !ok || apiErr.Code != "ClusterNotFoundException" || apiErr.Message != "Cluster not found." {
+		t.Errorf("Unexpected error %+v", err)
+	}
+	err = jsonError(http.StatusInternalServerError, []byte("oops"))
+	if apiErr, ok := err.(*APIError); !ok || apiErr.Code != "Unknown" || apiErr.Message != "oops" {
+		t.Errorf("Unexpected error %+v", err)
+	}
+}
@@ -0,0 +1,316 @@
+package awsapi
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Credentials are refreshed this long before they expire.
+	credentialsExpiryWindow = 5 * time.Minute
+	// AWS_CONTAINER_CREDENTIALS_RELATIVE_URI is a path on this host.
+	containerCredentialsHost = "http://169.254.170.2"
+	// Used when AWS_ROLE_SESSION_NAME is not set.
+	defaultRoleSessionName = "asg-healthcheck-agent"
+)
+
+// Credentials are used to sign requests.
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// Zero if the credentials do not expire.
+	Expires time.Time
+}
+
+func (c Credentials) valid(now time.Time) bool {
+	if c.AccessKeyID == "" {
+		return false
+	}
+	return c.Expires.IsZero() || now.Before(c.Expires.Add(-credentialsExpiryWindow))
+}
+
+// credentialChain finds credentials in the same places as the AWS CLI. In order:
+// the environment, the shared credentials file, a web identity token, the
+// container credentials endpoint and then the instance role.
+type credentialChain struct {
+	imds *IMDS
+	http *http.Client
+	// stsEndpoint gives back the URL of STS, used to assume a role with a web identity.
+	stsEndpoint func(ctx context.Context) string
+	cached      Credentials
+	lock        sync.Mutex
+}
+
+func (cc *credentialChain) get(ctx context.Context) (Credentials, error) {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	if cc.cached.valid(time.Now()) {
+		return cc.cached, nil
+	}
+
+	creds, ok := envCredentials()
+	providers := []func() (Credentials, bool, error){
+		sharedCredentials,
+		func() (Credentials, bool, error) { return cc.webIdentityCredentials(ctx) },
+		func() (Credentials, bool, error) { return cc.containerCredentials(ctx) },
+	}
+	for _, provider := range providers {
+		if ok {
+			break
+		}
+		var err error
+		creds, ok, err = provider()
+		if err != nil {
+			return Credentials{}, err
+		}
+	}
+	if !ok {
+		var err error
+		creds, err = cc.instanceRoleCredentials(ctx)
+		if err != nil {
+			return Credentials{}, fmt.Errorf("no credentials found in the environment, shared credentials file, web identity, container or instance role. Error: %s", err)
+		}
+	}
+	cc.cached = creds
+	return creds, nil
+}
+
+func (cc *credentialChain) client() *http.Client {
+	if cc.http == nil {
+		return &http.Client{Timeout: defaultAPITimeout}
+	}
+	return cc.http
+}
+
+func envCredentials() (Credentials, bool) {
+	creds := Credentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	return creds, creds.AccessKeyID != "" && creds.SecretAccessKey != ""
+}
+
+// sharedCredentials reads the profile named by AWS_PROFILE, or default, from the
+// shared credentials file. A missing file or profile is not an error.
+func sharedCredentials() (Credentials, bool, error) {
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return Credentials{}, false, nil
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return Credentials{}, false, nil
+	}
+	if err != nil {
+		return Credentials{}, false, fmt.Errorf("failed to read shared credentials file %s. Error: %s", path, err)
+	}
+	defer f.Close()
+
+	creds := Credentials{}
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if section != profile {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(parts[1])
+		switch strings.TrimSpace(parts[0]) {
+		case "aws_access_key_id":
+			creds.AccessKeyID = value
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = value
+		case "aws_session_token":
+			creds.SessionToken = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return Credentials{}, false, fmt.Errorf("failed to read shared credentials file %s. Error: %s", path, err)
+	}
+	return creds, creds.AccessKeyID != "" && creds.SecretAccessKey != "", nil
+}
+
+// webIdentityCredentials assumes the role in AWS_ROLE_ARN with the token in
+// AWS_WEB_IDENTITY_TOKEN_FILE, which is how EKS gives pods a role.
+func (cc *credentialChain) webIdentityCredentials(ctx context.Context) (Credentials, bool, error) {
+	tokenFile := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	roleARN := os.Getenv("AWS_ROLE_ARN")
+	if tokenFile == "" || roleARN == "" {
+		return Credentials{}, false, nil
+	}
+	token, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return Credentials{}, false, fmt.Errorf("failed to read the web identity token. Error: %s", err)
+	}
+	sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if sessionName == "" {
+		sessionName = defaultRoleSessionName
+	}
+	endpoint := "https://sts.amazonaws.com"
+	if cc.stsEndpoint != nil {
+		endpoint = cc.stsEndpoint(ctx)
+	}
+
+	// AssumeRoleWithWebIdentity is not signed, the token proves who we are.
+	params := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {roleARN},
+		"RoleSessionName":  {sessionName},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint+"/", strings.NewReader(params.Encode()))
+	if err != nil {
+		return Credentials{}, false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	resp, err := cc.client().Do(req.WithContext(ctx))
+	if err != nil {
+		return Credentials{}, false, fmt.Errorf("AssumeRoleWithWebIdentity failed. Error: %s", err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(ioLimit(resp))
+	if err != nil {
+		return Credentials{}, false, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Credentials{}, false, fmt.Errorf("AssumeRoleWithWebIdentity failed. Error: %s", queryError(resp.StatusCode, data))
+	}
+	doc := struct {
+		Credentials struct {
+			AccessKeyID     string `xml:"AccessKeyId"`
+			SecretAccessKey string
+			SessionToken    string
+			Expiration      time.Time
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}{}
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return Credentials{}, false, fmt.Errorf("failed to read the AssumeRoleWithWebIdentity response. Error: %s", err)
+	}
+	return Credentials{
+		AccessKeyID:     doc.Credentials.AccessKeyID,
+		SecretAccessKey: doc.Credentials.SecretAccessKey,
+		SessionToken:    doc.Credentials.SessionToken,
+		Expires:         doc.Credentials.Expiration,
+	}, true, nil
+}
+
+// containerCredentials gets the credentials of the ECS task role, or the EKS pod
+// identity, from the endpoint given to the container.
+func (cc *credentialChain) containerCredentials(ctx context.Context) (Credentials, bool, error) {
+	endpoint := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		endpoint = containerCredentialsHost + uri
+	}
+	if endpoint == "" {
+		return Credentials{}, false, nil
+	}
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return Credentials{}, false, err
+	}
+	token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if tokenFile := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); tokenFile != "" {
+		b, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return Credentials{}, false, fmt.Errorf("failed to read the container authorization token. Error: %s", err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	resp, err := cc.client().Do(req.WithContext(ctx))
+	if err != nil {
+		return Credentials{}, false, fmt.Errorf("failed to get the container credentials. Error: %s", err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(ioLimit(resp))
+	if err != nil {
+		return Credentials{}, false, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Credentials{}, false, fmt.Errorf("failed to get the container credentials, status code %d", resp.StatusCode)
+	}
+	doc := roleCredentials{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return Credentials{}, false, fmt.Errorf("failed to read the container credentials. Error: %s", err)
+	}
+	return doc.credentials(), true, nil
+}
+
+// roleCredentials is the document given back by the instance metadata and
+// the container credentials endpoint.
+type roleCredentials struct {
+	Code            string
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+func (doc roleCredentials) credentials() Credentials {
+	return Credentials{
+		AccessKeyID:     doc.AccessKeyID,
+		SecretAccessKey: doc.SecretAccessKey,
+		SessionToken:    doc.Token,
+		Expires:         doc.Expiration,
+	}
+}
+
+// instanceRoleCredentials gets the credentials of the role attached to the instance.
+func (cc *credentialChain) instanceRoleCredentials(ctx context.Context) (Credentials, error) {
+	roles, err := cc.imds.Get(ctx, "meta-data/iam/security-credentials/")
+	if err != nil {
+		return Credentials{}, err
+	}
+	role := strings.TrimSpace(strings.SplitN(roles, "\n", 2)[0])
+	if role == "" {
+		return Credentials{}, fmt.Errorf("the instance does not have a role")
+	}
+	body, err := cc.imds.Get(ctx, "meta-data/iam/security-credentials/"+role)
+	if err != nil {
+		return Credentials{}, err
+	}
+	doc := roleCredentials{}
+	if err := json.Unmarshal([]byte(body), &doc); err != nil {
+		return Credentials{}, fmt.Errorf("failed to read the credentials of role %s. Error: %s", role, err)
+	}
+	if doc.Code != "" && doc.Code != "Success" {
+		return Credentials{}, fmt.Errorf("failed to get the credentials of role %s, code %s", role, doc.Code)
+	}
+	return doc.credentials(), nil
+}
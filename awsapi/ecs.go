@@ -0,0 +1,119 @@
+package awsapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	ecsService      = "ecs"
+	ecsTargetPrefix = "AmazonEC2ContainerServiceV20141113."
+	// DefaultECSAgentEndpoint is the address of the ECS agent introspection API.
+	DefaultECSAgentEndpoint = "http://localhost:51678"
+)
+
+// ECSAgentMetadata is what the local ECS agent knows about the instance.
+type ECSAgentMetadata struct {
+	Cluster              string `json:"Cluster"`
+	ContainerInstanceArn string `json:"ContainerInstanceArn"`
+	Version              string `json:"Version"`
+}
+
+// ReadECSAgentMetadata asks the ECS agent introspection API at endpoint which cluster
+// and container instance it is. An empty endpoint uses DefaultECSAgentEndpoint.
+func ReadECSAgentMetadata(ctx context.Context, endpoint string) (ECSAgentMetadata, error) {
+	metadata := ECSAgentMetadata{}
+	if endpoint == "" {
+		endpoint = DefaultECSAgentEndpoint
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(endpoint, "/")+"/v1/metadata", nil)
+	if err != nil {
+		return metadata, err
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return metadata, fmt.Errorf("failed to read the ECS agent metadata. Error: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(ioLimit(resp))
+	if err != nil {
+		return metadata, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return metadata, fmt.Errorf("failed to read the ECS agent metadata, status code %d", resp.StatusCode)
+	}
+	if err := json.Unmarshal(body, &metadata); err != nil {
+		return metadata, fmt.Errorf("failed to read the ECS agent metadata. Error: %s", err)
+	}
+	if metadata.Cluster == "" || metadata.ContainerInstanceArn == "" {
+		return metadata, fmt.Errorf("the ECS agent has not registered the container instance yet")
+	}
+	return metadata, nil
+}
+
+type ecsFailure struct {
+	Arn    string `json:"arn"`
+	Reason string `json:"reason"`
+}
+
+func ecsFailures(failures []ecsFailure) error {
+	if len(failures) == 0 {
+		return nil
+	}
+	reasons := make([]string, len(failures))
+	for i, failure := range failures {
+		reasons[i] = fmt.Sprintf("%s: %s", failure.Arn, failure.Reason)
+	}
+	return fmt.Errorf("ECS reported failures: %s", strings.Join(reasons, ", "))
+}
+
+// UpdateContainerInstanceState sets the status of a container instance, eg: DRAINING.
+func (c *Client) UpdateContainerInstanceState(ctx context.Context, cluster, containerInstanceArn, status string) error {
+	in := map[string]interface{}{
+		"cluster":            cluster,
+		"containerInstances": []string{containerInstanceArn},
+		"status":             status,
+	}
+	out := struct {
+		Failures []ecsFailure `json:"failures"`
+	}{}
+	if err := c.call(ctx, ecsService, ecsTargetPrefix+"UpdateContainerInstancesState", in, &out); err != nil {
+		return err
+	}
+	return ecsFailures(out.Failures)
+}
+
+// ContainerInstance is the state of an ECS container instance.
+type ContainerInstance struct {
+	Status            string `json:"status"`
+	RunningTasksCount int64  `json:"runningTasksCount"`
+	PendingTasksCount int64  `json:"pendingTasksCount"`
+}
+
+// DescribeContainerInstance gets the status and task counts of a container instance.
+func (c *Client) DescribeContainerInstance(ctx context.Context, cluster, containerInstanceArn string) (ContainerInstance, error) {
+	in := map[string]interface{}{
+		"cluster":            cluster,
+		"containerInstances": []string{containerInstanceArn},
+	}
+	out := struct {
+		ContainerInstances []ContainerInstance `json:"containerInstances"`
+		Failures           []ecsFailure        `json:"failures"`
+	}{}
+	if err := c.call(ctx, ecsService, ecsTargetPrefix+"DescribeContainerInstances", in, &out); err != nil {
+		return ContainerInstance{}, err
+	}
+	if err := ecsFailures(out.Failures); err != nil {
+		return ContainerInstance{}, err
+	}
+	if len(out.ContainerInstances) == 0 {
+		return ContainerInstance{}, fmt.Errorf("container instance %s was not found", containerInstanceArn)
+	}
+	return out.ContainerInstances[0], nil
+}
@@ -0,0 +1,89 @@
+package awsapi
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+)
+
+const (
+	elbService = "elasticloadbalancing"
+	elbVersion = "2015-12-01"
+)
+
+// TargetStateUnused is the state of a target that is not registered or has
+// finished deregistering.
+const TargetStateUnused = "unused"
+
+// Target is a target in an ALB or NLB target group.
+type Target struct {
+	ID   string `xml:"Id"`
+	Port int64  `xml:"Port"`
+}
+
+// TargetHealth is the state of a target, eg: healthy, draining or unused.
+type TargetHealth struct {
+	Target Target `xml:"Target"`
+	State  string `xml:"TargetHealth>State"`
+	Reason string `xml:"TargetHealth>Reason"`
+}
+
+func addTargets(params url.Values, targets []Target) {
+	for i, target := range targets {
+		params.Set(fmt.Sprintf("Targets.member.%d.Id", i+1), target.ID)
+		if target.Port != 0 {
+			params.Set(fmt.Sprintf("Targets.member.%d.Port", i+1), fmt.Sprintf("%d", target.Port))
+		}
+	}
+}
+
+// DescribeTargetHealth gets the health of targets in a target group. Without
+// targets every registered target is described.
+func (c *Client) DescribeTargetHealth(ctx context.Context, targetGroupArn string, targets []Target) ([]TargetHealth, error) {
+	params := url.Values{"TargetGroupArn": {targetGroupArn}}
+	addTargets(params, targets)
+	resp := struct {
+		Targets []TargetHealth `xml:"DescribeTargetHealthResult>TargetHealthDescriptions>member"`
+	}{}
+	err := c.query(ctx, elbService, elbVersion, "DescribeTargetHealth", params, &resp)
+	return resp.Targets, err
+}
+
+// DeregisterTargets starts deregistering the targets from a target group.
+func (c *Client) DeregisterTargets(ctx context.Context, targetGroupArn string, targets []Target) error {
+	params := url.Values{"TargetGroupArn": {targetGroupArn}}
+	addTargets(params, targets)
+	return c.query(ctx, elbService, elbVersion, "DeregisterTargets", params, nil)
+}
+
+// InstanceTargetGroups lists every target group in the region that registers
+// targets by instance ID.
+func (c *Client) InstanceTargetGroups(ctx context.Context) ([]string, error) {
+	arns := []string{}
+	marker := ""
+	for {
+		params := url.Values{}
+		if marker != "" {
+			params.Set("Marker", marker)
+		}
+		resp := struct {
+			TargetGroups []struct {
+				TargetGroupArn string
+				TargetType     string
+			} `xml:"DescribeTargetGroupsResult>TargetGroups>member"`
+			NextMarker string `xml:"DescribeTargetGroupsResult>NextMarker"`
+		}{}
+		if err := c.query(ctx, elbService, elbVersion, "DescribeTargetGroups", params, &resp); err != nil {
+			return nil, err
+		}
+		for _, tg := range resp.TargetGroups {
+			if tg.TargetType == "" || tg.TargetType == "instance" {
+				arns = append(arns, tg.TargetGroupArn)
+			}
+		}
+		if resp.NextMarker == "" {
+			return arns, nil
+		}
+		marker = resp.NextMarker
+	}
+}
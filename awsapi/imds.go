@@ -0,0 +1,142 @@
+package awsapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultIMDSEndpoint is the address of the EC2 instance metadata service.
+const DefaultIMDSEndpoint = "http://169.254.169.254"
+
+const (
+	imdsTokenTTL     = 6 * time.Hour
+	imdsTimeout      = 5 * time.Second
+	maxResponseBytes = 1024 * 1024
+)
+
+// ErrNotFound is returned when a path does not exist in the instance metadata.
+// Some paths, like the instance tags, only exist if they have been enabled.
+var ErrNotFound = errors.New("not found in the instance metadata")
+
+// IMDS reads from the instance metadata service using IMDSv2 session tokens.
+type IMDS struct {
+	endpoint     string
+	client       *http.Client
+	token        string
+	tokenExpires time.Time
+	lock         sync.Mutex
+}
+
+// NewIMDS creates a client for the instance metadata service at endpoint.
+// An empty endpoint uses DefaultIMDSEndpoint.
+func NewIMDS(endpoint string) *IMDS {
+	if endpoint == "" {
+		endpoint = DefaultIMDSEndpoint
+	}
+	return &IMDS{
+		endpoint: strings.TrimRight(endpoint, "/"),
+		client:   &http.Client{Timeout: imdsTimeout},
+	}
+}
+
+func (m *IMDS) getToken(ctx context.Context) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.token != "" && time.Now().Before(m.tokenExpires) {
+		return m.token, nil
+	}
+
+	req, err := http.NewRequest(http.MethodPut, m.endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", fmt.Sprintf("%d", int(imdsTokenTTL.Seconds())))
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to get an instance metadata token. Error: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(ioLimit(resp))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get an instance metadata token, status code %d", resp.StatusCode)
+	}
+	m.token = string(body)
+	// Renew a little early so a token never expires in the middle of a request.
+	m.tokenExpires = time.Now().Add(imdsTokenTTL - time.Minute)
+	return m.token, nil
+}
+
+func (m *IMDS) dropToken() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.token = ""
+}
+
+// Get reads a path below /latest/, eg: meta-data/instance-id.
+// ErrNotFound is returned if the path does not exist.
+func (m *IMDS) Get(ctx context.Context, path string) (string, error) {
+	token, err := m.getToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodGet, m.endpoint+"/latest/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("X-aws-ec2-metadata-token", token)
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s from the instance metadata. Error: %s", path, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(ioLimit(resp))
+	if err != nil {
+		return "", err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return string(body), nil
+	case http.StatusNotFound:
+		return "", ErrNotFound
+	case http.StatusUnauthorized:
+		// The token has expired or been revoked, get a new one next time.
+		m.dropToken()
+	}
+	return "", fmt.Errorf("failed to read %s from the instance metadata, status code %d", path, resp.StatusCode)
+}
+
+// InstanceIdentity is the instance identity document.
+type InstanceIdentity struct {
+	AccountID        string `json:"accountId"`
+	AvailabilityZone string `json:"availabilityZone"`
+	ImageID          string `json:"imageId"`
+	InstanceID       string `json:"instanceId"`
+	InstanceType     string `json:"instanceType"`
+	PrivateIP        string `json:"privateIp"`
+	Region           string `json:"region"`
+}
+
+// InstanceIdentity reads the instance identity document.
+func (m *IMDS) InstanceIdentity(ctx context.Context) (InstanceIdentity, error) {
+	doc := InstanceIdentity{}
+	body, err := m.Get(ctx, "dynamic/instance-identity/document")
+	if err != nil {
+		return doc, err
+	}
+	if err := json.Unmarshal([]byte(body), &doc); err != nil {
+		return doc, fmt.Errorf("failed to read the instance identity document. Error: %s", err)
+	}
+	return doc, nil
+}
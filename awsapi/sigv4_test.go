@@ -0,0 +1,44 @@
+package awsapi
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Uses the example from the AWS signature version 4 documentation.
+func TestSign(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "https://iam.amazonaws.com/?Version=2010-05-08&Action=ListUsers", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	creds := Credentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+	sign(req, nil, creds, "us-east-1", "iam", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, " +
+		"SignedHeaders=content-type;host;x-amz-date, " +
+		"Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"
+	if got := req.Header.Get("Authorization"); got != expected {
+		t.Errorf("Unexpected Authorization header.\nGot:      %s\nExpected: %s", got, expected)
+	}
+	if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+		t.Errorf("Unexpected X-Amz-Date %s", got)
+	}
+
+	creds.SessionToken = "session"
+	sign(req, nil, creds, "us-east-1", "iam", time.Now())
+	if !strings.Contains(req.Header.Get("Authorization"), "x-amz-security-token") {
+		t.Errorf("Expected the session token to be signed, got %s", req.Header.Get("Authorization"))
+	}
+}
+
+func TestURIEncode(t *testing.T) {
+	if got := uriEncode("a b/c~d=é"); got != "a%20b%2Fc~d%3D%C3%A9" {
+		t.Errorf("Unexpected encoding %s", got)
+	}
+}
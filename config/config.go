@@ -8,6 +8,10 @@ import "os"
 
 type Config struct {
 	HealthChecks []HealthCheck `json:"health_checks"`
+	// CheckGroups apply a policy to a set of health checks, eg: only fail if 2
+	// of 3 upstream dependencies are failing. Checks that are not in a group
+	// cause a stable failure on their own.
+	CheckGroups  []CheckGroup  `json:"check_groups"`
 	FailureHooks []FailureHook `json:"failure_hooks"`
 	// Wait x seconds before processing failures
 	StartupGraceSeconds uint `json:"startup_grace_seconds"`
@@ -24,6 +28,25 @@ type Config struct {
 	// the service will sit idle till it is stopped.
 	// Default is false.
 	ExitAfterFailureHooks bool `json:"exit_after_failure_hooks"`
+	// FailureHooksDeadlineSeconds limits how long the failure hooks can run for in
+	// total. Once it has passed, the remaining hooks are skipped unless they
+	// are marked always_run. 0 means no deadline.
+	FailureHooksDeadlineSeconds uint `json:"failure_hooks_deadline_seconds"`
+	// Recoverable keeps the health checks running after a stable failure.
+	// Once every health check has met its recovery_success_count the agent
+	// returns to healthy and runs the recovery hooks. Used on hosts that are
+	// not in an ASG, where failures should alert and remediate but not terminate.
+	// Default is false.
+	Recoverable bool `json:"recoverable"`
+	// RecoveryHooks are run when a recoverable agent returns to healthy.
+	RecoveryHooks []FailureHook `json:"recovery_hooks"`
+	// TerminationHooks are run when the imds_watcher sees the auto scaling group
+	// move the instance to Terminated, like on a scale in, even if it is healthy.
+	TerminationHooks []FailureHook `json:"termination_hooks"`
+	// StateFile is where the health, health check counters and failure hook
+	// progress are saved. The state is restored when the agent starts so that
+	// a restart does not reset a stable failure. Empty disables it.
+	StateFile string `json:"state_file"`
 	// Pretty logs is used to make the logging engine pretty JSON logs.
 	// Should only be used in testing situations.
 	PrettyLogs bool `json:"pretty_logs"`
@@ -32,8 +55,20 @@ type Config struct {
 	// successfully starting. These can be used to help identify logs for
 	// groups of servers.
 	DefaultLoggingAttributes map[string]string `json:"logging_attributes"`
-	WebServer                WebServerConfig   `json:"webserver"`
-	StatsD                   StatsDConfig      `json:"statsd"`
+	// The configuration is reloaded on SIGHUP. Setting this will also reload it
+	// when the file changes, checking every watch_config_interval_seconds.
+	WatchConfigFile            bool            `json:"watch_config_file"`
+	WatchConfigIntervalSeconds uint            `json:"watch_config_interval_seconds"`
+	WebServer                  WebServerConfig `json:"webserver"`
+	StatsD                     StatsDConfig    `json:"statsd"`
+	// AWS is used by the built in AWS hooks.
+	AWS AWSConfig `json:"aws"`
+	// IMDSWatcher watches the instance metadata for notices that the instance
+	// is going away and runs the failure hooks when one arrives.
+	IMDSWatcher IMDSWatcherConfig `json:"imds_watcher"`
+	// Identity adds the identity of the instance to the logs, metrics, _status
+	// and hooks. It is discovered when the agent starts.
+	Identity IdentityConfig `json:"identity"`
 }
 
 type WebServerConfig struct {
@@ -43,8 +78,14 @@ type WebServerConfig struct {
 	UseTLS      bool   `json:"use_tls"`
 	TLSCertPath string `json:"cert_path"`
 	TLSKeyPath  string `json:"key_path"`
+	// If set, clients must present a certificate signed by one of the CAs in this
+	// bundle. Only used when use_tls is true.
+	ClientCAPath string `json:"client_ca_path"`
+	// The status code that _status responds with when a check is in a warning
+	// or unknown state. Defaults to 200.
+	DegradedStatusCode int `json:"degraded_status_code"`
 	// returns nicely formatted JSON structures to the requester. This is useful for
-	// reading as a human. Might be removed later for a flag in the query string.
+	// reading as a human. Requesters can also use ?pretty=true|false to override it.
 	PrettyJSON bool `json:"pretty_json_responses"`
 }
 
@@ -58,13 +99,112 @@ type StatsDConfig struct {
 	DefaultTags map[string]string `json:"default_tags"`
 }
 
+// AWSConfig holds the settings for the built in AWS hooks. Anything that is not
+// set is discovered from the instance metadata service when it is first needed.
+// Credentials are found the same way as the AWS CLI.
+type AWSConfig struct {
+	Region               string `json:"region"`
+	AutoScalingGroupName string `json:"autoscaling_group_name"`
+	// Address of the instance metadata service. Defaults to http://169.254.169.254.
+	IMDSEndpoint string `json:"imds_endpoint"`
+	// Endpoints replaces the endpoint of a service, eg: {"autoscaling": "http://127.0.0.1:8080"}.
+	// Used to test against a local stub.
+	Endpoints map[string]string `json:"endpoints"`
+}
+
+// IMDSWatcherConfig holds the settings for watching the instance metadata. The
+// metadata service is found using the aws block.
+type IMDSWatcherConfig struct {
+	Enabled bool `json:"enabled"`
+	// How often the metadata is checked. Defaults to 5.
+	PollIntervalSeconds uint `json:"poll_interval_seconds"`
+	// Run the failure hooks when a spot interruption notice is given. Defaults to true.
+	SpotInterruption bool `json:"spot_interruption"`
+	// Run the failure hooks when EC2 recommends rebalancing away from a spot
+	// instance. Defaults to true.
+	RebalanceRecommendation bool `json:"rebalance_recommendation"`
+	// Watch the auto scaling target lifecycle state and run the termination
+	// hooks when it changes to Terminated. Defaults to true.
+	TargetLifecycleState bool `json:"target_lifecycle_state"`
+}
+
+// IdentityConfig holds the settings for discovering the identity of the
+// instance from the instance metadata. The metadata service is found using
+// the aws block.
+type IdentityConfig struct {
+	Enabled bool `json:"enabled"`
+	// EC2 tags to add to the identity. Access to tags in the instance metadata
+	// must be turned on for the instance.
+	Tags []string `json:"tags"`
+}
+
+// Types of health checks that can be configured.
+const (
+	CheckTypeScript = "script"
+	CheckTypeHTTP   = "http"
+	CheckTypeTCP    = "tcp"
+	CheckTypeUnix   = "unix"
+)
+
+// States that an exit code can be mapped to.
+const (
+	StateOK       = "ok"
+	StateWarning  = "warning"
+	StateCritical = "critical"
+	StateUnknown  = "unknown"
+)
+
+// Output modes for script checks.
+const (
+	OutputModeLog    = "log"
+	OutputModeNagios = "nagios"
+)
+
+// Policies of a check group.
+const (
+	GroupPolicyAny    = "any"
+	GroupPolicyAll    = "all"
+	GroupPolicyQuorum = "quorum"
+)
+
+// CheckGroup is a set of health checks that only cause a stable failure when
+// the policy of the group is met. A health check can only be in one group.
+type CheckGroup struct {
+	Name   string   `json:"name"`
+	Checks []string `json:"checks"`
+	// Policy is any, all or quorum. any fails the group when one of the checks
+	// is stably failing, all when every check is and quorum when at least
+	// min_failing are. Defaults to any.
+	Policy     string `json:"policy"`
+	MinFailing uint   `json:"min_failing"`
+}
+
+// FailuresRequired gives back how many checks need to be stably failing for
+// the policy of the group to be met.
+func (cg CheckGroup) FailuresRequired() uint {
+	switch cg.Policy {
+	case GroupPolicyAll:
+		return uint(len(cg.Checks))
+	case GroupPolicyQuorum:
+		return cg.MinFailing
+	}
+	return 1
+}
+
 // HealthCheck is a test to see if the server if functioning correctly.
 type HealthCheck struct {
 	// Used to show the check in the web server
-	Name        string   `json:"name"`
-	Description string   `json:"description"`
-	Bin         string   `json:"command"`
-	Args        []string `json:"arguments"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Type of check to run. Defaults to "script" which runs the command
+	// with the arguments. "http" will make a request natively using the
+	// settings in the http block. "tcp" and "unix" will connect to the
+	// address in the socket block.
+	Type   string             `json:"type"`
+	Bin    string             `json:"command"`
+	Args   []string           `json:"arguments"`
+	HTTP   *HTTPCheckConfig   `json:"http,omitempty"`
+	Socket *SocketCheckConfig `json:"socket,omitempty"`
 	// How often to run the checks.
 	FreqSeconds uint `json:"frequency_in_seconds"`
 	// How many failures can we accept before a stable failure is accepted
@@ -72,19 +212,231 @@ type HealthCheck struct {
 	// If a check is failing, how any successes are required before the failure
 	// count is reset to 0
 	RecoverySuccessCount uint `json:"recovery_success_count"`
+	// ExitCodeStates maps exit codes to one of ok, warning, critical or unknown.
+	// When it is not set, 0 is ok and anything else is critical.
+	// When it is set, exit codes that are not listed follow the Nagios plugin
+	// conventions: 0 ok, 1 warning, 2 critical, 3 unknown and anything else critical.
+	// Only critical counts towards a stable failure.
+	ExitCodeStates map[string]string `json:"exit_code_states,omitempty"`
+	// Kill the check and count it as a failure if it runs longer than this.
+	// Native checks use this if they do not set their own timeout.
+	// 0 means no timeout for scripts.
+	TimeoutSeconds uint `json:"timeout_seconds"`
+	// OutputMode controls what is done with the stdout of a script check.
+	// "log" is the default and logs each line. "nagios" parses the output as
+	// a Nagios plugin, keeping the status text and sending perf data as metrics.
+	// Nagios mode also uses the Nagios exit codes if exit_code_states is not set.
+	OutputMode string `json:"output_mode"`
+	// Remediation runs commands that may fix the check before it becomes a stable failure.
+	Remediation *RemediationConfig `json:"remediation,omitempty"`
+	// DependsOn names other health checks that this check needs. While any of
+	// them is failing this check is skipped, and its stable failures are
+	// reported against the failing dependency.
+	DependsOn []string `json:"depends_on,omitempty"`
+}
+
+// RemediationConfig holds the commands that are run to try and fix a failing check.
+type RemediationConfig struct {
+	// Run the actions once failures_since_last_recovery reaches this number.
+	// It must not be more than allowed_failures so that the check gets to run
+	// again after the actions before a stable failure is declared.
+	AfterFailures uint `json:"after_failures"`
+	// The most times the actions can be run in an hour. 0 means no limit.
+	MaxPerHour uint `json:"max_per_hour"`
+	// Actions are run in order, each time the threshold is reached.
+	Actions []RemediationAction `json:"actions"`
+}
+
+// RemediationAction is a single command run to try and fix a failing check.
+type RemediationAction struct {
+	Name string   `json:"name"`
+	Bin  string   `json:"command"`
+	Args []string `json:"arguments"`
+	// Kill the action and consider it failed if it runs longer than this.
+	// 0 means no timeout.
+	TimeoutSeconds uint `json:"timeout_seconds"`
+}
+
+// HTTPCheckConfig holds the settings for a check of type "http".
+type HTTPCheckConfig struct {
+	URL     string            `json:"url"`
+	Method  string            `json:"method"`
+	Headers map[string]string `json:"headers"`
+	// Status codes that are considered a success. Defaults to 200.
+	ExpectedStatusCodes []int `json:"expected_status_codes"`
+	// If set the response body must match the regular expression.
+	BodyRegex      string `json:"body_regex"`
+	TimeoutSeconds uint   `json:"timeout_seconds"`
+}
+
+// SocketCheckConfig holds the settings for checks of type "tcp" and "unix".
+type SocketCheckConfig struct {
+	// host:port for tcp checks or the path to the socket for unix checks.
+	Address string `json:"address"`
+	// Optional data to write once connected.
+	Payload string `json:"payload"`
+	// If set the response must start with this value.
+	ExpectedResponsePrefix string `json:"expected_response_prefix"`
+	TimeoutSeconds         uint   `json:"timeout_seconds"`
 }
 
+// Types of hooks that can be configured.
+const (
+	HookTypeScript                     = "script"
+	HookTypeASGSetInstanceHealth       = "asg_set_instance_health"
+	HookTypeASGCompleteLifecycleAction = "asg_complete_lifecycle_action"
+	HookTypeECSDrain                   = "ecs_drain"
+	HookTypeELBDeregister              = "elb_deregister"
+	HookTypeWebhook                    = "webhook"
+)
+
+// Health statuses that can be set on an auto scaling instance.
+const (
+	ASGHealthy   = "Healthy"
+	ASGUnhealthy = "Unhealthy"
+)
+
+// Results that can be given when completing a lifecycle action.
+const (
+	LifecycleActionContinue = "CONTINUE"
+	LifecycleActionAbandon  = "ABANDON"
+)
+
+// What to do when a hook fails after all of its retries.
+const (
+	OnFailureContinue   = "continue"
+	OnFailureAbortChain = "abort_chain"
+	// OnFailureJumpTo is followed by the name of a later hook, eg: jump_to:notify
+	OnFailureJumpTo = "jump_to:"
+)
+
+// Outcomes of a hook that run_if conditions can test.
+const (
+	HookOutcomeSucceeded = "succeeded"
+	HookOutcomeFailed    = "failed"
+	HookOutcomeSkipped   = "skipped"
+)
+
 // FailureHook are scripts run when the health is changed to SICK.
 // These can be used to change de-register instances from services or
 // to change the termination life cycle hooks to proceed.
 type FailureHook struct {
-	Name        string   `json:"name"`
-	Description string   `json:"description"`
-	Bin         string   `json:"command"`
-	Args        []string `json:"arguments"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Type of hook to run. Defaults to "script" which runs the command with the
+	// arguments. The asg_* types make the auto scaling API call natively using
+	// the settings in the asg block, ecs_drain drains the ECS container
+	// instance using the settings in the ecs block, elb_deregister removes
+	// the instance from load balancer target groups using the elb block and
+	// webhook posts the failure to the URL in the webhook block.
+	Type    string             `json:"type"`
+	Bin     string             `json:"command"`
+	Args    []string           `json:"arguments"`
+	ASG     *ASGHookConfig     `json:"asg,omitempty"`
+	ECS     *ECSHookConfig     `json:"ecs,omitempty"`
+	ELB     *ELBHookConfig     `json:"elb,omitempty"`
+	Webhook *WebhookHookConfig `json:"webhook,omitempty"`
 	// If set to more than 0, failures will be retied until the max is hit.
 	MaxRetry                  uint `json:"max_retry"`
 	WaitSecondsBetweenRetries uint `json:"seconds_between_retries"`
+	// Kill the hook and consider it failed if it runs longer than this.
+	// 0 means no timeout.
+	TimeoutSeconds uint `json:"timeout_seconds"`
+	// AlwaysRun hooks are still run after failure_hooks_deadline_seconds has
+	// passed. Used for hooks that must happen, like completing a lifecycle action.
+	AlwaysRun bool `json:"always_run"`
+	// OnFailure is what happens to the rest of the chain if this hook fails.
+	// "continue" is the default, "abort_chain" skips the remaining hooks and
+	// "jump_to:<hook>" skips forward to a later hook.
+	OnFailure string `json:"on_failure"`
+	// RunIf conditions must all be true for the hook to run. Otherwise it is skipped.
+	RunIf []HookCondition `json:"run_if"`
+	// RetryPolicy controls the delay between retries. Without it the hook waits
+	// seconds_between_retries between each attempt.
+	RetryPolicy *RetryPolicy `json:"retry_policy,omitempty"`
+}
+
+// ASGHookConfig holds the settings for the asg_* hook types.
+type ASGHookConfig struct {
+	// Used by asg_set_instance_health. Healthy or Unhealthy, defaults to Unhealthy.
+	HealthStatus             string `json:"health_status"`
+	ShouldRespectGracePeriod bool   `json:"should_respect_grace_period"`
+	// Used by asg_complete_lifecycle_action.
+	LifecycleHookName string `json:"lifecycle_hook_name"`
+	// CONTINUE or ABANDON, defaults to CONTINUE.
+	LifecycleActionResult string `json:"lifecycle_action_result"`
+	// Send a lifecycle heartbeat this often while the hooks before this one are
+	// running, so that the lifecycle action does not time out. 0 disables it.
+	HeartbeatIntervalSeconds uint `json:"heartbeat_interval_seconds"`
+}
+
+// ECSHookConfig holds the settings for the ecs_drain hook type.
+type ECSHookConfig struct {
+	// The cluster and container instance are discovered from the ECS agent if they are not set.
+	Cluster              string `json:"cluster"`
+	ContainerInstanceArn string `json:"container_instance_arn"`
+	// Address of the ECS agent introspection API. Defaults to http://localhost:51678.
+	AgentEndpoint string `json:"agent_endpoint"`
+	// How often to check if the tasks have stopped. Defaults to 10.
+	PollIntervalSeconds uint `json:"poll_interval_seconds"`
+	// How long to wait for the running tasks to stop before the hook fails. Defaults to 600.
+	DrainTimeoutSeconds uint `json:"drain_timeout_seconds"`
+}
+
+// ELBHookConfig holds the settings for the elb_deregister hook type.
+type ELBHookConfig struct {
+	// Target groups to deregister the instance from. When empty, every target
+	// group the instance is registered in is found and used.
+	TargetGroupArns []string `json:"target_group_arns"`
+	// How often to check if the targets have finished draining. Defaults to 10.
+	PollIntervalSeconds uint `json:"poll_interval_seconds"`
+	// How long to wait for the targets to become unused before the hook fails. Defaults to 600.
+	DrainTimeoutSeconds uint `json:"drain_timeout_seconds"`
+}
+
+// WebhookHookConfig holds the settings for the webhook hook type.
+type WebhookHookConfig struct {
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	// Template is a Go text/template that makes the JSON body. Without it the
+	// whole payload is sent.
+	Template string `json:"template"`
+	// When Secret is set the body is signed with HMAC-SHA256 and the signature is
+	// sent in the SignatureHeader, which defaults to X-ASG-HC-Signature.
+	Secret          string `json:"secret"`
+	SignatureHeader string `json:"signature_header"`
+}
+
+// Backoff strategies for retrying hooks.
+const (
+	BackoffFixed       = "fixed"
+	BackoffLinear      = "linear"
+	BackoffExponential = "exponential"
+)
+
+// RetryPolicy describes how long to wait between the retries of a hook.
+type RetryPolicy struct {
+	// One of fixed, linear or exponential. Defaults to fixed.
+	Backoff string `json:"backoff"`
+	// Delay before the first retry. Defaults to seconds_between_retries.
+	InitialDelaySeconds uint `json:"initial_delay_seconds"`
+	// Exponential backoff multiplies the delay by this for each retry. Defaults to 2.
+	Multiplier float64 `json:"multiplier"`
+	// The delay will never be longer than this. 0 means no cap.
+	MaxDelaySeconds uint `json:"max_delay_seconds"`
+	// Full jitter picks a random delay between 0 and the computed delay, which
+	// spreads out the retries of many instances failing at once.
+	Jitter bool `json:"jitter"`
+	// Only retry when the hook exits with one of these codes. Empty retries on
+	// any failure. Timed out hooks have the exit code 124.
+	RetryOnExitCodes []int `json:"retry_on_exit_codes"`
+}
+
+// HookCondition tests the outcome of an earlier hook in the chain.
+type HookCondition struct {
+	Hook string `json:"hook"`
+	// One of succeeded, failed or skipped.
+	Outcome string `json:"outcome"`
 }
 
 func newConfig() Config {
@@ -100,14 +452,19 @@ func newConfig() Config {
 		RunFailureHooksOnTermSignal: false,
 		RunFailureHooks:             true,
 		DefaultLoggingAttributes:    defaultLoggingAttr,
+		WatchConfigIntervalSeconds:  10,
 		HealthChecks:                []HealthCheck{},
+		CheckGroups:                 []CheckGroup{},
 		FailureHooks:                []FailureHook{},
+		RecoveryHooks:               []FailureHook{},
+		TerminationHooks:            []FailureHook{},
 		WebServer: WebServerConfig{
-			Enabled:    true,
-			Address:    "0.0.0.0",
-			Port:       8011,
-			UseTLS:     false,
-			PrettyJSON: true,
+			Enabled:            true,
+			Address:            "0.0.0.0",
+			Port:               8011,
+			UseTLS:             false,
+			DegradedStatusCode: 200,
+			PrettyJSON:         true,
 		},
 		StatsD: StatsDConfig{
 			Enabled:     false,
@@ -116,6 +473,13 @@ func newConfig() Config {
 			Prefix:      "asg_healthcheck",
 			DefaultTags: defaultStatsdAttr,
 		},
+		IMDSWatcher: IMDSWatcherConfig{
+			Enabled:                 false,
+			PollIntervalSeconds:     5,
+			SpotInterruption:        true,
+			RebalanceRecommendation: true,
+			TargetLifecycleState:    true,
+		},
 	}
 
 	return cfg
@@ -123,7 +487,7 @@ func newConfig() Config {
 
 // New creates a new Config and passes it back to the caller.
 // Errors are also passed back and could include not being able to read the file from the disk
-// or it is invalid.
+// or it is invalid. Problems found while validating are returned as ValidationErrors.
 func New(path string) (Config, error) {
 	cfg := newConfig()
 	cfgBytes, err := readConfigFile(path)
@@ -134,6 +498,10 @@ func New(path string) (Config, error) {
 	if err != nil {
 		return Config{}, err
 	}
+	err = validateConfig(cfgBytes, cfg)
+	if err != nil {
+		return Config{}, err
+	}
 
 	return cfg, nil
 }
@@ -146,8 +514,13 @@ func mergeConfigs(configFileData []byte, defaultCfg *Config) error {
 	return json.Unmarshal(configFileData, defaultCfg)
 }
 
-// This can be filled in later once we have more understanding of what we need.
-// 24/02/2020
-func validateConfig() error {
+// validateConfig looks for unknown fields in the config file and then validates
+// the merged config. All the problems found are returned as ValidationErrors.
+func validateConfig(configFileData []byte, cfg Config) error {
+	errs := checkUnknownFields(configFileData)
+	errs = append(errs, cfg.Validate()...)
+	if len(errs) > 0 {
+		return errs
+	}
 	return nil
 }
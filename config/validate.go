@@ -0,0 +1,643 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ValidationError is a single problem found in the configuration.
+// Path is the JSON path to the value that caused the problem.
+type ValidationError struct {
+	Path    string
+	Message string
+}
+
+func (ve ValidationError) Error() string {
+	if ve.Path == "" {
+		return ve.Message
+	}
+	return fmt.Sprintf("%s: %s", ve.Path, ve.Message)
+}
+
+// ValidationErrors holds all the problems found in the configuration.
+type ValidationErrors []ValidationError
+
+func (ves ValidationErrors) Error() string {
+	msgs := make([]string, len(ves))
+	for i, ve := range ves {
+		msgs[i] = ve.Error()
+	}
+	return fmt.Sprintf("invalid configuration: %s", strings.Join(msgs, "; "))
+}
+
+type validator struct {
+	errors ValidationErrors
+}
+
+func (v *validator) add(path, format string, a ...interface{}) {
+	v.errors = append(v.errors, ValidationError{Path: path, Message: fmt.Sprintf(format, a...)})
+}
+
+// checkUnknownFields will look for keys in the configuration file that do not
+// match anything in the Config struct. These are most likely typos that would
+// otherwise be silently ignored.
+func checkUnknownFields(configFileData []byte) ValidationErrors {
+	var raw interface{}
+	if err := json.Unmarshal(configFileData, &raw); err != nil {
+		return ValidationErrors{{Message: fmt.Sprintf("failed to parse JSON. Error: %s", err)}}
+	}
+	v := &validator{}
+	v.walkUnknownFields("", raw, reflect.TypeOf(Config{}))
+	return v.errors
+}
+
+func (v *validator) walkUnknownFields(path string, raw interface{}, t reflect.Type) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := raw.(map[string]interface{})
+		if !ok {
+			return
+		}
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fieldType, found := jsonField(t, key)
+			if !found {
+				v.add(joinPath(path, key), "unknown field")
+				continue
+			}
+			v.walkUnknownFields(joinPath(path, key), obj[key], fieldType)
+		}
+	case reflect.Map:
+		obj, ok := raw.(map[string]interface{})
+		if !ok {
+			return
+		}
+		for key, value := range obj {
+			v.walkUnknownFields(joinPath(path, key), value, t.Elem())
+		}
+	case reflect.Slice:
+		list, ok := raw.([]interface{})
+		if !ok {
+			return
+		}
+		for i, value := range list {
+			v.walkUnknownFields(fmt.Sprintf("%s[%d]", path, i), value, t.Elem())
+		}
+	}
+}
+
+// jsonField finds the type of the field that encoding/json would use for key.
+func jsonField(t reflect.Type, key string) (reflect.Type, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if strings.EqualFold(name, key) {
+			return field.Type, true
+		}
+	}
+	return nil, false
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// Validate looks for problems in a merged configuration.
+// All problems are collected and returned, not just the first one.
+func (cfg Config) Validate() ValidationErrors {
+	v := &validator{}
+
+	names := map[string]int{}
+	for i, hc := range cfg.HealthChecks {
+		path := fmt.Sprintf("health_checks[%d]", i)
+		v.validateHealthCheck(path, hc)
+		if hc.Name != "" {
+			if first, ok := names[hc.Name]; ok {
+				v.add(path+".name", "duplicate name %q, already used by health_checks[%d]", hc.Name, first)
+			} else {
+				names[hc.Name] = i
+			}
+		}
+	}
+
+	v.validateDependencies(cfg.HealthChecks, names)
+	v.validateCheckGroups(cfg.CheckGroups, names)
+
+	v.validateHookChain("failure_hooks", cfg.FailureHooks)
+	v.validateHookChain("recovery_hooks", cfg.RecoveryHooks)
+	v.validateHookChain("termination_hooks", cfg.TerminationHooks)
+	if len(cfg.TerminationHooks) > 0 && !(cfg.IMDSWatcher.Enabled && cfg.IMDSWatcher.TargetLifecycleState) {
+		v.add("termination_hooks", "requires imds_watcher.enabled and imds_watcher.target_lifecycle_state to be true")
+	}
+	if len(cfg.RecoveryHooks) > 0 && !cfg.Recoverable {
+		v.add("recovery_hooks", "requires recoverable to be true")
+	}
+
+	if cfg.StateFile != "" {
+		if info, err := os.Stat(filepath.Dir(cfg.StateFile)); err != nil || !info.IsDir() {
+			v.add("state_file", "directory %q does not exist", filepath.Dir(cfg.StateFile))
+		}
+	}
+
+	if cfg.WatchConfigFile && cfg.WatchConfigIntervalSeconds == 0 {
+		v.add("watch_config_interval_seconds", "must be at least 1 when watch_config_file is true")
+	}
+
+	v.validateWebServer("webserver", cfg.WebServer)
+	v.validateStatsD("statsd", cfg.StatsD)
+	v.validateAWS("aws", cfg.AWS)
+	for i, tag := range cfg.Identity.Tags {
+		if tag == "" {
+			v.add(fmt.Sprintf("identity.tags[%d]", i), "is required")
+		}
+	}
+	if cfg.IMDSWatcher.Enabled && cfg.IMDSWatcher.PollIntervalSeconds == 0 {
+		v.add("imds_watcher.poll_interval_seconds", "must be at least 1 when the watcher is enabled")
+	}
+
+	return v.errors
+}
+
+func (v *validator) validateHealthCheck(path string, hc HealthCheck) {
+	if hc.Name == "" {
+		v.add(path+".name", "is required")
+	}
+	if hc.FreqSeconds == 0 {
+		v.add(path+".frequency_in_seconds", "must be at least 1")
+	}
+
+	codes := make([]string, 0, len(hc.ExitCodeStates))
+	for code := range hc.ExitCodeStates {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		state := hc.ExitCodeStates[code]
+		statePath := fmt.Sprintf("%s.exit_code_states.%s", path, code)
+		if _, err := strconv.Atoi(code); err != nil {
+			v.add(statePath, "%q is not an exit code", code)
+		}
+		switch state {
+		case StateOK, StateWarning, StateCritical, StateUnknown:
+		default:
+			v.add(
+				statePath,
+				"unknown state %q, must be one of %s, %s, %s or %s",
+				state, StateOK, StateWarning, StateCritical, StateUnknown,
+			)
+		}
+	}
+
+	if hc.Remediation != nil {
+		v.validateRemediation(path+".remediation", hc)
+	}
+
+	switch hc.OutputMode {
+	case "", OutputModeLog:
+	case OutputModeNagios:
+		if hc.Type != "" && hc.Type != CheckTypeScript {
+			v.add(path+".output_mode", "%s can only be used with %s checks", hc.OutputMode, CheckTypeScript)
+		}
+	default:
+		v.add(path+".output_mode", "unknown output mode %q, must be %s or %s", hc.OutputMode, OutputModeLog, OutputModeNagios)
+	}
+
+	switch hc.Type {
+	case "", CheckTypeScript:
+		v.validateCommand(path, hc.Bin)
+	case CheckTypeHTTP:
+		v.validateHTTPCheck(path+".http", hc.HTTP)
+	case CheckTypeTCP, CheckTypeUnix:
+		v.validateSocketCheck(path+".socket", hc.Type, hc.Socket)
+	default:
+		v.add(
+			path+".type",
+			"unknown type %q, must be one of %s, %s, %s or %s",
+			hc.Type, CheckTypeScript, CheckTypeHTTP, CheckTypeTCP, CheckTypeUnix,
+		)
+	}
+}
+
+// validateDependencies checks that depends_on only refers to health checks that
+// exist and that no check depends on itself. checks holds the index of each
+// health check by name.
+func (v *validator) validateDependencies(healthChecks []HealthCheck, checks map[string]int) {
+	dependsOn := map[string][]string{}
+	for _, hc := range healthChecks {
+		if _, ok := dependsOn[hc.Name]; !ok {
+			dependsOn[hc.Name] = hc.DependsOn
+		}
+	}
+	for i, hc := range healthChecks {
+		path := fmt.Sprintf("health_checks[%d]", i)
+		for j, dependency := range hc.DependsOn {
+			if _, ok := checks[dependency]; !ok {
+				v.add(fmt.Sprintf("%s.depends_on[%d]", path, j), "unknown health check %q", dependency)
+			}
+		}
+		if hc.Name != "" && dependsOnCheck(dependsOn, hc.DependsOn, hc.Name, map[string]bool{}) {
+			v.add(path+".depends_on", "%q depends on itself", hc.Name)
+		}
+	}
+}
+
+// dependsOnCheck tells the caller if name can be reached by following the dependencies.
+func dependsOnCheck(dependsOn map[string][]string, dependencies []string, name string, seen map[string]bool) bool {
+	for _, dependency := range dependencies {
+		if dependency == name {
+			return true
+		}
+		if seen[dependency] {
+			continue
+		}
+		seen[dependency] = true
+		if dependsOnCheck(dependsOn, dependsOn[dependency], name, seen) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateCheckGroups checks that each group only refers to health checks that
+// exist and are not already in another group. checks holds the index of each
+// health check by name.
+func (v *validator) validateCheckGroups(groups []CheckGroup, checks map[string]int) {
+	names := map[string]int{}
+	grouped := map[string]int{}
+	for i, group := range groups {
+		path := fmt.Sprintf("check_groups[%d]", i)
+		if group.Name == "" {
+			v.add(path+".name", "is required")
+		} else if first, ok := names[group.Name]; ok {
+			v.add(path+".name", "duplicate name %q, already used by check_groups[%d]", group.Name, first)
+		} else {
+			names[group.Name] = i
+		}
+
+		if len(group.Checks) == 0 {
+			v.add(path+".checks", "at least one health check is required")
+		}
+		for j, check := range group.Checks {
+			checkPath := fmt.Sprintf("%s.checks[%d]", path, j)
+			if _, ok := checks[check]; !ok {
+				v.add(checkPath, "unknown health check %q", check)
+				continue
+			}
+			if first, ok := grouped[check]; ok {
+				v.add(checkPath, "%q is already in check_groups[%d]", check, first)
+				continue
+			}
+			grouped[check] = i
+		}
+
+		switch group.Policy {
+		case "", GroupPolicyAny, GroupPolicyAll:
+		case GroupPolicyQuorum:
+			if group.MinFailing == 0 || group.MinFailing > uint(len(group.Checks)) {
+				v.add(path+".min_failing", "must be between 1 and the number of checks (%d)", len(group.Checks))
+			}
+		default:
+			v.add(
+				path+".policy",
+				"unknown policy %q, must be %s, %s or %s",
+				group.Policy, GroupPolicyAny, GroupPolicyAll, GroupPolicyQuorum,
+			)
+		}
+	}
+}
+
+func (v *validator) validateHTTPCheck(path string, cfg *HTTPCheckConfig) {
+	if cfg == nil {
+		v.add(path, "is required for http checks")
+		return
+	}
+	if cfg.URL == "" {
+		v.add(path+".url", "is required")
+	} else if u, err := url.Parse(cfg.URL); err != nil {
+		v.add(path+".url", "is not a valid URL. Error: %s", err)
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		v.add(path+".url", "scheme must be http or https")
+	}
+	for i, code := range cfg.ExpectedStatusCodes {
+		if code < 100 || code > 599 {
+			v.add(fmt.Sprintf("%s.expected_status_codes[%d]", path, i), "%d is not a valid HTTP status code", code)
+		}
+	}
+	if cfg.BodyRegex != "" {
+		if _, err := regexp.Compile(cfg.BodyRegex); err != nil {
+			v.add(path+".body_regex", "is not a valid regular expression. Error: %s", err)
+		}
+	}
+}
+
+func (v *validator) validateSocketCheck(path, checkType string, cfg *SocketCheckConfig) {
+	if cfg == nil {
+		v.add(path, "is required for %s checks", checkType)
+		return
+	}
+	if cfg.Address == "" {
+		v.add(path+".address", "is required")
+		return
+	}
+	if checkType == CheckTypeTCP {
+		if _, _, err := net.SplitHostPort(cfg.Address); err != nil {
+			v.add(path+".address", "must be in the form host:port. Error: %s", err)
+		}
+	}
+}
+
+func (v *validator) validateRemediation(path string, hc HealthCheck) {
+	cfg := hc.Remediation
+	if cfg.AfterFailures == 0 || cfg.AfterFailures > hc.AllowedFailures {
+		v.add(
+			path+".after_failures",
+			"must be between 1 and allowed_failures (%d) so the check can run again before a stable failure",
+			hc.AllowedFailures,
+		)
+	}
+	if len(cfg.Actions) == 0 {
+		v.add(path+".actions", "at least one action is required")
+	}
+	for i, action := range cfg.Actions {
+		actionPath := fmt.Sprintf("%s.actions[%d]", path, i)
+		if action.Name == "" {
+			v.add(actionPath+".name", "is required")
+		}
+		v.validateCommand(actionPath, action.Bin)
+	}
+}
+
+// validateHookChain checks each hook and that on_failure and run_if only refer
+// to hooks in the right place in the chain.
+func (v *validator) validateHookChain(chain string, hooks []FailureHook) {
+	names := map[string]int{}
+	for i, fh := range hooks {
+		path := fmt.Sprintf("%s[%d]", chain, i)
+		v.validateFailureHook(path, fh)
+		if fh.Name != "" {
+			if first, ok := names[fh.Name]; ok {
+				v.add(path+".name", "duplicate name %q, already used by %s[%d]", fh.Name, chain, first)
+			} else {
+				names[fh.Name] = i
+			}
+		}
+	}
+
+	for i, fh := range hooks {
+		path := fmt.Sprintf("%s[%d]", chain, i)
+		switch {
+		case fh.OnFailure == "", fh.OnFailure == OnFailureContinue, fh.OnFailure == OnFailureAbortChain:
+		case strings.HasPrefix(fh.OnFailure, OnFailureJumpTo):
+			target := strings.TrimPrefix(fh.OnFailure, OnFailureJumpTo)
+			if index, ok := names[target]; !ok || index <= i {
+				v.add(path+".on_failure", "can only jump to a hook later in the chain, %q is not", target)
+			}
+		default:
+			v.add(
+				path+".on_failure",
+				"unknown policy %q, must be %s, %s or %s<hook>",
+				fh.OnFailure, OnFailureContinue, OnFailureAbortChain, OnFailureJumpTo,
+			)
+		}
+
+		for j, condition := range fh.RunIf {
+			conditionPath := fmt.Sprintf("%s.run_if[%d]", path, j)
+			if index, ok := names[condition.Hook]; !ok || index >= i {
+				v.add(conditionPath+".hook", "must be a hook earlier in the chain, %q is not", condition.Hook)
+			}
+			switch condition.Outcome {
+			case HookOutcomeSucceeded, HookOutcomeFailed, HookOutcomeSkipped:
+			default:
+				v.add(
+					conditionPath+".outcome",
+					"unknown outcome %q, must be %s, %s or %s",
+					condition.Outcome, HookOutcomeSucceeded, HookOutcomeFailed, HookOutcomeSkipped,
+				)
+			}
+		}
+	}
+}
+
+func (v *validator) validateFailureHook(path string, fh FailureHook) {
+	if fh.Name == "" {
+		v.add(path+".name", "is required")
+	}
+	switch fh.Type {
+	case "", HookTypeScript:
+		v.validateCommand(path, fh.Bin)
+	case HookTypeASGSetInstanceHealth, HookTypeASGCompleteLifecycleAction:
+		v.validateASGHook(path+".asg", fh.Type, fh.ASG)
+	case HookTypeECSDrain:
+		if fh.ECS != nil && fh.ECS.AgentEndpoint != "" {
+			v.validateEndpoint(path+".ecs.agent_endpoint", fh.ECS.AgentEndpoint)
+		}
+	case HookTypeELBDeregister:
+		if fh.ELB != nil {
+			for i, arn := range fh.ELB.TargetGroupArns {
+				if !strings.HasPrefix(arn, "arn:") {
+					v.add(fmt.Sprintf("%s.elb.target_group_arns[%d]", path, i), "%q is not an ARN", arn)
+				}
+			}
+		}
+	case HookTypeWebhook:
+		v.validateWebhookHook(path+".webhook", fh.Webhook)
+	default:
+		v.add(
+			path+".type",
+			"unknown type %q, must be one of %s, %s, %s, %s, %s or %s",
+			fh.Type, HookTypeScript, HookTypeASGSetInstanceHealth, HookTypeASGCompleteLifecycleAction,
+			HookTypeECSDrain, HookTypeELBDeregister, HookTypeWebhook,
+		)
+	}
+	if fh.RetryPolicy != nil {
+		v.validateRetryPolicy(path+".retry_policy", *fh.RetryPolicy)
+	}
+}
+
+func (v *validator) validateASGHook(path, hookType string, cfg *ASGHookConfig) {
+	if cfg == nil {
+		if hookType == HookTypeASGCompleteLifecycleAction {
+			v.add(path, "is required for %s hooks", hookType)
+		}
+		return
+	}
+	switch cfg.HealthStatus {
+	case "", ASGHealthy, ASGUnhealthy:
+	default:
+		v.add(path+".health_status", "unknown health status %q, must be %s or %s", cfg.HealthStatus, ASGHealthy, ASGUnhealthy)
+	}
+	switch cfg.LifecycleActionResult {
+	case "", LifecycleActionContinue, LifecycleActionAbandon:
+	default:
+		v.add(
+			path+".lifecycle_action_result",
+			"unknown result %q, must be %s or %s",
+			cfg.LifecycleActionResult, LifecycleActionContinue, LifecycleActionAbandon,
+		)
+	}
+	if hookType == HookTypeASGCompleteLifecycleAction && cfg.LifecycleHookName == "" {
+		v.add(path+".lifecycle_hook_name", "is required for %s hooks", hookType)
+	}
+}
+
+func (v *validator) validateWebhookHook(path string, cfg *WebhookHookConfig) {
+	if cfg == nil {
+		v.add(path, "is required for %s hooks", HookTypeWebhook)
+		return
+	}
+	if cfg.URL == "" {
+		v.add(path+".url", "is required")
+	} else {
+		v.validateEndpoint(path+".url", cfg.URL)
+	}
+}
+
+func (v *validator) validateRetryPolicy(path string, rp RetryPolicy) {
+	switch rp.Backoff {
+	case "", BackoffFixed, BackoffLinear, BackoffExponential:
+	default:
+		v.add(
+			path+".backoff",
+			"unknown backoff %q, must be one of %s, %s or %s",
+			rp.Backoff, BackoffFixed, BackoffLinear, BackoffExponential,
+		)
+	}
+	if rp.Multiplier != 0 && rp.Multiplier < 1 {
+		v.add(path+".multiplier", "must be at least 1")
+	}
+	if rp.MaxDelaySeconds != 0 && rp.MaxDelaySeconds < rp.InitialDelaySeconds {
+		v.add(path+".max_delay_seconds", "must not be less than initial_delay_seconds")
+	}
+	for i, code := range rp.RetryOnExitCodes {
+		if code < 1 || code > 255 {
+			v.add(fmt.Sprintf("%s.retry_on_exit_codes[%d]", path, i), "%d is not a failing exit code", code)
+		}
+	}
+}
+
+// validateCommand makes sure that the command exists and can be executed.
+func (v *validator) validateCommand(path, bin string) {
+	path = path + ".command"
+	if bin == "" {
+		v.add(path, "is required")
+		return
+	}
+	if !strings.ContainsRune(bin, os.PathSeparator) {
+		if _, err := exec.LookPath(bin); err != nil {
+			v.add(path, "%q was not found in PATH", bin)
+		}
+		return
+	}
+	info, err := os.Stat(bin)
+	if err != nil {
+		v.add(path, "%q can not be used. Error: %s", bin, err)
+		return
+	}
+	if info.IsDir() {
+		v.add(path, "%q is a directory", bin)
+		return
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0111 == 0 {
+		v.add(path, "%q is not executable", bin)
+	}
+}
+
+func (v *validator) validateWebServer(path string, cfg WebServerConfig) {
+	if !cfg.Enabled {
+		return
+	}
+	if cfg.Port == 0 || cfg.Port > 65535 {
+		v.add(path+".port", "must be between 1 and 65535")
+	}
+	if cfg.DegradedStatusCode < 100 || cfg.DegradedStatusCode > 599 {
+		v.add(path+".degraded_status_code", "%d is not a valid HTTP status code", cfg.DegradedStatusCode)
+	}
+	if !cfg.UseTLS {
+		if cfg.ClientCAPath != "" {
+			v.add(path+".client_ca_path", "requires use_tls to be true")
+		}
+		return
+	}
+	v.validateReadableFile(path+".cert_path", cfg.TLSCertPath)
+	v.validateReadableFile(path+".key_path", cfg.TLSKeyPath)
+	if cfg.ClientCAPath != "" {
+		v.validateReadableFile(path+".client_ca_path", cfg.ClientCAPath)
+	}
+}
+
+func (v *validator) validateStatsD(path string, cfg StatsDConfig) {
+	if !cfg.Enabled {
+		return
+	}
+	if cfg.Address == "" {
+		v.add(path+".address", "is required")
+	}
+	if cfg.Port == 0 || cfg.Port > 65535 {
+		v.add(path+".port", "must be between 1 and 65535")
+	}
+}
+
+func (v *validator) validateAWS(path string, cfg AWSConfig) {
+	if cfg.IMDSEndpoint != "" {
+		v.validateEndpoint(path+".imds_endpoint", cfg.IMDSEndpoint)
+	}
+	services := make([]string, 0, len(cfg.Endpoints))
+	for service := range cfg.Endpoints {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	for _, service := range services {
+		v.validateEndpoint(path+".endpoints."+service, cfg.Endpoints[service])
+	}
+}
+
+func (v *validator) validateEndpoint(path, endpoint string) {
+	if u, err := url.Parse(endpoint); err != nil {
+		v.add(path, "is not a valid URL. Error: %s", err)
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		v.add(path, "scheme must be http or https")
+	}
+}
+
+func (v *validator) validateReadableFile(path, file string) {
+	if file == "" {
+		v.add(path, "is required")
+		return
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		v.add(path, "%q can not be read. Error: %s", file, err)
+		return
+	}
+	f.Close()
+}
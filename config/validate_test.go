@@ -0,0 +1,158 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func writeTestConfig(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "config*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestValidConfig(t *testing.T) {
+	path := writeTestConfig(t, `{
+		"health_checks": [
+			{"name": "script", "command": "/bin/sh", "arguments": ["-c", "exit 0"], "frequency_in_seconds": 2},
+			{"name": "web", "type": "http", "http": {"url": "http://127.0.0.1/health"}, "frequency_in_seconds": 2},
+			{"name": "redis", "type": "tcp", "socket": {"address": "127.0.0.1:6379"}, "frequency_in_seconds": 2, "depends_on": ["script"]}
+		],
+		"check_groups": [
+			{"name": "upstream", "checks": ["web", "redis"], "policy": "quorum", "min_failing": 2},
+			{"name": "critical", "checks": ["script"]}
+		],
+		"failure_hooks": [
+			{"name": "hook", "command": "sh"},
+			{"name": "unhealthy", "type": "asg_set_instance_health"},
+			{"name": "complete", "type": "asg_complete_lifecycle_action", "asg": {"lifecycle_hook_name": "terminate", "heartbeat_interval_seconds": 60}},
+			{"name": "drain", "type": "ecs_drain", "ecs": {"poll_interval_seconds": 5, "drain_timeout_seconds": 300}},
+			{"name": "notify", "type": "webhook", "webhook": {"url": "https://hooks.example.com/x", "template": "{\"text\": {{json .CheckName}}}", "secret": "s"}}
+		],
+		"termination_hooks": [
+			{"name": "deregister", "type": "elb_deregister"}
+		],
+		"aws": {"imds_endpoint": "http://127.0.0.1:8080", "endpoints": {"autoscaling": "http://127.0.0.1:8081"}},
+		"imds_watcher": {"enabled": true}
+	}`)
+	defer os.Remove(path)
+
+	if _, err := New(path); err != nil {
+		t.Errorf("Expected config to be valid. Error: %s", err)
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	notExecutable := writeTestConfig(t, "")
+	defer os.Remove(notExecutable)
+
+	path := writeTestConfig(t, `{
+		"health_checks": [
+			{"name": "a", "command": "/bin/sh", "frequency_in_seconds": 0, "remediation": {"after_failures": 1, "actions": []}},
+			{"name": "a", "comand": "/bin/sh", "frequency_in_seconds": 1},
+			{"name": "web", "type": "http", "http": {"url": "ftp://x", "body_regex": "("}, "frequency_in_seconds": 1},
+			{"name": "tcp", "type": "tcp", "socket": {"address": "nope"}, "output_mode": "nagios", "frequency_in_seconds": 1},
+			{"name": "odd", "type": "carrier_pigeon", "frequency_in_seconds": 1},
+			{"name": "proxy", "command": "/bin/sh", "frequency_in_seconds": 1, "depends_on": ["app", "missing"]},
+			{"name": "app", "command": "/bin/sh", "frequency_in_seconds": 1, "depends_on": ["proxy"]}
+		],
+		"check_groups": [
+			{"name": "deps", "checks": ["web", "missing"], "policy": "quorum", "min_failing": 3},
+			{"name": "deps", "checks": ["web"], "policy": "most"},
+			{"checks": []}
+		],
+		"failure_hooks": [
+			{"name": "hook", "command": "/does/not/exist", "on_failure": "jump_to:hook", "run_if": [{"hook": "hook", "outcome": "maybe"}]},
+			{"command": "`+notExecutable+`", "retry_policy": {"backoff": "fibonacci"}},
+			{"name": "complete", "type": "asg_complete_lifecycle_action", "asg": {"lifecycle_action_result": "MAYBE"}},
+			{"name": "teleport", "type": "teleport"},
+			{"name": "drain", "type": "ecs_drain", "ecs": {"agent_endpoint": "localhost:51678"}},
+			{"name": "deregister", "type": "elb_deregister", "elb": {"target_group_arns": ["web"]}},
+			{"name": "notify", "type": "webhook", "webhook": {}},
+			{"name": "page", "type": "webhook"}
+		],
+		"recovery_hooks": [
+			{"name": "recovered", "command": "sh"}
+		],
+		"webserver": {"port": 0, "use_tls": true},
+		"statsd": {"enabled": true, "port": 70000, "tags": {}},
+		"aws": {"endpoints": {"autoscaling": "127.0.0.1:8080"}},
+		"termination_hooks": [
+			{"name": "deregister", "type": "elb_deregister"}
+		],
+		"imds_watcher": {"enabled": true, "poll_interval_seconds": 0, "target_lifecycle_state": false},
+		"identity": {"enabled": true, "tags": ["team", ""]}
+	}`)
+	defer os.Remove(path)
+
+	_, err := New(path)
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("Expected ValidationErrors, got %v", err)
+	}
+
+	expected := []string{
+		"health_checks[0].frequency_in_seconds",
+		"health_checks[0].remediation.after_failures",
+		"health_checks[0].remediation.actions",
+		"health_checks[1].comand: unknown field",
+		"health_checks[1].command: is required",
+		"health_checks[1].name: duplicate name",
+		"health_checks[2].http.url",
+		"health_checks[2].http.body_regex",
+		"health_checks[3].socket.address",
+		"health_checks[3].output_mode",
+		"health_checks[4].type",
+		"health_checks[5].depends_on[1]: unknown health check",
+		"health_checks[5].depends_on: \"proxy\" depends on itself",
+		"health_checks[6].depends_on: \"app\" depends on itself",
+		"check_groups[0].checks[1]: unknown health check",
+		"check_groups[0].min_failing",
+		"check_groups[1].name: duplicate name",
+		"check_groups[1].checks[0]: \"web\" is already in check_groups[0]",
+		"check_groups[1].policy",
+		"check_groups[2].name: is required",
+		"check_groups[2].checks: at least one",
+		"failure_hooks[0].command",
+		"failure_hooks[0].on_failure",
+		"failure_hooks[0].run_if[0].hook",
+		"failure_hooks[0].run_if[0].outcome",
+		"failure_hooks[1].name: is required",
+		"failure_hooks[1].retry_policy.backoff",
+		"failure_hooks[1].command: \"" + notExecutable + "\" is not executable",
+		"failure_hooks[2].asg.lifecycle_action_result",
+		"failure_hooks[2].asg.lifecycle_hook_name",
+		"failure_hooks[3].type",
+		"failure_hooks[4].ecs.agent_endpoint",
+		"failure_hooks[5].elb.target_group_arns[0]",
+		"failure_hooks[6].webhook.url",
+		"failure_hooks[7].webhook: is required",
+		"recovery_hooks: requires recoverable",
+		"termination_hooks: requires imds_watcher.enabled",
+		"webserver.port",
+		"webserver.cert_path",
+		"webserver.key_path",
+		"statsd.port",
+		"statsd.tags: unknown field",
+		"aws.endpoints.autoscaling",
+		"identity.tags[1]",
+		"imds_watcher.poll_interval_seconds",
+	}
+	output := err.Error()
+	for _, e := range expected {
+		if !strings.Contains(output, e) {
+			t.Errorf("Expected a problem for %s", e)
+		}
+	}
+	if len(errs) != len(expected) {
+		t.Errorf("Expected %d problems, got %d:\n%s", len(expected), len(errs), output)
+	}
+}
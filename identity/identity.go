@@ -0,0 +1,172 @@
+package identity
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/morfien101/asg-healthcheck-agent/awsapi"
+	"github.com/morfien101/asg-healthcheck-agent/logs"
+)
+
+// Identity describes the instance the agent is running on. Only the hostname
+// is known when the agent is not running on EC2.
+type Identity struct {
+	Hostname             string            `json:"hostname"`
+	InstanceID           string            `json:"instance_id,omitempty"`
+	AvailabilityZone     string            `json:"availability_zone,omitempty"`
+	Region               string            `json:"region,omitempty"`
+	InstanceType         string            `json:"instance_type,omitempty"`
+	ImageID              string            `json:"image_id,omitempty"`
+	AccountID            string            `json:"account_id,omitempty"`
+	PrivateIP            string            `json:"private_ip,omitempty"`
+	AutoScalingGroupName string            `json:"autoscaling_group_name,omitempty"`
+	Tags                 map[string]string `json:"tags,omitempty"`
+}
+
+// FromDocument makes an Identity from the instance identity document.
+func FromDocument(doc awsapi.InstanceIdentity) *Identity {
+	id := &Identity{
+		InstanceID:       doc.InstanceID,
+		AvailabilityZone: doc.AvailabilityZone,
+		Region:           doc.Region,
+		InstanceType:     doc.InstanceType,
+		ImageID:          doc.ImageID,
+		AccountID:        doc.AccountID,
+		PrivateIP:        doc.PrivateIP,
+	}
+	id.Hostname, _ = os.Hostname()
+	return id
+}
+
+// Discover reads the identity of the instance from the instance metadata. The
+// auto scaling group is found the same way as the AWS hooks find it. Tags are
+// read from the instance metadata, so access to tags in the instance metadata
+// needs to be turned on. Tags that do not exist are left out.
+// If the instance identity can not be read, the error is given back with an
+// Identity that only has the hostname.
+func Discover(ctx context.Context, client *awsapi.Client, tagKeys []string) (*Identity, error) {
+	doc, err := client.IMDS().InstanceIdentity(ctx)
+	if err != nil {
+		id := &Identity{}
+		id.Hostname, _ = os.Hostname()
+		return id, err
+	}
+	id := FromDocument(doc)
+
+	if name, err := client.AutoScalingGroupName(ctx); err != nil {
+		logs.JSONLog(
+			"Failed to find the auto scaling group for the instance identity",
+			logs.INFO,
+			logs.JSONAttributes{"error": err.Error()},
+		)
+	} else {
+		id.AutoScalingGroupName = name
+	}
+
+	for _, key := range tagKeys {
+		value, err := client.IMDS().Get(ctx, "meta-data/tags/instance/"+key)
+		if err == awsapi.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return id, fmt.Errorf("failed to read tag %s. Error: %s", key, err)
+		}
+		if id.Tags == nil {
+			id.Tags = map[string]string{}
+		}
+		id.Tags[key] = strings.TrimSpace(value)
+	}
+	return id, nil
+}
+
+// Attributes gives back the identity as flat key value pairs, for log
+// attributes and metric tags. Tags are prefixed with tag_.
+func (id *Identity) Attributes() map[string]string {
+	attributes := map[string]string{}
+	add := func(key, value string) {
+		if value != "" {
+			attributes[key] = value
+		}
+	}
+	add("instance_id", id.InstanceID)
+	add("availability_zone", id.AvailabilityZone)
+	add("instance_type", id.InstanceType)
+	add("autoscaling_group_name", id.AutoScalingGroupName)
+	for key, value := range id.Tags {
+		add("tag_"+strings.ToLower(key), value)
+	}
+	return attributes
+}
+
+// Environment gives back the identity as ASG_HC_* environment variables.
+// Tag names are upper cased and anything other than letters and numbers is
+// changed to _, eg: ASG_HC_TAG_TEAM_NAME for team-name.
+func (id *Identity) Environment() []string {
+	env := []string{
+		"ASG_HC_HOSTNAME=" + id.Hostname,
+		"ASG_HC_INSTANCE_ID=" + id.InstanceID,
+		"ASG_HC_AVAILABILITY_ZONE=" + id.AvailabilityZone,
+		"ASG_HC_INSTANCE_TYPE=" + id.InstanceType,
+		"ASG_HC_AUTOSCALING_GROUP_NAME=" + id.AutoScalingGroupName,
+	}
+	keys := make([]string, 0, len(id.Tags))
+	for key := range id.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		env = append(env, "ASG_HC_TAG_"+envName(key)+"="+id.Tags[key])
+	}
+	return env
+}
+
+func envName(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+}
+
+// MergeAttributes adds the identity attributes to attributes. Values that are
+// already set are kept, so the configuration can override them.
+func MergeAttributes(attributes map[string]string, id *Identity) map[string]string {
+	merged := map[string]string{}
+	if id != nil {
+		for key, value := range id.Attributes() {
+			merged[key] = value
+		}
+	}
+	for key, value := range attributes {
+		merged[key] = value
+	}
+	return merged
+}
+
+var (
+	current     *Identity
+	currentLock sync.RWMutex
+)
+
+// Set replaces the identity given back by Current.
+func Set(id *Identity) {
+	currentLock.Lock()
+	defer currentLock.Unlock()
+	current = id
+}
+
+// Current gives back the identity found when the agent started, or nil if
+// identity discovery is not enabled.
+func Current() *Identity {
+	currentLock.RLock()
+	defer currentLock.RUnlock()
+	return current
+}
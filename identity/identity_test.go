@@ -0,0 +1,88 @@
+package identity
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/morfien101/asg-healthcheck-agent/awsapi"
+	"github.com/morfien101/asg-healthcheck-agent/config"
+	"github.com/morfien101/asg-healthcheck-agent/logs"
+)
+
+func TestMain(m *testing.M) {
+	logs.DefaultLogger = logs.NewFakeLogger(false)
+	os.Exit(m.Run())
+}
+
+func newIMDSStub(metadata map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			w.Write([]byte("token"))
+			return
+		}
+		value, ok := metadata[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(value))
+	}))
+}
+
+func TestDiscover(t *testing.T) {
+	s := newIMDSStub(map[string]string{
+		"/latest/dynamic/instance-identity/document":                `{"instanceId":"i-0123456789","availabilityZone":"eu-west-1a","instanceType":"t3.micro","region":"eu-west-1"}`,
+		"/latest/meta-data/tags/instance/aws:autoscaling:groupName": "web",
+		"/latest/meta-data/tags/instance/team":                      "platform\n",
+	})
+	defer s.Close()
+
+	id, err := Discover(context.Background(), awsapi.New(config.AWSConfig{IMDSEndpoint: s.URL}), []string{"team", "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.InstanceID != "i-0123456789" || id.AvailabilityZone != "eu-west-1a" || id.InstanceType != "t3.micro" ||
+		id.AutoScalingGroupName != "web" || id.Hostname == "" {
+		t.Errorf("Unexpected identity %+v", id)
+	}
+	if len(id.Tags) != 1 || id.Tags["team"] != "platform" {
+		t.Errorf("Expected only the tags that exist, got %v", id.Tags)
+	}
+
+	attributes := MergeAttributes(map[string]string{"instance_type": "configured"}, id)
+	expected := map[string]string{
+		"instance_id":            "i-0123456789",
+		"availability_zone":      "eu-west-1a",
+		"instance_type":          "configured",
+		"autoscaling_group_name": "web",
+		"tag_team":               "platform",
+	}
+	for key, value := range expected {
+		if attributes[key] != value {
+			t.Errorf("Expected %s to be %q, got %q", key, value, attributes[key])
+		}
+	}
+	if env := strings.Join(id.Environment(), "\n"); !strings.Contains(env, "ASG_HC_AUTOSCALING_GROUP_NAME=web\nASG_HC_TAG_TEAM=platform") {
+		t.Errorf("Unexpected environment:\n%s", env)
+	}
+}
+
+func TestDiscoverOffEC2(t *testing.T) {
+	s := newIMDSStub(map[string]string{})
+	defer s.Close()
+
+	id, err := Discover(context.Background(), awsapi.New(config.AWSConfig{IMDSEndpoint: s.URL}), nil)
+	if err == nil {
+		t.Error("Expected an error without an instance identity document")
+	}
+	if id == nil || id.Hostname == "" || id.InstanceID != "" {
+		t.Errorf("Expected only the hostname, got %+v", id)
+	}
+	if attributes := MergeAttributes(map[string]string{"hostname": "web-1"}, nil); len(attributes) != 1 {
+		t.Errorf("Expected the attributes to be kept without an identity, got %v", attributes)
+	}
+}
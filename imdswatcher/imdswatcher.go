@@ -0,0 +1,263 @@
+package imdswatcher
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/morfien101/asg-healthcheck-agent/awsapi"
+	"github.com/morfien101/asg-healthcheck-agent/config"
+	"github.com/morfien101/asg-healthcheck-agent/logs"
+	"github.com/morfien101/asg-healthcheck-agent/metrics"
+	"github.com/morfien101/asg-healthcheck-agent/scriptengine"
+)
+
+// Paths in the instance metadata that only exist once EC2 has given a notice.
+const (
+	spotInstanceActionPath = "meta-data/spot/instance-action"
+	rebalancePath          = "meta-data/events/recommendations/rebalance"
+)
+
+// targetLifecycleStatePath only exists for instances in an auto scaling group.
+const targetLifecycleStatePath = "meta-data/autoscaling/target-lifecycle-state"
+
+// Handler is told what the watcher finds. The StateManager is a Handler.
+type Handler interface {
+	// ExternalFailure is called when a notice arrives. The details are the
+	// notice from the instance metadata. false is returned if the notice could
+	// not be accepted, it is then passed on again on the next poll.
+	ExternalFailure(reason string, details []string) bool
+	// TargetLifecycleStateChanged is called when the auto scaling target
+	// lifecycle state is first read and each time it changes.
+	TargetLifecycleStateChanged(state string)
+}
+
+// notice is something in the instance metadata that is watched for.
+type notice struct {
+	reason string
+	path   string
+}
+
+var promNotices = metrics.NewPromCounter(
+	"imds_notices_total",
+	"Number of notices found in the instance metadata by reason.",
+)
+
+// Watcher polls the instance metadata for notices that the instance is going
+// away and for the target lifecycle state. Each notice is only passed to the
+// Handler the first time it is seen.
+type Watcher struct {
+	handler        Handler
+	enabled        bool
+	interval       time.Duration
+	notices        []notice
+	seen           map[string]bool
+	watchLifecycle bool
+	lifecycleState string
+	failing        bool
+	stop           chan struct{}
+	// done is closed when the poll go routine has returned.
+	done chan struct{}
+	lock sync.Mutex
+}
+
+// New creates a Watcher. It does nothing until it is started.
+func New(cfg config.IMDSWatcherConfig, handler Handler) *Watcher {
+	w := &Watcher{
+		handler: handler,
+		seen:    map[string]bool{},
+	}
+	w.configure(cfg)
+	return w
+}
+
+func (w *Watcher) configure(cfg config.IMDSWatcherConfig) {
+	w.enabled = cfg.Enabled
+	w.interval = time.Duration(cfg.PollIntervalSeconds) * time.Second
+	w.notices = []notice{}
+	if cfg.SpotInterruption {
+		w.notices = append(w.notices, notice{reason: scriptengine.ReasonSpotInterruption, path: spotInstanceActionPath})
+	}
+	if cfg.RebalanceRecommendation {
+		w.notices = append(w.notices, notice{reason: scriptengine.ReasonRebalanceRecommendation, path: rebalancePath})
+	}
+	w.watchLifecycle = cfg.TargetLifecycleState
+}
+
+// Start polls the instance metadata in the background if the watcher is enabled.
+func (w *Watcher) Start() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if !w.enabled || (len(w.notices) == 0 && !w.watchLifecycle) || w.stop != nil {
+		return
+	}
+	w.stop = make(chan struct{})
+	w.done = make(chan struct{})
+	go w.watch(w.stop, w.done, w.interval)
+	logs.JSONLog(
+		"Watching the instance metadata",
+		logs.INFO,
+		logs.JSONAttributes{"poll_interval_seconds": w.interval.Seconds()},
+	)
+}
+
+// Stop stops polling. It waits for a poll that is running to finish, requests
+// to the instance metadata are cancelled.
+func (w *Watcher) Stop() {
+	w.lock.Lock()
+	if w.stop == nil {
+		w.lock.Unlock()
+		return
+	}
+	close(w.stop)
+	done := w.done
+	w.stop = nil
+	w.done = nil
+	w.lock.Unlock()
+	<-done
+}
+
+// Reload applies a new configuration. The old poll has finished before the new
+// one starts, and notices that have already been seen are not passed on again.
+func (w *Watcher) Reload(cfg config.IMDSWatcherConfig) {
+	w.Stop()
+	w.lock.Lock()
+	w.configure(cfg)
+	w.lock.Unlock()
+	w.Start()
+}
+
+func (w *Watcher) watch(stop, done chan struct{}, interval time.Duration) {
+	defer close(done)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		w.poll(ctx, interval)
+		w.pollLifecycleState(ctx, interval)
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll checks each notice that has not been seen yet. Each request is limited to timeout.
+func (w *Watcher) poll(parent context.Context, timeout time.Duration) {
+	w.lock.Lock()
+	notices := []notice{}
+	for _, n := range w.notices {
+		if !w.seen[n.reason] {
+			notices = append(notices, n)
+		}
+	}
+	w.lock.Unlock()
+
+	for _, n := range notices {
+		if parent.Err() != nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(parent, timeout)
+		body, err := awsapi.Default().IMDS().Get(ctx, n.path)
+		cancel()
+		if parent.Err() != nil {
+			// Stopped, this is not a failure to read the instance metadata.
+			return
+		}
+		if err == awsapi.ErrNotFound {
+			w.setFailing(false, nil)
+			continue
+		}
+		if err != nil {
+			w.setFailing(true, err)
+			continue
+		}
+		w.setFailing(false, nil)
+
+		// The notice is only seen once the handler has accepted it, so a
+		// notice is not lost while another is waiting to be handled.
+		if !w.handler.ExternalFailure(n.reason, []string{body}) {
+			continue
+		}
+		w.lock.Lock()
+		w.seen[n.reason] = true
+		w.lock.Unlock()
+		logs.JSONLog(
+			"Instance metadata notice received",
+			logs.WARNING,
+			logs.JSONAttributes{
+				"notice": body,
+				"reason": n.reason,
+			},
+		)
+		tags := metrics.Tags{"reason": n.reason}
+		metrics.Incr("imds_notice", 1, tags)
+		promNotices.Add(1, tags)
+	}
+}
+
+// pollLifecycleState passes the target lifecycle state on when it changes.
+func (w *Watcher) pollLifecycleState(parent context.Context, timeout time.Duration) {
+	w.lock.Lock()
+	watch := w.watchLifecycle
+	w.lock.Unlock()
+	if !watch || parent.Err() != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+	state, err := awsapi.Default().IMDS().Get(ctx, targetLifecycleStatePath)
+	if parent.Err() != nil {
+		return
+	}
+	if err == awsapi.ErrNotFound {
+		// Not in an auto scaling group.
+		w.setFailing(false, nil)
+		return
+	}
+	if err != nil {
+		w.setFailing(true, err)
+		return
+	}
+	w.setFailing(false, nil)
+
+	state = strings.TrimSpace(state)
+	w.lock.Lock()
+	changed := state != w.lifecycleState
+	w.lifecycleState = state
+	w.lock.Unlock()
+	if changed {
+		w.handler.TargetLifecycleStateChanged(state)
+	}
+}
+
+// setFailing logs the first error after the instance metadata was last read,
+// later errors are only logged at debug so agents off EC2 do not fill the logs.
+func (w *Watcher) setFailing(failing bool, err error) {
+	w.lock.Lock()
+	wasFailing := w.failing
+	w.failing = failing
+	w.lock.Unlock()
+	if !failing {
+		return
+	}
+	level := logs.WARNING
+	if wasFailing {
+		level = logs.DEBUG
+	}
+	logs.JSONLog(
+		"Failed to read the instance metadata, will try again",
+		level,
+		logs.JSONAttributes{"error": err.Error()},
+	)
+}
@@ -0,0 +1,213 @@
+package imdswatcher
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/morfien101/asg-healthcheck-agent/awsapi"
+	"github.com/morfien101/asg-healthcheck-agent/config"
+	"github.com/morfien101/asg-healthcheck-agent/logs"
+	"github.com/morfien101/asg-healthcheck-agent/scriptengine"
+)
+
+func TestMain(m *testing.M) {
+	logs.DefaultLogger = logs.NewFakeLogger(false)
+	os.Exit(m.Run())
+}
+
+// imdsStub serves the metadata paths it holds. It needs an IMDSv2 token.
+type imdsStub struct {
+	*httptest.Server
+	metadata map[string]string
+	lock     sync.Mutex
+}
+
+func newIMDSStub() *imdsStub {
+	s := &imdsStub{metadata: map[string]string{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			w.Write([]byte("token"))
+			return
+		}
+		if r.Header.Get("X-aws-ec2-metadata-token") != "token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		s.lock.Lock()
+		value, ok := s.metadata[r.URL.Path]
+		s.lock.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(value))
+	}))
+	awsapi.Setup(config.AWSConfig{IMDSEndpoint: s.URL})
+	return s
+}
+
+func (s *imdsStub) set(path, value string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.metadata[path] = value
+}
+
+func (s *imdsStub) Close() {
+	s.Server.Close()
+	awsapi.Setup(config.AWSConfig{})
+}
+
+// notifications is a Handler that records what it is told.
+type notifications struct {
+	reasons []string
+	details [][]string
+	states  []string
+	// busy stops notices being accepted.
+	busy bool
+	// delay is how long a notice takes to be accepted.
+	delay time.Duration
+	// calls counts every notice passed on, accepted or not.
+	calls int
+	lock  sync.Mutex
+}
+
+func (n *notifications) ExternalFailure(reason string, details []string) bool {
+	n.lock.Lock()
+	n.calls++
+	delay := n.delay
+	n.lock.Unlock()
+	time.Sleep(delay)
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.busy {
+		return false
+	}
+	n.reasons = append(n.reasons, reason)
+	n.details = append(n.details, details)
+	return true
+}
+
+func (n *notifications) setBusy(busy bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.busy = busy
+}
+
+func (n *notifications) TargetLifecycleStateChanged(state string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.states = append(n.states, state)
+}
+
+func (n *notifications) count() int {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return len(n.reasons)
+}
+
+func TestWatcher(t *testing.T) {
+	s := newIMDSStub()
+	defer s.Close()
+	n := &notifications{}
+	w := New(config.IMDSWatcherConfig{Enabled: true, PollIntervalSeconds: 1, SpotInterruption: true}, n)
+
+	w.poll(context.Background(), time.Second)
+	if n.count() != 0 {
+		t.Fatalf("Expected no notices, got %v", n.reasons)
+	}
+
+	notice := `{"action": "terminate", "time": "2026-10-16T08:22:00Z"}`
+	s.set("/latest/meta-data/spot/instance-action", notice)
+	// Rebalance recommendations are not watched.
+	s.set("/latest/meta-data/events/recommendations/rebalance", `{"noticeTime": "2026-10-16T08:20:00Z"}`)
+	// A notice that is not accepted is passed on again on the next poll.
+	n.setBusy(true)
+	w.poll(context.Background(), time.Second)
+	n.setBusy(false)
+	w.poll(context.Background(), time.Second)
+	w.poll(context.Background(), time.Second)
+	if n.count() != 1 {
+		t.Fatalf("Expected one notice, got %v", n.reasons)
+	}
+	if n.reasons[0] != scriptengine.ReasonSpotInterruption || n.details[0][0] != notice {
+		t.Errorf("Expected the spot interruption notice, got %s %v", n.reasons[0], n.details[0])
+	}
+
+	w.Reload(config.IMDSWatcherConfig{Enabled: true, PollIntervalSeconds: 1, SpotInterruption: true, RebalanceRecommendation: true})
+	defer w.Stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for n.count() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the rebalance recommendation")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if len(n.reasons) != 2 || n.reasons[1] != scriptengine.ReasonRebalanceRecommendation {
+		t.Errorf("Expected only the rebalance recommendation after the reload, got %v", n.reasons)
+	}
+}
+
+func TestReloadWaitsForPoll(t *testing.T) {
+	s := newIMDSStub()
+	defer s.Close()
+	s.set("/latest/meta-data/spot/instance-action", `{"action": "terminate"}`)
+	n := &notifications{delay: 500 * time.Millisecond}
+	cfg := config.IMDSWatcherConfig{Enabled: true, PollIntervalSeconds: 1, SpotInterruption: true}
+	w := New(cfg, n)
+	w.Start()
+	defer w.Stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		n.lock.Lock()
+		calls := n.calls
+		n.lock.Unlock()
+		if calls > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the notice")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The notice is still being handled by the old poll.
+	w.Reload(cfg)
+	time.Sleep(1500 * time.Millisecond)
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.calls != 1 || len(n.reasons) != 1 {
+		t.Errorf("Expected the notice to be passed on once, got %d calls %v", n.calls, n.reasons)
+	}
+}
+
+func TestWatcherTargetLifecycleState(t *testing.T) {
+	s := newIMDSStub()
+	defer s.Close()
+	n := &notifications{}
+	w := New(config.IMDSWatcherConfig{Enabled: true, PollIntervalSeconds: 1, TargetLifecycleState: true}, n)
+
+	// Not in an auto scaling group.
+	w.pollLifecycleState(context.Background(), time.Second)
+	s.set("/latest/meta-data/autoscaling/target-lifecycle-state", "InService")
+	w.pollLifecycleState(context.Background(), time.Second)
+	w.pollLifecycleState(context.Background(), time.Second)
+	s.set("/latest/meta-data/autoscaling/target-lifecycle-state", "Terminated\n")
+	w.pollLifecycleState(context.Background(), time.Second)
+
+	if states := strings.Join(n.states, ","); states != "InService,Terminated" {
+		t.Errorf("Expected each change to be passed on, got %s", states)
+	}
+	if n.count() != 0 {
+		t.Errorf("Expected no failures, got %v", n.reasons)
+	}
+}
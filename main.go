@@ -1,15 +1,21 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"reflect"
 	"syscall"
+	"time"
 
+	"github.com/morfien101/asg-healthcheck-agent/awsapi"
 	"github.com/morfien101/asg-healthcheck-agent/config"
+	"github.com/morfien101/asg-healthcheck-agent/identity"
+	"github.com/morfien101/asg-healthcheck-agent/imdswatcher"
 	"github.com/morfien101/asg-healthcheck-agent/logs"
 	"github.com/morfien101/asg-healthcheck-agent/metrics"
 	"github.com/morfien101/asg-healthcheck-agent/scriptengine"
@@ -23,12 +29,16 @@ import (
 var VERSION = "0.0.2"
 var defaultConfigLocation = "/etc/asg-healthchecker/config.json"
 
+// How long the agent waits for the identity of the instance when it starts.
+const identityTimeout = 10 * time.Second
+
 // Flags for the application launch
 var (
 	versionCheck        = flag.Bool("v", false, "Outputs the version of the program.")
 	helpFlag            = flag.Bool("h", false, "Shows the help menu.")
 	configLocaltionFlag = flag.String("c", defaultConfigLocation, "Location of the configuration file.")
 	showconfigFlag      = flag.Bool("s", false, "Show full running config")
+	validateFlag        = flag.Bool("validate", false, "Validate the configuration file, print any problems and exit.")
 	svcFlag             = flag.String("service", "", "Control the system service.")
 )
 
@@ -37,14 +47,19 @@ type configStop error
 type program struct {
 	exit           chan bool
 	finshed        chan bool
+	reload         chan struct{}
 	configLocation string
 	config         config.Config
 	signalsChan    chan os.Signal
+	reloadSignals  chan os.Signal
+	watcher        *imdswatcher.Watcher
 }
 
 func main() {
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	reloadSignals := make(chan os.Signal, 1)
+	signal.Notify(reloadSignals, syscall.SIGHUP)
 	// Deal with flags
 	digestFlags()
 
@@ -57,6 +72,7 @@ func main() {
 	prg := &program{
 		configLocation: *configLocaltionFlag,
 		signalsChan:    signals,
+		reloadSignals:  reloadSignals,
 	}
 
 	serviceController, err := service.New(prg, svcConfig)
@@ -117,6 +133,10 @@ func digestFlags() {
 		os.Exit(0)
 	}
 
+	if *validateFlag {
+		os.Exit(validateConfigFile(*configLocaltionFlag))
+	}
+
 	if *showconfigFlag {
 		cfg, err := generateConfig(*configLocaltionFlag)
 		if err != nil {
@@ -133,7 +153,34 @@ func digestFlags() {
 }
 
 func generateConfig(path string) (config.Config, error) {
-	return config.New(path)
+	cfg, err := config.New(path)
+	if err != nil {
+		return config.Config{}, err
+	}
+	// Webhook templates are checked by the scriptengine, which renders them.
+	if errs := scriptengine.ValidateFailureHooks(cfg); len(errs) > 0 {
+		return config.Config{}, errs
+	}
+	return cfg, nil
+}
+
+// validateConfigFile prints every problem found in the configuration file.
+// The returned value is used as the exit code.
+func validateConfigFile(path string) int {
+	_, err := generateConfig(path)
+	if err == nil {
+		fmt.Printf("%s is valid\n", path)
+		return 0
+	}
+	if errs, ok := err.(config.ValidationErrors); ok {
+		for _, ve := range errs {
+			fmt.Println(ve.Error())
+		}
+		fmt.Printf("%s has %d problem(s)\n", path, len(errs))
+		return 1
+	}
+	fmt.Printf("Failed to read %s. Error: %s\n", path, err)
+	return 1
 }
 
 func (p *program) Stop(s service.Service) error {
@@ -154,10 +201,16 @@ func (p *program) Start(s service.Service) error {
 	// If a signal is used then the value is expected to be true.
 	p.exit = make(chan bool, 1)
 	p.finshed = make(chan bool, 1)
+	p.reload = make(chan struct{}, 1)
 	go func() {
 		<-p.signalsChan
 		p.exit <- true
 	}()
+	go func() {
+		for range p.reloadSignals {
+			p.requestReload()
+		}
+	}()
 
 	// Errors would relate to looking for config files.
 	config, err := generateConfig(p.configLocation)
@@ -167,23 +220,26 @@ func (p *program) Start(s service.Service) error {
 	p.config = config
 
 	// Configure the logger since we now know what it should look like.
-	logs.JSONDebugLogging(config.DebugLogs)
-	logs.OutputJSONPretty(config.PrettyLogs)
-	jsonDefaults := map[string]interface{}{}
-	for key, value := range config.DefaultLoggingAttributes {
-		jsonDefaults[key] = value
+	configureLogging(config)
+	awsapi.Setup(config.AWS)
+	if config.Identity.Enabled {
+		discoverIdentity(config.Identity)
+		// Log with the identity from here on.
+		configureLogging(config)
 	}
-	logs.SetJSONLogDefaults(jsonDefaults)
 
 	if config.StatsD.Enabled {
 		metrics.Setup(
 			fmt.Sprintf("%s:%d", config.StatsD.Address, config.StatsD.Port),
 			config.StatsD.Prefix,
-			config.StatsD.DefaultTags,
+			identity.MergeAttributes(config.StatsD.DefaultTags, identity.Current()),
 		)
 		metrics.Enable()
 	}
 	metrics.Incr("starting", 1, metrics.Tags{})
+	if config.WatchConfigFile {
+		go p.watchConfigFile(time.Duration(config.WatchConfigIntervalSeconds) * time.Second)
+	}
 	// Start the service in a async go routine
 	go p.run()
 	go func() {
@@ -199,19 +255,148 @@ func (p *program) Start(s service.Service) error {
 	return nil
 }
 
+func configureLogging(cfg config.Config) {
+	logs.JSONDebugLogging(cfg.DebugLogs)
+	logs.OutputJSONPretty(cfg.PrettyLogs)
+	jsonDefaults := map[string]interface{}{}
+	for key, value := range identity.MergeAttributes(cfg.DefaultLoggingAttributes, identity.Current()) {
+		jsonDefaults[key] = value
+	}
+	logs.SetJSONLogDefaults(jsonDefaults)
+}
+
+// discoverIdentity reads the identity of the instance from the instance metadata.
+// If it can not be read the agent carries on with what it could find.
+func discoverIdentity(cfg config.IdentityConfig) {
+	ctx, cancel := context.WithTimeout(context.Background(), identityTimeout)
+	defer cancel()
+	id, err := identity.Discover(ctx, awsapi.Default(), cfg.Tags)
+	if err != nil {
+		logs.JSONLog(
+			"Failed to discover the identity of the instance",
+			logs.WARNING,
+			logs.JSONAttributes{"error": err.Error()},
+		)
+	} else {
+		logs.JSONLog(
+			"Discovered the identity of the instance",
+			logs.INFO,
+			logs.JSONAttributes{"instance_id": id.InstanceID},
+		)
+	}
+	identity.Set(id)
+}
+
+// requestReload asks the run loop to reload the configuration.
+// Requests that arrive while one is already waiting are dropped.
+func (p *program) requestReload() {
+	select {
+	case p.reload <- struct{}{}:
+	default:
+	}
+}
+
+// watchConfigFile will request a reload when the modification time or size
+// of the configuration file changes.
+func (p *program) watchConfigFile(interval time.Duration) {
+	lastInfo, err := os.Stat(p.configLocation)
+	if err != nil {
+		logs.JSONLog(
+			"Failed to read configuration file for watching",
+			logs.ERROR,
+			logs.JSONAttributes{"error": err.Error()},
+		)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		info, err := os.Stat(p.configLocation)
+		if err != nil {
+			continue
+		}
+		if lastInfo == nil || !info.ModTime().Equal(lastInfo.ModTime()) || info.Size() != lastInfo.Size() {
+			logs.JSONLog(
+				"Configuration file change detected",
+				logs.INFO,
+				logs.JSONAttributes{"config_file": p.configLocation},
+			)
+			p.requestReload()
+		}
+		lastInfo = info
+	}
+}
+
+// reloadConfig reads and validates the configuration file. If it is valid then
+// it is handed to the state manager. Invalid configurations are rejected
+// and the current configuration is kept running.
+func (p *program) reloadConfig(sm *statemanager.StateManager) {
+	cfg, err := generateConfig(p.configLocation)
+	if err != nil {
+		attributes := logs.JSONAttributes{"error": err.Error()}
+		if errs, ok := err.(config.ValidationErrors); ok {
+			problems := make([]string, len(errs))
+			for i, ve := range errs {
+				problems[i] = ve.Error()
+			}
+			attributes["problems"] = problems
+		}
+		logs.JSONLog(
+			"Rejected configuration reload, keeping the current configuration",
+			logs.ERROR,
+			attributes,
+		)
+		return
+	}
+
+	if !reflect.DeepEqual(cfg.WebServer, p.config.WebServer) ||
+		!reflect.DeepEqual(cfg.StatsD, p.config.StatsD) ||
+		!reflect.DeepEqual(cfg.Identity, p.config.Identity) ||
+		cfg.Recoverable != p.config.Recoverable ||
+		cfg.WatchConfigFile != p.config.WatchConfigFile ||
+		cfg.WatchConfigIntervalSeconds != p.config.WatchConfigIntervalSeconds {
+		logs.JSONLog(
+			"Changes to webserver, statsd, identity, recoverable and config watching settings require a restart",
+			logs.WARNING,
+			logs.JSONAttributes{},
+		)
+		// Keep what is actually running so that we keep warning until a restart.
+		cfg.WebServer = p.config.WebServer
+		cfg.StatsD = p.config.StatsD
+		cfg.Identity = p.config.Identity
+		cfg.Recoverable = p.config.Recoverable
+		cfg.WatchConfigFile = p.config.WatchConfigFile
+		cfg.WatchConfigIntervalSeconds = p.config.WatchConfigIntervalSeconds
+	}
+	// The rest of the configuration is only applied if the state manager took
+	// it, so the running configuration is never half new and half old.
+	if !sm.Reload(cfg) {
+		return
+	}
+	configureLogging(cfg)
+	awsapi.Setup(cfg.AWS)
+	p.watcher.Reload(cfg.IMDSWatcher)
+	p.config = cfg
+}
+
 func (p *program) run() error {
 
 	hce := scriptengine.NewHealthCheckEngine(p.config.HealthChecks)
 	fhe := scriptengine.NewFailureHookEngine(p.config.FailureHooks)
-	statemanager := statemanager.New(hce, fhe, p.config.RunFailureHooksOnTermSignal, p.config.RunFailureHooks)
-	websrv := webserver.New(p.config.WebServer, &statemanager)
+	rhe := scriptengine.NewFailureHookEngine(p.config.RecoveryHooks)
+	the := scriptengine.NewFailureHookEngine(p.config.TerminationHooks)
+	statemanager := statemanager.New(hce, fhe, rhe, the, p.config)
+	websrv := webserver.New(p.config.WebServer, statemanager)
+	p.watcher = imdswatcher.New(p.config.IMDSWatcher, statemanager)
 	fatalErrors := make(chan error, 1)
 
-	go func() {
-		fatalErrors <- websrv.StartHTTPEngine("127.0.0.1:8080")
-	}()
+	if websrv.Enabled() {
+		go func() {
+			fatalErrors <- websrv.Start()
+		}()
+	}
 	go func() {
 		stateManagerErrorChan := statemanager.Start(p.config.StartupGraceSeconds)
+		p.watcher.Start()
 		select {
 		case err, ok := <-stateManagerErrorChan:
 			if !ok {
@@ -226,6 +411,8 @@ func (p *program) run() error {
 
 	for {
 		select {
+		case <-p.reload:
+			p.reloadConfig(statemanager)
 		case err := <-fatalErrors:
 			if err != nil {
 				if _, ok := err.(configStop); ok {
@@ -248,6 +435,7 @@ func (p *program) run() error {
 					logs.JSONAttributes{},
 				)
 			}
+			p.watcher.Stop()
 			statemanager.Stop(isSignal)
 			if err := websrv.StopHTTPEngine(); err != nil {
 				logs.JSONLog(
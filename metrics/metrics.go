@@ -94,6 +94,13 @@ func Gauge(stat string, value int64, tagsInput map[string]string) {
 	}
 }
 
+// FGauge sets or updates a gauge using a float value
+func FGauge(stat string, value float64, tagsInput map[string]string) {
+	if on {
+		stdClient.FGauge(stat, value, convertTags(tagsInput)...)
+	}
+}
+
 // GaugeDelta sends a change for a gauge
 func GaugeDelta(stat string, value int64, tagsInput map[string]string) {
 	if on {
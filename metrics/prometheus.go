@@ -0,0 +1,257 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PrometheusPrefix is added to the front of all Prometheus metric names.
+const PrometheusPrefix = "asg_healthcheck_"
+
+const (
+	promCounter   = "counter"
+	promGauge     = "gauge"
+	promHistogram = "histogram"
+)
+
+// DefaultDurationBuckets are the histogram buckets used for run times in seconds.
+var DefaultDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+var promRegistry = &registry{metrics: map[string]*PromMetric{}}
+
+type registry struct {
+	lock    sync.Mutex
+	metrics map[string]*PromMetric
+}
+
+// PromMetric is a family of Prometheus metrics that share a name.
+// Each unique set of tags creates a new series in the family.
+// Prometheus metrics are always collected, even if StatsD is not enabled.
+type PromMetric struct {
+	name    string
+	help    string
+	kind    string
+	buckets []float64
+	series  map[string]*promSeries
+}
+
+type promSeries struct {
+	tags         Tags
+	labels       string
+	value        float64
+	bucketCounts []uint64
+	count        uint64
+}
+
+func newPromMetric(name, help, kind string, buckets []float64) *PromMetric {
+	promRegistry.lock.Lock()
+	defer promRegistry.lock.Unlock()
+	name = PrometheusPrefix + name
+	if existing, ok := promRegistry.metrics[name]; ok {
+		return existing
+	}
+	m := &PromMetric{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		buckets: buckets,
+		series:  map[string]*promSeries{},
+	}
+	promRegistry.metrics[name] = m
+	return m
+}
+
+// NewPromCounter registers a counter that can only go up.
+func NewPromCounter(name, help string) *PromMetric {
+	return newPromMetric(name, help, promCounter, nil)
+}
+
+// NewPromGauge registers a gauge that can be set to any value.
+func NewPromGauge(name, help string) *PromMetric {
+	return newPromMetric(name, help, promGauge, nil)
+}
+
+// NewPromHistogram registers a histogram using the given upper bounds for the buckets.
+func NewPromHistogram(name, help string, buckets []float64) *PromMetric {
+	sorted := append([]float64{}, buckets...)
+	sort.Float64s(sorted)
+	return newPromMetric(name, help, promHistogram, sorted)
+}
+
+// getSeries needs to be called with the registry lock held.
+func (m *PromMetric) getSeries(tags Tags) *promSeries {
+	labels := renderLabels(tags)
+	s, ok := m.series[labels]
+	if !ok {
+		s = &promSeries{tags: tags, labels: labels}
+		if m.kind == promHistogram {
+			s.bucketCounts = make([]uint64, len(m.buckets))
+		}
+		m.series[labels] = s
+	}
+	return s
+}
+
+// Add increases a counter or gauge by value.
+func (m *PromMetric) Add(value float64, tags Tags) {
+	promRegistry.lock.Lock()
+	defer promRegistry.lock.Unlock()
+	m.getSeries(tags).value += value
+}
+
+// Set will set a gauge to value.
+func (m *PromMetric) Set(value float64, tags Tags) {
+	promRegistry.lock.Lock()
+	defer promRegistry.lock.Unlock()
+	m.getSeries(tags).value = value
+}
+
+// Observe records a value in a histogram.
+func (m *PromMetric) Observe(value float64, tags Tags) {
+	promRegistry.lock.Lock()
+	defer promRegistry.lock.Unlock()
+	s := m.getSeries(tags)
+	for i, upperBound := range m.buckets {
+		if value <= upperBound {
+			s.bucketCounts[i]++
+		}
+	}
+	s.count++
+	s.value += value
+}
+
+// Delete removes the series with the given tags. Used when the thing it
+// describes no longer exists.
+func (m *PromMetric) Delete(tags Tags) {
+	promRegistry.lock.Lock()
+	defer promRegistry.lock.Unlock()
+	delete(m.series, renderLabels(tags))
+}
+
+// DeleteMatching removes every series that has all of the given tags.
+func (m *PromMetric) DeleteMatching(tags Tags) {
+	promRegistry.lock.Lock()
+	defer promRegistry.lock.Unlock()
+	for key, s := range m.series {
+		matches := true
+		for tag, value := range tags {
+			if s.tags[tag] != value {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			delete(m.series, key)
+		}
+	}
+}
+
+// WritePrometheus writes all the registered metrics in the Prometheus text exposition format.
+func WritePrometheus(w io.Writer) error {
+	promRegistry.lock.Lock()
+	defer promRegistry.lock.Unlock()
+
+	names := make([]string, 0, len(promRegistry.metrics))
+	for name := range promRegistry.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		m := promRegistry.metrics[name]
+		if len(m.series) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "# HELP %s %s\n", m.name, escapeHelp(m.help))
+		fmt.Fprintf(&b, "# TYPE %s %s\n", m.name, m.kind)
+
+		keys := make([]string, 0, len(m.series))
+		for key := range m.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			m.writeSeries(&b, m.series[key])
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (m *PromMetric) writeSeries(b *strings.Builder, s *promSeries) {
+	if m.kind != promHistogram {
+		fmt.Fprintf(b, "%s%s %s\n", m.name, wrapLabels(s.labels), formatFloat(s.value))
+		return
+	}
+	for i, upperBound := range m.buckets {
+		le := fmt.Sprintf(`le="%s"`, formatFloat(upperBound))
+		fmt.Fprintf(b, "%s_bucket%s %d\n", m.name, wrapLabels(joinLabels(s.labels, le)), s.bucketCounts[i])
+	}
+	fmt.Fprintf(b, "%s_bucket%s %d\n", m.name, wrapLabels(joinLabels(s.labels, `le="+Inf"`)), s.count)
+	fmt.Fprintf(b, "%s_sum%s %s\n", m.name, wrapLabels(s.labels), formatFloat(s.value))
+	fmt.Fprintf(b, "%s_count%s %d\n", m.name, wrapLabels(s.labels), s.count)
+}
+
+// renderLabels gives a stable string for a set of tags, sorted by key.
+func renderLabels(tags Tags) string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, sanitizeLabelName(key), escapeLabelValue(tags[key])))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func joinLabels(labels, extra string) string {
+	if labels == "" {
+		return extra
+	}
+	return labels + "," + extra
+}
+
+func wrapLabels(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func sanitizeLabelName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(value)
+}
+
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
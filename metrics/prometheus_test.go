@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	counter := NewPromCounter("test_runs_total", "Test runs.")
+	gauge := NewPromGauge("test_state", "Test state.")
+	histogram := NewPromHistogram("test_duration_seconds", "Test durations.", []float64{1, 0.1})
+
+	counter.Add(1, Tags{"name": "a", "successful": "true"})
+	counter.Add(2, Tags{"successful": "true", "name": "a"})
+	gauge.Set(3, Tags{"name": `quote"d`})
+	gauge.Set(-1, Tags{"name": "gone"})
+	gauge.Delete(Tags{"name": "gone"})
+	histogram.Observe(0.05, Tags{"name": "a"})
+	histogram.Observe(0.5, Tags{"name": "a"})
+
+	b := &bytes.Buffer{}
+	if err := WritePrometheus(b); err != nil {
+		t.Fatal(err)
+	}
+	output := b.String()
+
+	expected := []string{
+		"# HELP asg_healthcheck_test_runs_total Test runs.\n",
+		"# TYPE asg_healthcheck_test_runs_total counter\n",
+		`asg_healthcheck_test_runs_total{name="a",successful="true"} 3` + "\n",
+		"# TYPE asg_healthcheck_test_state gauge\n",
+		`asg_healthcheck_test_state{name="quote\"d"} 3` + "\n",
+		"# TYPE asg_healthcheck_test_duration_seconds histogram\n",
+		`asg_healthcheck_test_duration_seconds_bucket{name="a",le="0.1"} 1` + "\n",
+		`asg_healthcheck_test_duration_seconds_bucket{name="a",le="1"} 2` + "\n",
+		`asg_healthcheck_test_duration_seconds_bucket{name="a",le="+Inf"} 2` + "\n",
+		`asg_healthcheck_test_duration_seconds_sum{name="a"} 0.55` + "\n",
+		`asg_healthcheck_test_duration_seconds_count{name="a"} 2` + "\n",
+	}
+	for _, line := range expected {
+		if !strings.Contains(output, line) {
+			t.Errorf("Expected output to contain %q. Output:\n%s", line, output)
+		}
+	}
+	if strings.Contains(output, "gone") {
+		t.Errorf("Deleted series should not be in the output:\n%s", output)
+	}
+}
@@ -0,0 +1,184 @@
+package scriptengine
+
+import (
+	"context"
+	"time"
+
+	"github.com/morfien101/asg-healthcheck-agent/awsapi"
+	"github.com/morfien101/asg-healthcheck-agent/config"
+	"github.com/morfien101/asg-healthcheck-agent/logs"
+	"github.com/morfien101/asg-healthcheck-agent/metrics"
+)
+
+// AWS calls made by hooks without a timeout give up after this long.
+const defaultAWSHookTimeout = 30 * time.Second
+
+// asgHook calls the auto scaling API for the instance the agent is running on.
+// The region, group and instance are discovered from the instance metadata
+// unless they are set in the aws configuration.
+type asgHook struct {
+	name              string
+	hookType          string
+	healthStatus      string
+	respectGrace      bool
+	lifecycleHookName string
+	result            string
+	heartbeatInterval time.Duration
+}
+
+func newASGHook(name, hookType string, cfg *config.ASGHookConfig) *asgHook {
+	h := &asgHook{
+		name:         name,
+		hookType:     hookType,
+		healthStatus: config.ASGUnhealthy,
+		result:       config.LifecycleActionContinue,
+	}
+	if cfg == nil {
+		return h
+	}
+	if cfg.HealthStatus != "" {
+		h.healthStatus = cfg.HealthStatus
+	}
+	if cfg.LifecycleActionResult != "" {
+		h.result = cfg.LifecycleActionResult
+	}
+	h.respectGrace = cfg.ShouldRespectGracePeriod
+	h.lifecycleHookName = cfg.LifecycleHookName
+	h.heartbeatInterval = time.Duration(cfg.HeartbeatIntervalSeconds) * time.Second
+	return h
+}
+
+var promLifecycleHeartbeats = metrics.NewPromCounter(
+	"lifecycle_heartbeats_total",
+	"Number of lifecycle action heartbeats sent by a hook.",
+)
+
+func metricLifecycleHeartbeat(name string, successful bool) {
+	tags := metrics.Tags{"name": name, "successful": "true"}
+	if !successful {
+		tags["successful"] = "false"
+	}
+	metrics.Incr("lifecycle_heartbeat", 1, tags)
+	promLifecycleHeartbeats.Add(1, tags)
+}
+
+func (h *asgHook) run(input hookInput, timeout time.Duration) (int, error) {
+	ctx, cancel := nativeHookContext(timeout, defaultAWSHookTimeout)
+	defer cancel()
+
+	client := awsapi.Default()
+	var err error
+	switch h.hookType {
+	case config.HookTypeASGSetInstanceHealth:
+		err = h.setInstanceHealth(ctx, client)
+	case config.HookTypeASGCompleteLifecycleAction:
+		err = h.completeLifecycleAction(ctx, client)
+	}
+	return nativeHookResult(ctx, h.name, input, err)
+}
+
+func (h *asgHook) setInstanceHealth(ctx context.Context, client *awsapi.Client) error {
+	instanceID, err := client.InstanceID(ctx)
+	if err != nil {
+		return err
+	}
+	logs.JSONLog(
+		"Setting the auto scaling instance health",
+		logs.INFO,
+		logs.JSONAttributes{
+			"failure_hook_name": h.name,
+			"health_status":     h.healthStatus,
+			"instance_id":       instanceID,
+		},
+	)
+	return client.SetInstanceHealth(ctx, instanceID, h.healthStatus, h.respectGrace)
+}
+
+func (h *asgHook) lifecycleAction(ctx context.Context, client *awsapi.Client) (awsapi.LifecycleAction, error) {
+	action := awsapi.LifecycleAction{LifecycleHookName: h.lifecycleHookName}
+	var err error
+	action.InstanceID, err = client.InstanceID(ctx)
+	if err != nil {
+		return action, err
+	}
+	action.AutoScalingGroupName, err = client.AutoScalingGroupName(ctx)
+	return action, err
+}
+
+func (h *asgHook) completeLifecycleAction(ctx context.Context, client *awsapi.Client) error {
+	action, err := h.lifecycleAction(ctx, client)
+	if err != nil {
+		return err
+	}
+	logs.JSONLog(
+		"Completing the lifecycle action",
+		logs.INFO,
+		logs.JSONAttributes{
+			"autoscaling_group_name":  action.AutoScalingGroupName,
+			"failure_hook_name":       h.name,
+			"instance_id":             action.InstanceID,
+			"lifecycle_action_result": h.result,
+			"lifecycle_hook_name":     action.LifecycleHookName,
+		},
+	)
+	return client.CompleteLifecycleAction(ctx, action, h.result)
+}
+
+// startHeartbeat sends lifecycle heartbeats until stop is called. The first is
+// sent straight away. Only hooks that complete a lifecycle action send heartbeats.
+func (h *asgHook) startHeartbeat() (stop func()) {
+	if h.hookType != config.HookTypeASGCompleteLifecycleAction || h.heartbeatInterval == 0 {
+		return nil
+	}
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(h.heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			h.sendHeartbeat()
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+func (h *asgHook) sendHeartbeat() {
+	ctx, cancel := context.WithTimeout(context.Background(), h.heartbeatInterval)
+	defer cancel()
+	client := awsapi.Default()
+	action, err := h.lifecycleAction(ctx, client)
+	if err == nil {
+		err = client.RecordLifecycleActionHeartbeat(ctx, action)
+	}
+	if err != nil {
+		// The lifecycle action may not have started yet, so keep trying.
+		logs.JSONLog(
+			"Failed to send lifecycle heartbeat",
+			logs.WARNING,
+			logs.JSONAttributes{
+				"error":             err.Error(),
+				"failure_hook_name": h.name,
+			},
+		)
+		metricLifecycleHeartbeat(h.name, false)
+		return
+	}
+	logs.JSONLog(
+		"Sent lifecycle heartbeat",
+		logs.DEBUG,
+		logs.JSONAttributes{
+			"failure_hook_name":   h.name,
+			"lifecycle_hook_name": action.LifecycleHookName,
+		},
+	)
+	metricLifecycleHeartbeat(h.name, true)
+}
@@ -0,0 +1,179 @@
+package scriptengine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/morfien101/asg-healthcheck-agent/awsapi"
+	"github.com/morfien101/asg-healthcheck-agent/config"
+)
+
+// awsStub pretends to be the instance metadata service and the AWS APIs.
+// It records the actions that are called. Query API requests have their form
+// parsed before the response is made. Actions without a response get an
+// empty one. The metadata can also hold other local endpoints, like the ECS agent.
+type awsStub struct {
+	*httptest.Server
+	metadata    map[string]string
+	failActions map[string]bool
+	responses   map[string]func(r *http.Request) string
+	actions     []string
+	lock        sync.Mutex
+}
+
+func newAWSStub() *awsStub {
+	s := &awsStub{failActions: map[string]bool{}, responses: map[string]func(r *http.Request) string{}}
+	s.metadata = map[string]string{
+		"/latest/meta-data/instance-id":                             "i-0123456789",
+		"/latest/meta-data/placement/region":                        "eu-west-1",
+		"/latest/meta-data/tags/instance/aws:autoscaling:groupName": "web",
+		"/latest/meta-data/iam/security-credentials/":               "role",
+		"/latest/meta-data/iam/security-credentials/role":           `{"Code":"Success","AccessKeyId":"AKID","SecretAccessKey":"secret"}`,
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPut:
+			w.Write([]byte("token"))
+		case r.Method == http.MethodGet:
+			s.lock.Lock()
+			value, ok := s.metadata[r.URL.Path]
+			s.lock.Unlock()
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(value))
+		default:
+			target := r.Header.Get("X-Amz-Target")
+			action := target[strings.LastIndex(target, ".")+1:]
+			if target == "" {
+				r.ParseForm()
+				action = r.PostForm.Get("Action")
+			}
+			s.lock.Lock()
+			s.actions = append(s.actions, action)
+			fail := s.failActions[action]
+			respond := s.responses[action]
+			s.lock.Unlock()
+			switch {
+			case fail && target != "":
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"__type":"ClusterNotFoundException","message":"Cluster not found."}`))
+			case fail:
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("<ErrorResponse><Error><Code>ValidationError</Code><Message>No active Lifecycle Action found</Message></Error></ErrorResponse>"))
+			case respond != nil:
+				w.Write([]byte(respond(r)))
+			case target != "":
+				w.Write([]byte("{}"))
+			default:
+				w.Write([]byte("<Response></Response>"))
+			}
+		}
+	}))
+	awsapi.Setup(config.AWSConfig{
+		IMDSEndpoint: s.URL,
+		Endpoints:    map[string]string{"autoscaling": s.URL, "ecs": s.URL, "elasticloadbalancing": s.URL},
+	})
+	return s
+}
+
+func (s *awsStub) Close() {
+	s.Server.Close()
+	awsapi.Setup(config.AWSConfig{})
+}
+
+func (s *awsStub) calls() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.actions...)
+}
+
+// clearAWSEnvironment makes sure the credentials come from the stub.
+func clearAWSEnvironment() func() {
+	old := map[string]string{}
+	for _, key := range []string{"AWS_ACCESS_KEY_ID", "AWS_REGION", "AWS_DEFAULT_REGION", "AWS_SHARED_CREDENTIALS_FILE"} {
+		old[key] = os.Getenv(key)
+		os.Unsetenv(key)
+	}
+	os.Setenv("AWS_SHARED_CREDENTIALS_FILE", os.DevNull)
+	return func() {
+		for key, value := range old {
+			if value == "" {
+				os.Unsetenv(key)
+			} else {
+				os.Setenv(key, value)
+			}
+		}
+	}
+}
+
+func TestASGHooks(t *testing.T) {
+	defer clearAWSEnvironment()()
+	s := newAWSStub()
+	defer s.Close()
+
+	fhe := NewFailureHookEngine([]config.FailureHook{
+		{Name: "unhealthy", Type: config.HookTypeASGSetInstanceHealth},
+		{Name: "drain", Bin: "/bin/sh", Args: []string{"-c", "sleep 1"}},
+		{
+			Name: "complete",
+			Type: config.HookTypeASGCompleteLifecycleAction,
+			ASG: &config.ASGHookConfig{
+				LifecycleHookName:        "terminate",
+				HeartbeatIntervalSeconds: 1,
+			},
+		},
+	})
+	report := fhe.RunHooks(NewFailureContext(ReasonStableFailure))
+	for _, result := range report.Hooks {
+		if result.Outcome != config.HookOutcomeSucceeded {
+			t.Errorf("Expected %s to succeed, got %+v", result.Name, result)
+		}
+	}
+
+	calls := s.calls()
+	if len(calls) < 3 {
+		t.Fatalf("Expected at least 3 calls, got %v", calls)
+	}
+	if calls[len(calls)-1] != "CompleteLifecycleAction" {
+		t.Errorf("Expected the lifecycle action to be completed last, got %v", calls)
+	}
+	heartbeats := 0
+	for _, call := range calls {
+		if call == "RecordLifecycleActionHeartbeat" {
+			heartbeats++
+		}
+	}
+	if heartbeats == 0 {
+		t.Errorf("Expected heartbeats while the drain hook ran, got %v", calls)
+	}
+	if !strings.Contains(strings.Join(calls, ","), "SetInstanceHealth") {
+		t.Errorf("Expected the instance health to be set, got %v", calls)
+	}
+}
+
+func TestASGHookFailure(t *testing.T) {
+	defer clearAWSEnvironment()()
+	s := newAWSStub()
+	defer s.Close()
+	s.failActions["CompleteLifecycleAction"] = true
+
+	fhe := NewFailureHookEngine([]config.FailureHook{
+		{
+			Name:     "complete",
+			Type:     config.HookTypeASGCompleteLifecycleAction,
+			ASG:      &config.ASGHookConfig{LifecycleHookName: "terminate"},
+			MaxRetry: 1,
+		},
+	})
+	report := fhe.RunHooks(NewFailureContext(ReasonStableFailure))
+	result := report.Hooks[0]
+	if result.Outcome != config.HookOutcomeFailed || result.Attempts != 2 || result.ExitCode != 1 {
+		t.Errorf("Expected the hook to fail after 2 attempts with exit code 1, got %+v", result)
+	}
+}
@@ -0,0 +1,216 @@
+package scriptengine
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/morfien101/asg-healthcheck-agent/awsapi"
+	"github.com/morfien101/asg-healthcheck-agent/config"
+	"github.com/morfien101/asg-healthcheck-agent/logs"
+)
+
+const (
+	defaultDrainPollInterval = 10 * time.Second
+	defaultDrainTimeout      = 10 * time.Minute
+)
+
+// States of an ECS drain shown in _status.
+const (
+	ecsDrainDraining = "draining"
+	ecsDrainDrained  = "drained"
+	ecsDrainTimedOut = "timed_out"
+	ecsDrainFailed   = "failed"
+)
+
+var errECSDrainTimedOut = errors.New("tasks were still running when the drain timeout passed")
+
+// ecsDrainProgress is shown in _status while the container instance drains.
+type ecsDrainProgress struct {
+	State                string `json:"state"`
+	Cluster              string `json:"cluster,omitempty"`
+	ContainerInstanceArn string `json:"container_instance_arn,omitempty"`
+	RunningTasks         int64  `json:"running_tasks"`
+	StartedAt            string `json:"started_at"`
+	LastPollTime         string `json:"last_poll_time,omitempty"`
+	Error                string `json:"error,omitempty"`
+}
+
+// ecsDrainHook sets the ECS container instance to DRAINING and waits for the
+// running tasks to stop.
+type ecsDrainHook struct {
+	name          string
+	cluster       string
+	arn           string
+	agentEndpoint string
+	pollInterval  time.Duration
+	drainTimeout  time.Duration
+	status        *ecsDrainProgress
+	lock          sync.RWMutex
+}
+
+func newECSDrainHook(name string, cfg *config.ECSHookConfig) *ecsDrainHook {
+	h := &ecsDrainHook{
+		name:         name,
+		pollInterval: defaultDrainPollInterval,
+		drainTimeout: defaultDrainTimeout,
+	}
+	if cfg == nil {
+		return h
+	}
+	h.cluster = cfg.Cluster
+	h.arn = cfg.ContainerInstanceArn
+	h.agentEndpoint = cfg.AgentEndpoint
+	if cfg.PollIntervalSeconds > 0 {
+		h.pollInterval = time.Duration(cfg.PollIntervalSeconds) * time.Second
+	}
+	if cfg.DrainTimeoutSeconds > 0 {
+		h.drainTimeout = time.Duration(cfg.DrainTimeoutSeconds) * time.Second
+	}
+	return h
+}
+
+func (h *ecsDrainHook) progress() interface{} {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	if h.status == nil {
+		return nil
+	}
+	status := *h.status
+	return status
+}
+
+func (h *ecsDrainHook) update(f func(p *ecsDrainProgress)) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	f(h.status)
+}
+
+func (h *ecsDrainHook) run(input hookInput, timeout time.Duration) (int, error) {
+	// The drain timeout limits the wait, so there is no other limit unless the hook sets one.
+	ctx, cancel := nativeHookContext(timeout, 0)
+	defer cancel()
+
+	h.lock.Lock()
+	h.status = &ecsDrainProgress{
+		State:     ecsDrainDraining,
+		StartedAt: time.Now().Format("Mon Jan 2 15:04:05 -0700 MST 2006"),
+	}
+	h.lock.Unlock()
+
+	err := h.drain(ctx, awsapi.Default())
+	if err != nil {
+		h.update(func(p *ecsDrainProgress) {
+			p.State = ecsDrainFailed
+			if err == errECSDrainTimedOut || ctx.Err() == context.DeadlineExceeded {
+				p.State = ecsDrainTimedOut
+			}
+			p.Error = err.Error()
+		})
+	}
+	return nativeHookResult(ctx, h.name, input, err)
+}
+
+// containerInstance uses the configured cluster and container instance, or asks the ECS agent.
+func (h *ecsDrainHook) containerInstance(ctx context.Context) (string, string, error) {
+	if h.cluster != "" && h.arn != "" {
+		return h.cluster, h.arn, nil
+	}
+	metadata, err := awsapi.ReadECSAgentMetadata(ctx, h.agentEndpoint)
+	if err != nil {
+		return "", "", err
+	}
+	cluster, arn := h.cluster, h.arn
+	if cluster == "" {
+		cluster = metadata.Cluster
+	}
+	if arn == "" {
+		arn = metadata.ContainerInstanceArn
+	}
+	return cluster, arn, nil
+}
+
+func (h *ecsDrainHook) drain(ctx context.Context, client *awsapi.Client) error {
+	cluster, arn, err := h.containerInstance(ctx)
+	if err != nil {
+		return err
+	}
+	h.update(func(p *ecsDrainProgress) {
+		p.Cluster = cluster
+		p.ContainerInstanceArn = arn
+	})
+	attributes := logs.JSONAttributes{
+		"cluster":                cluster,
+		"container_instance_arn": arn,
+		"failure_hook_name":      h.name,
+	}
+	logs.JSONLog("Draining ECS container instance", logs.INFO, attributes)
+	if err := client.UpdateContainerInstanceState(ctx, cluster, arn, "DRAINING"); err != nil {
+		return err
+	}
+
+	drainDeadline := time.Now().Add(h.drainTimeout)
+	for {
+		instance, err := client.DescribeContainerInstance(ctx, cluster, arn)
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			// Keep polling, the drain carries on without us.
+			logs.JSONLog(
+				"Failed to check the ECS container instance, will try again",
+				logs.WARNING,
+				logs.JSONAttributes{
+					"error":             err.Error(),
+					"failure_hook_name": h.name,
+				},
+			)
+		} else {
+			h.update(func(p *ecsDrainProgress) {
+				p.RunningTasks = instance.RunningTasksCount
+				p.LastPollTime = time.Now().Format("Mon Jan 2 15:04:05 -0700 MST 2006")
+			})
+			if instance.RunningTasksCount == 0 {
+				h.update(func(p *ecsDrainProgress) { p.State = ecsDrainDrained })
+				logs.JSONLog("ECS container instance has drained", logs.INFO, attributes)
+				return nil
+			}
+			logs.JSONLog(
+				"Waiting for ECS tasks to stop",
+				logs.INFO,
+				logs.JSONAttributes{
+					"failure_hook_name": h.name,
+					"running_tasks":     instance.RunningTasksCount,
+					"seconds_left":      int(time.Until(drainDeadline).Seconds()),
+				},
+			)
+		}
+
+		more, err := waitToPoll(ctx, h.pollInterval, drainDeadline)
+		if err != nil {
+			return err
+		}
+		if !more {
+			return errECSDrainTimedOut
+		}
+	}
+}
+
+// waitToPoll waits for the next poll of a drain. It gives back false once the drain
+// deadline has passed. The last wait is cut short so there is a final poll at the deadline.
+func waitToPoll(ctx context.Context, interval time.Duration, drainDeadline time.Time) (bool, error) {
+	remaining := time.Until(drainDeadline)
+	if remaining <= 0 {
+		return false, nil
+	}
+	if remaining < interval {
+		interval = remaining
+	}
+	select {
+	case <-ctx.Done():
+		return false, ctx.Err()
+	case <-time.After(interval):
+		return true, nil
+	}
+}
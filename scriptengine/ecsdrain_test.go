@@ -0,0 +1,83 @@
+package scriptengine
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/morfien101/asg-healthcheck-agent/config"
+)
+
+func TestECSDrainHook(t *testing.T) {
+	defer clearAWSEnvironment()()
+	s := newAWSStub()
+	defer s.Close()
+	s.metadata["/v1/metadata"] = `{"Cluster":"web","ContainerInstanceArn":"arn:aws:ecs:eu-west-1:1:container-instance/web/abc"}`
+	running := 2
+	s.responses["DescribeContainerInstances"] = func(*http.Request) string {
+		count := running
+		if running > 0 {
+			running--
+		}
+		return fmt.Sprintf(`{"containerInstances":[{"status":"DRAINING","runningTasksCount":%d}]}`, count)
+	}
+
+	fhe := NewFailureHookEngine([]config.FailureHook{
+		{
+			Name: "drain",
+			Type: config.HookTypeECSDrain,
+			ECS:  &config.ECSHookConfig{AgentEndpoint: s.URL, PollIntervalSeconds: 1},
+		},
+	})
+	report := fhe.RunHooks(NewFailureContext(ReasonStableFailure))
+	if report.Hooks[0].Outcome != config.HookOutcomeSucceeded {
+		t.Fatalf("Expected the drain to succeed, got %+v", report.Hooks[0])
+	}
+	calls := strings.Join(s.calls(), ",")
+	if calls != "UpdateContainerInstancesState,DescribeContainerInstances,DescribeContainerInstances,DescribeContainerInstances" {
+		t.Errorf("Unexpected calls %s", calls)
+	}
+
+	b, err := json.Marshal(fhe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := string(b)
+	if !strings.Contains(status, `"state":"drained"`) || !strings.Contains(status, `"cluster":"web"`) {
+		t.Errorf("Expected the drain progress in the status, got %s", status)
+	}
+}
+
+func TestECSDrainHookTimeout(t *testing.T) {
+	defer clearAWSEnvironment()()
+	s := newAWSStub()
+	defer s.Close()
+	s.responses["DescribeContainerInstances"] = func(*http.Request) string {
+		return `{"containerInstances":[{"status":"DRAINING","runningTasksCount":3}]}`
+	}
+
+	h := newECSDrainHook("drain", &config.ECSHookConfig{
+		Cluster:              "web",
+		ContainerInstanceArn: "arn",
+		PollIntervalSeconds:  1,
+		DrainTimeoutSeconds:  1,
+	})
+	exitcode, err := h.run(newHookInput(NewFailureContext(ReasonStableFailure), "drain", 1), 0)
+	if exitcode != 1 || err != nil {
+		t.Errorf("Expected the drain to fail with exit code 1, got %d. Error: %v", exitcode, err)
+	}
+	progress := h.progress().(ecsDrainProgress)
+	if progress.State != ecsDrainTimedOut || progress.RunningTasks != 3 {
+		t.Errorf("Expected the drain to time out with 3 tasks running, got %+v", progress)
+	}
+
+	s.failActions["UpdateContainerInstancesState"] = true
+	if exitcode, _ := h.run(newHookInput(NewFailureContext(ReasonStableFailure), "drain", 1), 0); exitcode != 1 {
+		t.Errorf("Expected an API error to fail the hook, got %d", exitcode)
+	}
+	if progress := h.progress().(ecsDrainProgress); progress.State != ecsDrainFailed || !strings.Contains(progress.Error, "ClusterNotFoundException") {
+		t.Errorf("Expected the drain to fail with the API error, got %+v", progress)
+	}
+}
@@ -0,0 +1,234 @@
+package scriptengine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/morfien101/asg-healthcheck-agent/awsapi"
+	"github.com/morfien101/asg-healthcheck-agent/config"
+	"github.com/morfien101/asg-healthcheck-agent/logs"
+)
+
+// States of a target group in the hook report.
+const (
+	targetGroupUnused        = "unused"
+	targetGroupDraining      = "draining"
+	targetGroupNotRegistered = "not_registered"
+	targetGroupFailed        = "failed"
+)
+
+var errELBDrainTimedOut = errors.New("targets were still draining when the drain timeout passed")
+
+// elbDeregisterHook removes the instance from ALB and NLB target groups and
+// waits for the connections to drain.
+type elbDeregisterHook struct {
+	name            string
+	targetGroupArns []string
+	pollInterval    time.Duration
+	drainTimeout    time.Duration
+	results         []TargetGroupResult
+	lock            sync.RWMutex
+}
+
+func newELBDeregisterHook(name string, cfg *config.ELBHookConfig) *elbDeregisterHook {
+	h := &elbDeregisterHook{
+		name:         name,
+		pollInterval: defaultDrainPollInterval,
+		drainTimeout: defaultDrainTimeout,
+	}
+	if cfg == nil {
+		return h
+	}
+	h.targetGroupArns = cfg.TargetGroupArns
+	if cfg.PollIntervalSeconds > 0 {
+		h.pollInterval = time.Duration(cfg.PollIntervalSeconds) * time.Second
+	}
+	if cfg.DrainTimeoutSeconds > 0 {
+		h.drainTimeout = time.Duration(cfg.DrainTimeoutSeconds) * time.Second
+	}
+	return h
+}
+
+func (h *elbDeregisterHook) addDetails(result *HookResult) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	result.TargetGroups = append([]TargetGroupResult{}, h.results...)
+}
+
+func (h *elbDeregisterHook) addResult(result TargetGroupResult) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.results = append(h.results, result)
+}
+
+func (h *elbDeregisterHook) updateResult(arn, state, errMsg string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for i := range h.results {
+		if h.results[i].TargetGroupArn == arn {
+			h.results[i].State = state
+			h.results[i].Error = errMsg
+		}
+	}
+}
+
+func (h *elbDeregisterHook) run(input hookInput, timeout time.Duration) (int, error) {
+	// The drain timeout limits the wait, so there is no other limit unless the hook sets one.
+	ctx, cancel := nativeHookContext(timeout, 0)
+	defer cancel()
+
+	h.lock.Lock()
+	h.results = []TargetGroupResult{}
+	h.lock.Unlock()
+
+	err := h.deregister(ctx, awsapi.Default())
+	return nativeHookResult(ctx, h.name, input, err)
+}
+
+// instanceTargets finds the targets of the instance that are registered in the target group.
+func instanceTargets(ctx context.Context, client *awsapi.Client, arn, instanceID string) ([]awsapi.Target, error) {
+	health, err := client.DescribeTargetHealth(ctx, arn, nil)
+	if err != nil {
+		return nil, err
+	}
+	targets := []awsapi.Target{}
+	for _, th := range health {
+		if th.Target.ID == instanceID && th.State != awsapi.TargetStateUnused {
+			targets = append(targets, th.Target)
+		}
+	}
+	return targets, nil
+}
+
+func (h *elbDeregisterHook) deregister(ctx context.Context, client *awsapi.Client) error {
+	instanceID, err := client.InstanceID(ctx)
+	if err != nil {
+		return err
+	}
+	arns := h.targetGroupArns
+	discovered := len(arns) == 0
+	if discovered {
+		arns, err = client.InstanceTargetGroups(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to find the target groups. Error: %s", err)
+		}
+	}
+
+	// The targets of the instance in each target group that are still draining.
+	pending := map[string][]awsapi.Target{}
+	for _, arn := range arns {
+		result := TargetGroupResult{TargetGroupArn: arn}
+		targets, err := instanceTargets(ctx, client, arn, instanceID)
+		switch {
+		case err != nil:
+			result.State = targetGroupFailed
+			result.Error = err.Error()
+		case len(targets) == 0:
+			if discovered {
+				// Only the groups the instance is in are interesting.
+				continue
+			}
+			result.State = targetGroupNotRegistered
+		default:
+			result.Targets = len(targets)
+			logs.JSONLog(
+				"Deregistering instance from target group",
+				logs.INFO,
+				logs.JSONAttributes{
+					"failure_hook_name": h.name,
+					"target_group_arn":  arn,
+					"targets":           len(targets),
+				},
+			)
+			if err := client.DeregisterTargets(ctx, arn, targets); err != nil {
+				result.State = targetGroupFailed
+				result.Error = err.Error()
+			} else {
+				result.State = targetGroupDraining
+				pending[arn] = targets
+			}
+		}
+		h.addResult(result)
+	}
+
+	drainDeadline := time.Now().Add(h.drainTimeout)
+	for len(pending) > 0 {
+		for arn, targets := range pending {
+			health, err := client.DescribeTargetHealth(ctx, arn, targets)
+			if err != nil {
+				if ctx.Err() != nil {
+					return err
+				}
+				logs.JSONLog(
+					"Failed to check the targets, will try again",
+					logs.WARNING,
+					logs.JSONAttributes{
+						"error":             err.Error(),
+						"failure_hook_name": h.name,
+						"target_group_arn":  arn,
+					},
+				)
+				continue
+			}
+			if allTargetsUnused(health) {
+				h.updateResult(arn, targetGroupUnused, "")
+				delete(pending, arn)
+				logs.JSONLog(
+					"Targets have drained from target group",
+					logs.INFO,
+					logs.JSONAttributes{
+						"failure_hook_name": h.name,
+						"target_group_arn":  arn,
+					},
+				)
+			}
+		}
+		if len(pending) == 0 {
+			break
+		}
+		logs.JSONLog(
+			"Waiting for targets to drain",
+			logs.INFO,
+			logs.JSONAttributes{
+				"failure_hook_name":      h.name,
+				"seconds_left":           int(time.Until(drainDeadline).Seconds()),
+				"target_groups_draining": len(pending),
+			},
+		)
+		more, err := waitToPoll(ctx, h.pollInterval, drainDeadline)
+		if err != nil {
+			return err
+		}
+		if !more {
+			for arn := range pending {
+				h.updateResult(arn, targetGroupDraining, errELBDrainTimedOut.Error())
+			}
+			return errELBDrainTimedOut
+		}
+	}
+
+	failed := 0
+	h.lock.RLock()
+	for _, result := range h.results {
+		if result.State == targetGroupFailed {
+			failed++
+		}
+	}
+	h.lock.RUnlock()
+	if failed > 0 {
+		return fmt.Errorf("failed to deregister from %d target group(s)", failed)
+	}
+	return nil
+}
+
+func allTargetsUnused(health []awsapi.TargetHealth) bool {
+	for _, th := range health {
+		if th.State != awsapi.TargetStateUnused {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,116 @@
+package scriptengine
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/morfien101/asg-healthcheck-agent/config"
+)
+
+func targetHealthResponse(targets ...string) string {
+	members := ""
+	for _, target := range targets {
+		parts := strings.Split(target, ":")
+		members += "<member><Target><Id>" + parts[0] + "</Id><Port>80</Port></Target><TargetHealth><State>" + parts[1] + "</State></TargetHealth></member>"
+	}
+	return "<DescribeTargetHealthResponse><DescribeTargetHealthResult><TargetHealthDescriptions>" +
+		members +
+		"</TargetHealthDescriptions></DescribeTargetHealthResult></DescribeTargetHealthResponse>"
+}
+
+func TestELBDeregisterHook(t *testing.T) {
+	defer clearAWSEnvironment()()
+	s := newAWSStub()
+	defer s.Close()
+
+	s.responses["DescribeTargetGroups"] = func(*http.Request) string {
+		return `<DescribeTargetGroupsResponse><DescribeTargetGroupsResult><TargetGroups>
+<member><TargetGroupArn>arn:tg-a</TargetGroupArn><TargetType>instance</TargetType></member>
+<member><TargetGroupArn>arn:tg-b</TargetGroupArn><TargetType>instance</TargetType></member>
+<member><TargetGroupArn>arn:tg-ip</TargetGroupArn><TargetType>ip</TargetType></member>
+</TargetGroups></DescribeTargetGroupsResult></DescribeTargetGroupsResponse>`
+	}
+	deregistered := ""
+	s.responses["DeregisterTargets"] = func(r *http.Request) string {
+		deregistered = r.PostForm.Get("TargetGroupArn") + "/" + r.PostForm.Get("Targets.member.1.Id") + ":" + r.PostForm.Get("Targets.member.1.Port")
+		return "<DeregisterTargetsResponse></DeregisterTargetsResponse>"
+	}
+	polls := 0
+	s.responses["DescribeTargetHealth"] = func(r *http.Request) string {
+		switch {
+		case r.PostForm.Get("TargetGroupArn") == "arn:tg-b":
+			return targetHealthResponse("i-other:healthy")
+		case r.PostForm.Get("Targets.member.1.Id") == "":
+			return targetHealthResponse("i-0123456789:healthy", "i-other:healthy")
+		}
+		polls++
+		if polls == 1 {
+			return targetHealthResponse("i-0123456789:draining")
+		}
+		return targetHealthResponse("i-0123456789:unused")
+	}
+
+	fhe := NewFailureHookEngine([]config.FailureHook{
+		{
+			Name: "deregister",
+			Type: config.HookTypeELBDeregister,
+			ELB:  &config.ELBHookConfig{PollIntervalSeconds: 1},
+		},
+	})
+	result := fhe.RunHooks(NewFailureContext(ReasonStableFailure)).Hooks[0]
+	if result.Outcome != config.HookOutcomeSucceeded {
+		t.Fatalf("Expected the deregistration to succeed, got %+v", result)
+	}
+	if deregistered != "arn:tg-a/i-0123456789:80" {
+		t.Errorf("Expected only the instance to be deregistered from tg-a, got %s", deregistered)
+	}
+	if len(result.TargetGroups) != 1 {
+		t.Fatalf("Expected only the target group the instance is in to be reported, got %+v", result.TargetGroups)
+	}
+	tg := result.TargetGroups[0]
+	if tg.TargetGroupArn != "arn:tg-a" || tg.State != targetGroupUnused || tg.Targets != 1 {
+		t.Errorf("Unexpected target group result %+v", tg)
+	}
+}
+
+func TestELBDeregisterHookTimeout(t *testing.T) {
+	defer clearAWSEnvironment()()
+	s := newAWSStub()
+	defer s.Close()
+
+	s.responses["DescribeTargetHealth"] = func(r *http.Request) string {
+		if r.PostForm.Get("TargetGroupArn") == "arn:tg-b" {
+			return targetHealthResponse()
+		}
+		if r.PostForm.Get("Targets.member.1.Id") == "" {
+			return targetHealthResponse("i-0123456789:healthy")
+		}
+		return targetHealthResponse("i-0123456789:draining")
+	}
+
+	fhe := NewFailureHookEngine([]config.FailureHook{
+		{
+			Name: "deregister",
+			Type: config.HookTypeELBDeregister,
+			ELB: &config.ELBHookConfig{
+				TargetGroupArns:     []string{"arn:tg-a", "arn:tg-b"},
+				PollIntervalSeconds: 1,
+				DrainTimeoutSeconds: 1,
+			},
+		},
+	})
+	result := fhe.RunHooks(NewFailureContext(ReasonStableFailure)).Hooks[0]
+	if result.Outcome != config.HookOutcomeFailed || result.ExitCode != 1 {
+		t.Fatalf("Expected the deregistration to fail, got %+v", result)
+	}
+	if len(result.TargetGroups) != 2 {
+		t.Fatalf("Expected both target groups to be reported, got %+v", result.TargetGroups)
+	}
+	if tg := result.TargetGroups[0]; tg.State != targetGroupDraining || tg.Error == "" {
+		t.Errorf("Expected tg-a to still be draining, got %+v", tg)
+	}
+	if tg := result.TargetGroups[1]; tg.State != targetGroupNotRegistered {
+		t.Errorf("Expected tg-b to be not_registered, got %+v", tg)
+	}
+}
@@ -0,0 +1,115 @@
+package scriptengine
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/morfien101/asg-healthcheck-agent/identity"
+)
+
+// Reasons that hooks are run.
+const (
+	ReasonStableFailure     = "stable_failure"
+	ReasonTerminationSignal = "termination_signal"
+	ReasonRecovered         = "recovered"
+	// Reasons given by the instance metadata watcher.
+	ReasonSpotInterruption        = "spot_interruption"
+	ReasonRebalanceRecommendation = "rebalance_recommendation"
+	// The termination hooks are run when the target lifecycle state is Terminated.
+	ReasonTargetLifecycleTerminated = "target_lifecycle_terminated"
+)
+
+// FailureContext describes why the hooks are running. It is given to each hook as
+// ASG_HC_* environment variables and as a JSON document on stdin.
+type FailureContext struct {
+	IncidentID                string   `json:"incident_id"`
+	Reason                    string   `json:"reason"`
+	CheckName                 string   `json:"check_name"`
+	Group                     string   `json:"group,omitempty"`
+	LastExitCode              int      `json:"last_exit_code"`
+	LastState                 string   `json:"last_state"`
+	LastRunTime               string   `json:"last_run_time"`
+	OutputTail                []string `json:"output_tail"`
+	FailureCount              uint     `json:"failure_count"`
+	FailuresSinceLastRecovery uint     `json:"failures_since_last_recovery"`
+	AllowedFailures           uint     `json:"allowed_failures"`
+	DetectedAt                string   `json:"detected_at"`
+}
+
+// NewFailureContext starts a context for a new incident.
+// The details of the check are filled in by the HealthCheckEngine.
+func NewFailureContext(reason string) FailureContext {
+	return FailureContext{
+		IncidentID:   newIncidentID(),
+		Reason:       reason,
+		LastExitCode: -1,
+		OutputTail:   []string{},
+		DetectedAt:   time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+func newIncidentID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// Not unique but still useful to tie the logs together.
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// hookInput is what each hook is given. It adds the details of the hook run and
+// the identity of the instance, when it has been discovered, to the context.
+type hookInput struct {
+	FailureContext
+	HookName      string             `json:"hook_name"`
+	Attempt       uint               `json:"attempt"`
+	HookStartedAt string             `json:"hook_started_at"`
+	Instance      *identity.Identity `json:"instance,omitempty"`
+}
+
+func newHookInput(fc FailureContext, hookName string, attempt uint) hookInput {
+	return hookInput{
+		FailureContext: fc,
+		HookName:       hookName,
+		Attempt:        attempt,
+		HookStartedAt:  time.Now().UTC().Format(time.RFC3339),
+		Instance:       identity.Current(),
+	}
+}
+
+func (hi hookInput) environment() []string {
+	env := []string{
+		"ASG_HC_INCIDENT_ID=" + hi.IncidentID,
+		"ASG_HC_REASON=" + hi.Reason,
+		"ASG_HC_CHECK_NAME=" + hi.CheckName,
+		"ASG_HC_GROUP=" + hi.Group,
+		fmt.Sprintf("ASG_HC_LAST_EXIT_CODE=%d", hi.LastExitCode),
+		"ASG_HC_LAST_STATE=" + hi.LastState,
+		"ASG_HC_LAST_RUN_TIME=" + hi.LastRunTime,
+		"ASG_HC_OUTPUT_TAIL=" + strings.Join(hi.OutputTail, "\n"),
+		fmt.Sprintf("ASG_HC_FAILURE_COUNT=%d", hi.FailureCount),
+		fmt.Sprintf("ASG_HC_FAILURES_SINCE_LAST_RECOVERY=%d", hi.FailuresSinceLastRecovery),
+		fmt.Sprintf("ASG_HC_ALLOWED_FAILURES=%d", hi.AllowedFailures),
+		"ASG_HC_DETECTED_AT=" + hi.DetectedAt,
+		"ASG_HC_HOOK_NAME=" + hi.HookName,
+		fmt.Sprintf("ASG_HC_ATTEMPT=%d", hi.Attempt),
+		"ASG_HC_HOOK_STARTED_AT=" + hi.HookStartedAt,
+	}
+	if hi.Instance != nil {
+		env = append(env, hi.Instance.Environment()...)
+	}
+	return env
+}
+
+func (hi hookInput) json() []byte {
+	b, err := json.Marshal(hi)
+	if err != nil {
+		return []byte("{}\n")
+	}
+	// A trailing new line lets scripts use read.
+	return append(b, '\n')
+}
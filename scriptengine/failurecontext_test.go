@@ -0,0 +1,115 @@
+package scriptengine
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/morfien101/asg-healthcheck-agent/config"
+	"github.com/morfien101/asg-healthcheck-agent/identity"
+)
+
+func TestFailureContextGivenToHooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "failurecontext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	envFile := filepath.Join(dir, "env")
+	stdinFile := filepath.Join(dir, "stdin")
+
+	hce := NewHealthCheckEngine([]config.HealthCheck{
+		{Name: "disk", Bin: "/bin/sh", Args: []string{"-c", "echo disk is full; exit 2"}, FreqSeconds: 1},
+	})
+	hce.SetGraceMode(false)
+	hce.HealthChecks[0].runCheck()
+	fc := hce.DescribeFailure("disk", NewFailureContext(ReasonStableFailure))
+
+	fhe := NewFailureHookEngine([]config.FailureHook{
+		{
+			Name: "record",
+			Bin:  "/bin/sh",
+			Args: []string{"-c", "env | grep ^ASG_HC_ > " + envFile + "; cat > " + stdinFile},
+		},
+	})
+	fhe.RunHooks(fc)
+
+	env, err := ioutil.ReadFile(envFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"ASG_HC_INCIDENT_ID=" + fc.IncidentID,
+		"ASG_HC_REASON=stable_failure",
+		"ASG_HC_CHECK_NAME=disk",
+		"ASG_HC_LAST_EXIT_CODE=2",
+		"ASG_HC_OUTPUT_TAIL=disk is full",
+		"ASG_HC_FAILURE_COUNT=1",
+		"ASG_HC_HOOK_NAME=record",
+		"ASG_HC_ATTEMPT=1",
+	} {
+		if !strings.Contains(string(env), expected+"\n") {
+			t.Errorf("Expected %s in the environment, got:\n%s", expected, env)
+		}
+	}
+
+	stdin, err := ioutil.ReadFile(stdinFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := hookInput{}
+	if err := json.Unmarshal(stdin, &input); err != nil {
+		t.Fatalf("Failed to decode stdin %q. Error: %s", stdin, err)
+	}
+	if input.IncidentID != fc.IncidentID || input.CheckName != "disk" || input.HookName != "record" {
+		t.Errorf("Unexpected hook input %+v", input)
+	}
+	if len(input.OutputTail) != 1 || input.OutputTail[0] != "disk is full" {
+		t.Errorf("Unexpected output tail %q", input.OutputTail)
+	}
+}
+
+func TestHookInputIdentity(t *testing.T) {
+	if input := newHookInput(NewFailureContext(ReasonStableFailure), "hook", 1); input.Instance != nil {
+		t.Errorf("Expected no identity until it is discovered, got %+v", input.Instance)
+	}
+
+	identity.Set(&identity.Identity{
+		Hostname:   "web-1",
+		InstanceID: "i-0123456789",
+		Tags:       map[string]string{"team-name": "web"},
+	})
+	defer identity.Set(nil)
+	input := newHookInput(NewFailureContext(ReasonStableFailure), "hook", 1)
+	env := strings.Join(input.environment(), "\n")
+	for _, expected := range []string{"ASG_HC_HOSTNAME=web-1", "ASG_HC_INSTANCE_ID=i-0123456789", "ASG_HC_TAG_TEAM_NAME=web"} {
+		if !strings.Contains(env, expected) {
+			t.Errorf("Expected %s in the environment, got:\n%s", expected, env)
+		}
+	}
+	if stdin := string(input.json()); !strings.Contains(stdin, `"instance":{"hostname":"web-1","instance_id":"i-0123456789"`) {
+		t.Errorf("Expected the identity on stdin, got %s", stdin)
+	}
+}
+
+func TestFailureContextNativeCheck(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	hce := NewHealthCheckEngine([]config.HealthCheck{
+		{Name: "web", Type: config.CheckTypeHTTP, HTTP: &config.HTTPCheckConfig{URL: srv.URL}, FreqSeconds: 1},
+	})
+	hce.SetGraceMode(false)
+	hce.HealthChecks[0].runCheck()
+	fc := hce.DescribeFailure("web", NewFailureContext(ReasonStableFailure))
+	if len(fc.OutputTail) != 1 || fc.OutputTail[0] != "unexpected status code 503" {
+		t.Errorf("Expected the failure reason as the output tail, got %q", fc.OutputTail)
+	}
+}
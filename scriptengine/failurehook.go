@@ -1,6 +1,8 @@
 package scriptengine
 
 import (
+	"context"
+	"encoding/json"
 	"time"
 
 	"github.com/morfien101/asg-healthcheck-agent/config"
@@ -9,27 +11,194 @@ import (
 )
 
 type failureHookInterface interface {
-	run()
+	run(fc FailureContext, deadline time.Time) HookResult
+}
+
+// nativeHook is a hook that is run by the agent rather than a script. It reports
+// the result as if it were a process that exited. 0 is success.
+type nativeHook interface {
+	run(input hookInput, timeout time.Duration) (exitcode int, err error)
+}
+
+// heartbeater is a native hook that needs to keep something alive while the
+// hooks before it run.
+type heartbeater interface {
+	startHeartbeat() (stop func())
+}
+
+// progressReporter is a native hook that shows what it is doing in _status.
+type progressReporter interface {
+	progress() interface{}
+}
+
+// resultDetailer is a native hook that adds the details of its last attempt to the hook report.
+type resultDetailer interface {
+	addDetails(result *HookResult)
+}
+
+// hookAttempt is a single attempt at running a hook.
+type hookAttempt interface {
+	run() (exitcode int, err error)
+}
+
+// hookFunc lets a single attempt at a native hook be run like a process.
+type hookFunc func() (int, error)
+
+func (f hookFunc) run() (int, error) {
+	return f()
 }
 
 type failureHook struct {
-	Name                    string `json:"name"`
-	Description             string `json:"description"`
-	MaxRetry                uint   `json:"retries_allowed"`
-	TimeBetweenRetrySeconds uint   `json:"seconds_between_retries"`
+	Name                    string                    `json:"name"`
+	Description             string                    `json:"description"`
+	Type                    string                    `json:"type"`
+	ASG                     *config.ASGHookConfig     `json:"asg,omitempty"`
+	ECS                     *config.ECSHookConfig     `json:"ecs,omitempty"`
+	ELB                     *config.ELBHookConfig     `json:"elb,omitempty"`
+	Webhook                 *config.WebhookHookConfig `json:"webhook,omitempty"`
+	MaxRetry                uint                      `json:"retries_allowed"`
+	TimeBetweenRetrySeconds uint                      `json:"seconds_between_retries"`
+	TimeoutSeconds          uint                      `json:"timeout_seconds"`
+	AlwaysRun               bool                      `json:"always_run"`
+	OnFailure               string                    `json:"on_failure,omitempty"`
+	RunIf                   []config.HookCondition    `json:"run_if,omitempty"`
+	RetryPolicy             *config.RetryPolicy       `json:"retry_policy,omitempty"`
+	retryPolicy             retryPolicy
+	native                  nativeHook
+	setupErr                error
 	bin                     string
 	args                    []string
 }
 
 func newFailureHook(cfg config.FailureHook) *failureHook {
-	return &failureHook{
+	fh := &failureHook{
 		Name:                    cfg.Name,
 		Description:             cfg.Description,
+		Type:                    cfg.Type,
+		ASG:                     cfg.ASG,
+		ECS:                     cfg.ECS,
+		ELB:                     cfg.ELB,
+		Webhook:                 redactWebhook(cfg.Webhook),
 		MaxRetry:                cfg.MaxRetry,
 		TimeBetweenRetrySeconds: cfg.WaitSecondsBetweenRetries,
+		TimeoutSeconds:          cfg.TimeoutSeconds,
+		AlwaysRun:               cfg.AlwaysRun,
+		OnFailure:               cfg.OnFailure,
+		RunIf:                   cfg.RunIf,
+		RetryPolicy:             cfg.RetryPolicy,
+		retryPolicy:             newRetryPolicy(cfg),
 		bin:                     cfg.Bin,
 		args:                    cfg.Args,
 	}
+	if fh.Type == "" {
+		fh.Type = config.HookTypeScript
+	}
+	switch fh.Type {
+	case config.HookTypeASGSetInstanceHealth, config.HookTypeASGCompleteLifecycleAction:
+		fh.native = newASGHook(cfg.Name, fh.Type, cfg.ASG)
+	case config.HookTypeECSDrain:
+		fh.native = newECSDrainHook(cfg.Name, cfg.ECS)
+	case config.HookTypeELBDeregister:
+		fh.native = newELBDeregisterHook(cfg.Name, cfg.ELB)
+	case config.HookTypeWebhook:
+		// A nil *webhookHook would not be a nil nativeHook.
+		if h, err := newWebhookHook(cfg.Name, cfg.Webhook); err != nil {
+			fh.setupErr = err
+		} else {
+			fh.native = h
+		}
+	}
+	return fh
+}
+
+// newAttempt sets up a single attempt at running the hook.
+func (fh *failureHook) newAttempt(input hookInput, timeout time.Duration) (hookAttempt, error) {
+	if fh.setupErr != nil {
+		return nil, fh.setupErr
+	}
+	if fh.native != nil {
+		return hookFunc(func() (int, error) {
+			return fh.native.run(input, timeout)
+		}), nil
+	}
+	p, err := newProcess(fh.Name, timeout, fh.bin, fh.args...)
+	if err != nil {
+		return nil, err
+	}
+	p.setEnvironment(input.environment())
+	p.setStdin(input.json())
+	return p, nil
+}
+
+// startHeartbeat starts any heartbeats the hook needs while the hooks before it run.
+// The returned function stops them. It is nil if the hook does not need heartbeats.
+func (fh *failureHook) startHeartbeat() func() {
+	if hb, ok := fh.native.(heartbeater); ok {
+		return hb.startHeartbeat()
+	}
+	return nil
+}
+
+// MarshalJSON adds the progress of native hooks that report it.
+func (fh *failureHook) MarshalJSON() ([]byte, error) {
+	type hook failureHook
+	out := struct {
+		*hook
+		Progress interface{} `json:"progress,omitempty"`
+	}{hook: (*hook)(fh)}
+	if reporter, ok := fh.native.(progressReporter); ok {
+		out.Progress = reporter.progress()
+	}
+	return json.Marshal(out)
+}
+
+// nativeHookContext limits a native hook to its timeout. Hooks without a timeout
+// use fallback, a fallback of 0 means no limit.
+func nativeHookContext(timeout, fallback time.Duration) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		timeout = fallback
+	}
+	if timeout == 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// nativeHookResult gives back the result of a native hook as if it were a process.
+// Errors are logged and exit with 1, running past the timeout exits with 124.
+func nativeHookResult(ctx context.Context, name string, input hookInput, err error) (int, error) {
+	if ctx.Err() == context.DeadlineExceeded {
+		return timeoutExitCode, errProcessTimeout
+	}
+	if err != nil {
+		logs.JSONLog(
+			"Built in failure hook failed",
+			logs.WARNING,
+			logs.JSONAttributes{
+				"error":             err.Error(),
+				"failure_hook_name": name,
+				"incident_id":       input.IncidentID,
+			},
+		)
+		return 1, nil
+	}
+	return 0, nil
+}
+
+var promFailureHookAttempts = metrics.NewPromCounter(
+	"failure_hook_attempts_total",
+	"Number of attempts to run a failure hook.",
+)
+
+var promFailureHookSkipped = metrics.NewPromCounter(
+	"failure_hooks_skipped_total",
+	"Number of failure hooks skipped by reason.",
+)
+
+func metricFailureHookSkipped(name, reason string) {
+	tags := metrics.Tags{"name": name, "reason": reason}
+	metrics.Incr("failure_hook_skipped", 1, tags)
+	promFailureHookSkipped.Add(1, tags)
 }
 
 func metricFailureHookRanProcess(name string, exitcode int) {
@@ -37,6 +206,7 @@ func metricFailureHookRanProcess(name string, exitcode int) {
 	if exitcode != 0 {
 		success = "false"
 	}
+	promFailureHookAttempts.Add(1, metrics.Tags{"successful": success, "name": name})
 	metrics.Incr(
 		"failure_hook_run",
 		1,
@@ -47,15 +217,75 @@ func metricFailureHookRanProcess(name string, exitcode int) {
 	)
 }
 
-func (fh *failureHook) run() {
+// run will run the hook until it succeeds or runs out of retries. A zero deadline
+// means the hook can take as long as it needs, otherwise no attempt can run past it.
+// The result says if the hook succeeded and how many attempts it took.
+func (fh *failureHook) run(fc FailureContext, deadline time.Time) (result HookResult) {
+	result = HookResult{
+		Name:      fh.Name,
+		Outcome:   config.HookOutcomeFailed,
+		Reason:    reasonRetriesExhausted,
+		ExitCode:  -1,
+		StartedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+	defer func() {
+		result.FinishedAt = time.Now().UTC().Format(time.RFC3339)
+		if detailer, ok := fh.native.(resultDetailer); ok {
+			detailer.addDetails(&result)
+		}
+	}()
+
 	var attempt uint
 	for attempt = 0; attempt <= fh.MaxRetry; attempt++ {
 		if attempt != 0 {
-			if fh.TimeBetweenRetrySeconds != 0 {
-				time.Sleep(time.Duration(fh.TimeBetweenRetrySeconds) * time.Second)
+			delay := fh.retryPolicy.delay(attempt)
+			if !deadline.IsZero() && delay >= time.Until(deadline) {
+				logs.JSONLog(
+					"Failure hook retry would be after the deadline, not retrying",
+					logs.WARNING,
+					logs.JSONAttributes{
+						"attempts":          attempt,
+						"delay_seconds":     delay.Seconds(),
+						"failure_hook_name": fh.Name,
+					},
+				)
+				result.Reason = reasonDeadlinePassed
+				return result
+			}
+			if delay > 0 {
+				logs.JSONLog(
+					"Waiting to retry failure hook",
+					logs.INFO,
+					logs.JSONAttributes{
+						"attempt":           attempt + 1,
+						"backoff":           fh.retryPolicy.backoff,
+						"delay_seconds":     delay.Seconds(),
+						"failure_hook_name": fh.Name,
+					},
+				)
+				time.Sleep(delay)
 			}
 		}
-		p, err := newProcess(fh.Name, fh.bin, fh.args...)
+		timeout := time.Duration(fh.TimeoutSeconds) * time.Second
+		if !deadline.IsZero() {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				logs.JSONLog(
+					"Failure hook deadline has passed, not retrying",
+					logs.WARNING,
+					logs.JSONAttributes{
+						"attempts":          attempt,
+						"failure_hook_name": fh.Name,
+					},
+				)
+				result.Reason = reasonDeadlinePassed
+				return result
+			}
+			if timeout == 0 || remaining < timeout {
+				timeout = remaining
+			}
+		}
+		p, err := fh.newAttempt(newHookInput(fc, fh.Name, attempt+1), timeout)
 		if err != nil {
 			logs.JSONLog(
 				"Failed to create failure hook process",
@@ -67,7 +297,25 @@ func (fh *failureHook) run() {
 			)
 			continue
 		}
+		result.Attempts++
 		exitcode, err := p.run()
+		result.ExitCode = exitcode
+		if err == errProcessTimeout {
+			logs.JSONLog(
+				"Failure hook process timed out",
+				logs.WARNING,
+				logs.JSONAttributes{
+					"timeout_seconds":   timeout.Seconds(),
+					"failure_hook_name": fh.Name,
+				},
+			)
+			metricFailureHookRanProcess(fh.Name, exitcode)
+			if !fh.retryable(exitcode) {
+				result.Reason = reasonNotRetryable
+				return result
+			}
+			continue
+		}
 		if err != nil {
 			logs.JSONLog(
 				"Failed to run failure hook process",
@@ -94,6 +342,10 @@ func (fh *failureHook) run() {
 		}
 		metricFailureHookRanProcess(fh.Name, exitcode)
 		if tryAgain {
+			if !fh.retryable(exitcode) {
+				result.Reason = reasonNotRetryable
+				return result
+			}
 			continue
 		}
 
@@ -104,6 +356,26 @@ func (fh *failureHook) run() {
 				"failure_hook_name": fh.Name,
 			},
 		)
-		break
+		result.Outcome = config.HookOutcomeSucceeded
+		result.Reason = ""
+		return result
+	}
+	return result
+}
+
+// retryable checks the exit code against the retry policy and logs if the hook
+// will not be retried because of it.
+func (fh *failureHook) retryable(exitcode int) bool {
+	if fh.retryPolicy.retryable(exitcode) {
+		return true
 	}
+	logs.JSONLog(
+		"Failure hook exit code is not retryable, giving up",
+		logs.WARNING,
+		logs.JSONAttributes{
+			"exitcode":          exitcode,
+			"failure_hook_name": fh.Name,
+		},
+	)
+	return false
 }
@@ -1,36 +1,294 @@
 package scriptengine
 
-import "github.com/morfien101/asg-healthcheck-agent/config"
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/morfien101/asg-healthcheck-agent/config"
+	"github.com/morfien101/asg-healthcheck-agent/logs"
+)
 
 // FailureHookEngineInterface describes how a FailureHookEngine will work
 type FailureHookEngineInterface interface {
-	RunHooks()
+	RunHooks(FailureContext) HookReport
+	LastReport() *HookReport
+	RestoreReport(HookReport)
+	Reload([]config.FailureHook)
+	CompletedHooks() []string
+	SetCompletedHooks([]string)
+	OnHookCompleted(func(name string))
+	SetDeadline(seconds uint)
 }
 
 // FailureHookEngine will run the failure hooks when required.
 type FailureHookEngine struct {
 	FailureHooks []*failureHook
+	// Hooks that have finished running, successfully or not.
+	// Completed hooks are not run again.
+	completed       []string
+	lastReport      *HookReport
+	completedLock   sync.RWMutex
+	onHookCompleted func(name string)
+	// How long all the hooks can take, 0 means no limit.
+	deadline time.Duration
+	// lock guards the hooks and settings. It is never held while hooks run,
+	// so a reload does not wait for the hooks to finish.
+	lock sync.RWMutex
+	// runLock stops the hooks being run more than once at the same time.
+	runLock sync.Mutex
 }
 
 // NewFailureHookEngine will populate a new failure hook engine
 // and return a pointer to it.
 func NewFailureHookEngine(cfg []config.FailureHook) *FailureHookEngine {
-	fhe := &FailureHookEngine{
-		FailureHooks: []*failureHook{},
-	}
-	for _, fhConfig := range cfg {
-		fhe.FailureHooks = append(fhe.FailureHooks, newFailureHook(fhConfig))
-	}
+	fhe := &FailureHookEngine{}
+	fhe.FailureHooks = newFailureHooks(cfg)
 
 	return fhe
 }
 
+func newFailureHooks(cfg []config.FailureHook) []*failureHook {
+	hooks := []*failureHook{}
+	for _, fhConfig := range cfg {
+		hooks = append(hooks, newFailureHook(fhConfig))
+	}
+	return hooks
+}
+
 // RunHooks will run each of the hooks in sequence.
 // Hooks will retry if failed and will not return errors.
 // The failure hooks are expected to be run as the last action in the chain
 // so dealing with errors besides logging is pointless.
-func (fhe *FailureHookEngine) RunHooks() {
-	for _, hook := range fhe.FailureHooks {
-		hook.run()
+// Hooks that have already completed are skipped, this allows a restarted agent to
+// carry on where it left off. Each hook is told why it is running with the failure context.
+// Once the deadline has passed the remaining hooks are skipped, unless they are marked
+// always_run. Hooks that fail can abort the chain or jump to a later hook, and hooks
+// with run_if conditions are skipped if an earlier hook did not have the expected outcome.
+// Hooks that complete a lifecycle action send heartbeats until it is their turn to run.
+// Skipped hooks count as completed. A report of what happened is returned and kept.
+func (fhe *FailureHookEngine) RunHooks(fc FailureContext) HookReport {
+	fhe.runLock.Lock()
+	defer fhe.runLock.Unlock()
+	// A reload while the hooks are running takes effect on the next run.
+	fhe.lock.RLock()
+	hooks := fhe.FailureHooks
+	deadlineDuration := fhe.deadline
+	fhe.lock.RUnlock()
+	var deadline time.Time
+	if deadlineDuration > 0 {
+		deadline = time.Now().Add(deadlineDuration)
 	}
+	previous := fhe.LastReport()
+	report := newHookReport(fc)
+	jumpTo := ""
+
+	// Hooks that complete a lifecycle action keep it alive while the hooks before them run.
+	heartbeats := map[string]func(){}
+	for _, hook := range hooks {
+		if fhe.isCompleted(hook.Name) {
+			continue
+		}
+		if stop := hook.startHeartbeat(); stop != nil {
+			heartbeats[hook.Name] = stop
+		}
+	}
+	defer func() {
+		for _, stop := range heartbeats {
+			stop()
+		}
+	}()
+
+	for _, hook := range hooks {
+		if stop, ok := heartbeats[hook.Name]; ok {
+			stop()
+			delete(heartbeats, hook.Name)
+		}
+		var result HookResult
+		alreadyCompleted := fhe.isCompleted(hook.Name)
+		switch {
+		case alreadyCompleted:
+			logs.JSONLog(
+				"Skipping failure hook, it has already completed",
+				logs.INFO,
+				logs.JSONAttributes{"failure_hook_name": hook.Name},
+			)
+			result = skippedHook(hook.Name, reasonAlreadyCompleted)
+			// Keep the outcome from before a restart so that policies and conditions still apply.
+			if previous != nil && previous.IncidentID == fc.IncidentID {
+				if r, ok := previous.result(hook.Name); ok {
+					result = r
+				}
+			}
+		case report.Aborted:
+			result = fhe.skipHook(hook.Name, reasonChainAborted, reasonChainAborted)
+		case jumpTo != "" && hook.Name != jumpTo:
+			result = fhe.skipHook(hook.Name, reasonJumpedOver, reasonJumpedOver)
+		case report.unmetCondition(hook.RunIf) != "":
+			result = fhe.skipHook(hook.Name, reasonRunIfNotMet, report.unmetCondition(hook.RunIf))
+		case hook.AlwaysRun:
+			// always_run hooks are not limited by the deadline.
+			result = hook.run(fc, time.Time{})
+		case !deadline.IsZero() && !time.Now().Before(deadline):
+			logs.JSONLog(
+				"Skipping failure hook, the failure hooks deadline has passed",
+				logs.WARNING,
+				logs.JSONAttributes{
+					"failure_hook_name": hook.Name,
+					"deadline_seconds":  deadlineDuration.Seconds(),
+				},
+			)
+			metricFailureHookSkipped(hook.Name, reasonDeadlinePassed)
+			result = skippedHook(hook.Name, reasonDeadlinePassed)
+		default:
+			result = hook.run(fc, deadline)
+		}
+		if hook.Name == jumpTo {
+			jumpTo = ""
+		}
+
+		if result.Outcome == config.HookOutcomeFailed {
+			if hook.OnFailure == config.OnFailureAbortChain {
+				report.Aborted = true
+				logs.JSONLog(
+					"Failure hook failed, aborting the rest of the chain",
+					logs.WARNING,
+					logs.JSONAttributes{"failure_hook_name": hook.Name},
+				)
+			} else if target, ok := jumpTarget(hook.OnFailure); ok {
+				jumpTo = target
+				logs.JSONLog(
+					"Failure hook failed, jumping to a later hook",
+					logs.WARNING,
+					logs.JSONAttributes{
+						"failure_hook_name": hook.Name,
+						"jump_to":           target,
+					},
+				)
+			}
+		}
+
+		report.Hooks = append(report.Hooks, result)
+		fhe.setLastReport(report)
+		if !alreadyCompleted {
+			fhe.markCompleted(hook.Name)
+		}
+	}
+	report.FinishedAt = time.Now().UTC().Format(time.RFC3339)
+	fhe.setLastReport(report)
+	return report
+}
+
+// skipHook logs and counts a hook that is skipped because of the chain policies.
+func (fhe *FailureHookEngine) skipHook(name, metricReason, reason string) HookResult {
+	logs.JSONLog(
+		"Skipping failure hook",
+		logs.WARNING,
+		logs.JSONAttributes{
+			"failure_hook_name": name,
+			"reason":            reason,
+		},
+	)
+	metricFailureHookSkipped(name, metricReason)
+	return skippedHook(name, reason)
+}
+
+// LastReport returns the report of the last time the hooks were run, or nil if they
+// have not been run. It is safe to call while the hooks are running and shows the
+// progress so far.
+func (fhe *FailureHookEngine) LastReport() *HookReport {
+	fhe.completedLock.RLock()
+	defer fhe.completedLock.RUnlock()
+	if fhe.lastReport == nil {
+		return nil
+	}
+	return fhe.lastReport.copy()
+}
+
+// RestoreReport sets the report from before a restart. The outcomes of completed hooks
+// are taken from it when the same incident is run again.
+func (fhe *FailureHookEngine) RestoreReport(report HookReport) {
+	fhe.setLastReport(report)
+}
+
+func (fhe *FailureHookEngine) setLastReport(report HookReport) {
+	fhe.completedLock.Lock()
+	defer fhe.completedLock.Unlock()
+	fhe.lastReport = report.copy()
+}
+
+// MarshalJSON adds the last report to the hooks.
+func (fhe *FailureHookEngine) MarshalJSON() ([]byte, error) {
+	fhe.lock.RLock()
+	hooks := fhe.FailureHooks
+	fhe.lock.RUnlock()
+	return json.Marshal(struct {
+		FailureHooks []*failureHook
+		LastReport   *HookReport `json:"last_report,omitempty"`
+	}{
+		FailureHooks: hooks,
+		LastReport:   fhe.LastReport(),
+	})
+}
+
+func (fhe *FailureHookEngine) isCompleted(name string) bool {
+	fhe.completedLock.RLock()
+	defer fhe.completedLock.RUnlock()
+	for _, completed := range fhe.completed {
+		if completed == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (fhe *FailureHookEngine) markCompleted(name string) {
+	fhe.completedLock.Lock()
+	fhe.completed = append(fhe.completed, name)
+	fhe.completedLock.Unlock()
+	fhe.lock.RLock()
+	onHookCompleted := fhe.onHookCompleted
+	fhe.lock.RUnlock()
+	if onHookCompleted != nil {
+		onHookCompleted(name)
+	}
+}
+
+// SetDeadline sets how long all of the hooks can take to run. 0 removes the deadline.
+// It takes effect the next time the hooks are run.
+func (fhe *FailureHookEngine) SetDeadline(seconds uint) {
+	fhe.lock.Lock()
+	defer fhe.lock.Unlock()
+	fhe.deadline = time.Duration(seconds) * time.Second
+}
+
+// CompletedHooks returns the names of the hooks that have finished running.
+// It is safe to call while the hooks are running.
+func (fhe *FailureHookEngine) CompletedHooks() []string {
+	fhe.completedLock.RLock()
+	defer fhe.completedLock.RUnlock()
+	return append([]string{}, fhe.completed...)
+}
+
+// SetCompletedHooks marks hooks as already completed so that they are not run again.
+func (fhe *FailureHookEngine) SetCompletedHooks(names []string) {
+	fhe.completedLock.Lock()
+	defer fhe.completedLock.Unlock()
+	fhe.completed = append([]string{}, names...)
+}
+
+// OnHookCompleted sets a function that is called each time a hook finishes running.
+func (fhe *FailureHookEngine) OnHookCompleted(f func(name string)) {
+	fhe.lock.Lock()
+	defer fhe.lock.Unlock()
+	fhe.onHookCompleted = f
+}
+
+// Reload replaces the failure hooks with the new configuration.
+// If the hooks are currently running, they carry on with the old hooks and
+// the new hooks are used the next time they are run.
+func (fhe *FailureHookEngine) Reload(cfg []config.FailureHook) {
+	fhe.lock.Lock()
+	defer fhe.lock.Unlock()
+	fhe.FailureHooks = newFailureHooks(cfg)
 }
@@ -1,7 +1,12 @@
 package scriptengine
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/morfien101/asg-healthcheck-agent/config"
 )
@@ -25,5 +30,119 @@ func TestFailureHookEngine(t *testing.T) {
 	}
 	fhe := NewFailureHookEngine(cfg)
 
-	fhe.RunHooks()
+	fhe.RunHooks(NewFailureContext(ReasonStableFailure))
+}
+
+func TestFailureHookEngineReloadWhileRunning(t *testing.T) {
+	fhe := NewFailureHookEngine([]config.FailureHook{
+		{Name: "drain", Bin: "/bin/sh", Args: []string{"-c", "sleep 2"}},
+	})
+	done := make(chan HookReport, 1)
+	go func() { done <- fhe.RunHooks(NewFailureContext(ReasonStableFailure)) }()
+	// Give the hook time to start.
+	time.Sleep(200 * time.Millisecond)
+
+	start := time.Now()
+	fhe.Reload([]config.FailureHook{{Name: "alert", Bin: "/bin/true"}})
+	fhe.SetDeadline(60)
+	if _, err := json.Marshal(fhe); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("Expected the reload not to wait for the running hooks, took %s", took)
+	}
+
+	report := <-done
+	if len(report.Hooks) != 1 || report.Hooks[0].Name != "drain" {
+		t.Errorf("Expected the running hooks to finish with the old configuration, got %+v", report.Hooks)
+	}
+	if report = fhe.RunHooks(NewFailureContext(ReasonStableFailure)); len(report.Hooks) != 1 || report.Hooks[0].Name != "alert" {
+		t.Errorf("Expected the next run to use the new configuration, got %+v", report.Hooks)
+	}
+}
+
+func TestFailureHookDeadline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "failurehooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hookLog := filepath.Join(dir, "hooks.log")
+	record := func(name string) []string {
+		return []string{"-c", "echo " + name + " >> " + hookLog}
+	}
+
+	fhe := NewFailureHookEngine([]config.FailureHook{
+		{Name: "hangs", Bin: "/bin/sh", Args: []string{"-c", "sleep 30"}, MaxRetry: 3},
+		{Name: "skipped", Bin: "/bin/sh", Args: record("skipped")},
+		{Name: "complete_lifecycle", Bin: "/bin/sh", Args: record("complete_lifecycle"), AlwaysRun: true},
+	})
+	fhe.SetDeadline(1)
+
+	start := time.Now()
+	fhe.RunHooks(NewFailureContext(ReasonStableFailure))
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("Expected the deadline to stop the hooks, took %s", took)
+	}
+
+	b, err := ioutil.ReadFile(hookLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "complete_lifecycle\n" {
+		t.Errorf("Expected only the always_run hook to run after the deadline, got %q", string(b))
+	}
+	if completed := fhe.CompletedHooks(); len(completed) != 3 {
+		t.Errorf("Expected all hooks to be completed, got %v", completed)
+	}
+}
+
+func TestFailureHookChainPolicies(t *testing.T) {
+	exit := func(code string) []string { return []string{"-c", "exit " + code} }
+	fhe := NewFailureHookEngine([]config.FailureHook{
+		{Name: "drain", Bin: "/bin/sh", Args: exit("1"), OnFailure: "jump_to:notify"},
+		{Name: "jumped", Bin: "/bin/sh", Args: exit("0")},
+		{Name: "notify", Bin: "/bin/sh", Args: exit("0")},
+		{
+			Name:  "only_if_drained",
+			Bin:   "/bin/sh",
+			Args:  exit("0"),
+			RunIf: []config.HookCondition{{Hook: "drain", Outcome: config.HookOutcomeSucceeded}},
+		},
+		{Name: "critical", Bin: "/bin/sh", Args: exit("1"), OnFailure: config.OnFailureAbortChain},
+		{Name: "complete_lifecycle", Bin: "/bin/sh", Args: exit("0"), AlwaysRun: true},
+	})
+
+	fc := NewFailureContext(ReasonStableFailure)
+	report := fhe.RunHooks(fc)
+
+	expected := []struct{ outcome, reason string }{
+		{config.HookOutcomeFailed, reasonRetriesExhausted},
+		{config.HookOutcomeSkipped, reasonJumpedOver},
+		{config.HookOutcomeSucceeded, ""},
+		{config.HookOutcomeSkipped, "run_if_not_met: drain was failed, not succeeded"},
+		{config.HookOutcomeFailed, reasonRetriesExhausted},
+		{config.HookOutcomeSkipped, reasonChainAborted},
+	}
+	if len(report.Hooks) != len(expected) {
+		t.Fatalf("Expected %d results, got %+v", len(expected), report.Hooks)
+	}
+	for i, e := range expected {
+		result := report.Hooks[i]
+		if result.Outcome != e.outcome || result.Reason != e.reason {
+			t.Errorf("%s: expected %s (%s), got %s (%s)", result.Name, e.outcome, e.reason, result.Outcome, result.Reason)
+		}
+	}
+	if !report.Aborted || report.IncidentID != fc.IncidentID {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	if last := fhe.LastReport(); last == nil || len(last.Hooks) != len(expected) {
+		t.Errorf("Expected the report to be kept, got %+v", last)
+	}
+
+	// Running the same incident again keeps the outcomes, so the chain is still aborted.
+	report = fhe.RunHooks(fc)
+	if !report.Aborted || report.Hooks[0].Outcome != config.HookOutcomeFailed {
+		t.Errorf("Expected the outcomes to be kept for the same incident, got %+v", report)
+	}
 }
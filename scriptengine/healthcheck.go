@@ -1,6 +1,8 @@
 package scriptengine
 
 import (
+	"encoding/json"
+	"fmt"
 	"sync"
 	"time"
 
@@ -14,48 +16,191 @@ type HealthCheckInternface interface {
 	Stop()
 }
 
+// Outcomes of the last run of a check.
+const (
+	outcomeNever   = "never"
+	outcomeSuccess = "success"
+	outcomeFailure = "failure"
+	outcomeTimeout = "timeout"
+	outcomeError   = "error"
+	// The check was not run because a check it depends on is failing.
+	outcomeSkippedDependencyFailed = "skipped_dependency_failed"
+)
+
+// stateSkipped is the last state of a check that is skipped, so an old
+// warning is not reported as current.
+const stateSkipped = "skipped"
+
+func outcomeFor(exitcode int, err error) string {
+	switch {
+	case err == errProcessTimeout:
+		return outcomeTimeout
+	case err != nil:
+		return outcomeError
+	case exitcode != 0:
+		return outcomeFailure
+	}
+	return outcomeSuccess
+}
+
+// checkRunner is a single run of a health check. The result is given back
+// as an exit code, regardless of the type of check. tail gives back the
+// output of the last run, which is passed on to the hooks.
+type checkRunner interface {
+	run() (exitcode int, err error)
+	tail() []string
+}
+
 // HealthCheck is a single health check.
 // It is used to run the checks on the servers.
 type HealthCheck struct {
-	Name                     string `json:"name"`
-	Description              string `json:"description"`
-	LastExitCode             int    `json:"last_exit_code"`
-	LastRuntime              string `json:"last_run_time"`
-	TotalFailureCount        uint   `json:"failure_count"`
-	RecoveryAttempt          uint   `json:"recovery_attempt"`
-	FailureSinceLastRecovery uint   `json:"failures_since_last_recovery"`
-	FreqSeconds              uint   `json:"frequency_seconds"`
-	AllowedFailures          uint   `json:"allowed_failures"`
-	RecoveriesRequired       uint   `json:"recovery_count_required"`
-	GraceMode                bool   `json:"grace_mode"`
+	Name                     string       `json:"name"`
+	Description              string       `json:"description"`
+	Type                     string       `json:"type"`
+	LastExitCode             int          `json:"last_exit_code"`
+	LastRuntime              string       `json:"last_run_time"`
+	LastOutcome              string       `json:"last_outcome"`
+	LastState                string       `json:"last_state"`
+	StatusText               string       `json:"status_text,omitempty"`
+	TotalFailureCount        uint         `json:"failure_count"`
+	RecoveryAttempt          uint         `json:"recovery_attempt"`
+	FailureSinceLastRecovery uint         `json:"failures_since_last_recovery"`
+	FreqSeconds              uint         `json:"frequency_seconds"`
+	AllowedFailures          uint         `json:"allowed_failures"`
+	RecoveriesRequired       uint         `json:"recovery_count_required"`
+	TimeoutSeconds           uint         `json:"timeout_seconds"`
+	GraceMode                bool         `json:"grace_mode"`
+	Remediation              *remediation `json:"remediation,omitempty"`
+	DependsOn                []string     `json:"depends_on,omitempty"`
+	FailedDependency         string       `json:"failed_dependency,omitempty"`
 	failureCounter           uint
+	stableFailurePublished   bool
 	stdErr                   chan string
 	stdout                   chan string
 	bin                      string
 	args                     []string
+	outputMode               string
+	lastOutput               []string
+	httpCheck                *httpCheck
+	socketCheck              *socketCheck
+	setupErr                 error
+	exitCodeStates           exitCodeStates
+	config                   config.HealthCheck
+	failingCheck             func(names []string) string
 	runChecks                chan struct{}
 	failedChan               chan<- string
+	recoveredChan            chan<- string
 	running                  bool
 	lock                     sync.RWMutex
 }
 
-func newHealthCheck(publishFailuresOn chan<- string, cfg config.HealthCheck) *HealthCheck {
-	return &HealthCheck{
+func newHealthCheck(publishFailuresOn, publishRecoveriesOn chan<- string, cfg config.HealthCheck) *HealthCheck {
+	hc := &HealthCheck{
 		Name:               cfg.Name,
 		Description:        cfg.Description,
+		Type:               cfg.Type,
 		GraceMode:          true,
 		LastExitCode:       -1,
 		LastRuntime:        "never",
+		LastOutcome:        outcomeNever,
+		LastState:          outcomeNever,
 		FreqSeconds:        cfg.FreqSeconds,
 		AllowedFailures:    cfg.AllowedFailures,
 		RecoveriesRequired: cfg.RecoverySuccessCount,
+		TimeoutSeconds:     cfg.TimeoutSeconds,
 		bin:                cfg.Bin,
 		args:               cfg.Args,
 		stdErr:             make(chan string, 10),
 		stdout:             make(chan string, 10),
 		runChecks:          make(chan struct{}, 1),
 		failedChan:         publishFailuresOn,
+		recoveredChan:      publishRecoveriesOn,
+		outputMode:         cfg.OutputMode,
+		Remediation:        newRemediation(cfg.Remediation),
+		DependsOn:          cfg.DependsOn,
+		config:             cfg,
+		exitCodeStates:     newExitCodeStates(cfg.ExitCodeStates, cfg.OutputMode == config.OutputModeNagios),
+	}
+	if hc.Type == "" {
+		hc.Type = config.CheckTypeScript
+	}
+	switch hc.Type {
+	case config.CheckTypeHTTP:
+		hc.httpCheck, hc.setupErr = newHTTPCheck(cfg.Name, cfg.HTTP, cfg.TimeoutSeconds)
+	case config.CheckTypeTCP, config.CheckTypeUnix:
+		hc.socketCheck, hc.setupErr = newSocketCheck(cfg.Name, hc.Type, cfg.Socket, cfg.TimeoutSeconds)
+	}
+	hc.updatePromMetrics()
+
+	return hc
+}
+
+// newRunner returns something that can run the check once.
+// Scripts need a new process for every run, native checks are reused.
+func (hc *HealthCheck) newRunner() (checkRunner, error) {
+	if hc.setupErr != nil {
+		return nil, hc.setupErr
+	}
+	switch hc.Type {
+	case config.CheckTypeHTTP:
+		return hc.httpCheck, nil
+	case config.CheckTypeTCP, config.CheckTypeUnix:
+		return hc.socketCheck, nil
+	case config.CheckTypeScript, "":
+		p, err := newProcess(hc.Name, time.Duration(hc.TimeoutSeconds)*time.Second, hc.bin, hc.args...)
+		if err != nil {
+			return nil, err
+		}
+		// Nagios output is parsed after the run rather than logged.
+		p.logStdout = hc.outputMode != config.OutputModeNagios
+		return p, nil
+	}
+	return nil, fmt.Errorf("unknown health check type %s", hc.Type)
+}
+
+var (
+	promCheckLastExitCode = metrics.NewPromGauge(
+		"healthcheck_last_exit_code",
+		"Exit code of the last run of the health check.",
+	)
+	promCheckFailures = metrics.NewPromGauge(
+		"healthcheck_consecutive_failures",
+		"Failures since the health check last recovered.",
+	)
+	promCheckRecoveryAttempts = metrics.NewPromGauge(
+		"healthcheck_recovery_attempts",
+		"Successful runs counted towards the recovery of a failing health check.",
+	)
+	promCheckGraceMode = metrics.NewPromGauge(
+		"healthcheck_grace_mode",
+		"1 if failures of the health check are currently ignored.",
+	)
+	promCheckState = metrics.NewPromGauge(
+		"healthcheck_state",
+		"State of the last run of the health check. 0 ok, 1 warning, 2 critical, 3 unknown.",
+	)
+	promCheckWarnings = metrics.NewPromCounter(
+		"healthcheck_warnings_total",
+		"Number of health check runs that ended in a warning or unknown state.",
+	)
+	promCheckRuns = metrics.NewPromCounter(
+		"healthcheck_runs_total",
+		"Number of health check runs by outcome.",
+	)
+	promCheckDuration = metrics.NewPromHistogram(
+		"healthcheck_duration_seconds",
+		"Time taken to run the health check.",
+		metrics.DefaultDurationBuckets,
+	)
+)
+
+func metricHealthcheckDegraded(name, state string) {
+	tags := metrics.Tags{
+		"name":  name,
+		"state": state,
 	}
+	metrics.Incr("healthcheck_warning", 1, tags)
+	promCheckWarnings.Add(1, tags)
 }
 
 func metricHealthcheckRanProcess(name string, exitcode int) {
@@ -76,7 +221,9 @@ func metricHealthcheckRanProcess(name string, exitcode int) {
 // Start will instruct the health check to run on the schedules given
 func (hc *HealthCheck) Start() {
 	ticker := time.NewTicker(time.Duration(hc.FreqSeconds) * time.Second)
+	hc.lock.Lock()
 	hc.running = true
+	hc.lock.Unlock()
 	go func() {
 		for {
 			select {
@@ -88,62 +235,302 @@ func (hc *HealthCheck) Start() {
 					return
 				}
 			case <-ticker.C:
-				// Do a check here.
-				logs.JSONLog(
-					"Attempting to run healthcheck",
-					logs.DEBUG,
-					logs.JSONAttributes{
-						"healthcheck_name": hc.Name,
-					},
-				)
-
-				check, err := newProcess(hc.Name, hc.bin, hc.args...)
-				if err != nil {
-					logs.JSONLog(
-						"failed to create process",
-						logs.ERROR,
-						logs.JSONAttributes{
-							"healthcheck_name": hc.Name,
-							"error":            err.Error(),
-						},
-					)
-					hc.LastExitCode = 1
-					continue
-				}
-				exitcode, err := check.run()
-				if err != nil {
-					logs.JSONLog(
-						"failed to run process",
-						logs.ERROR,
-						logs.JSONAttributes{
-							"healthcheck_name": hc.Name,
-							"error":            err.Error(),
-						},
-					)
-					hc.LastExitCode = 1
-					return
-				}
-				hc.LastExitCode = exitcode
-				hc.LastRuntime = time.Now().Format("Mon Jan 2 15:04:05 -0700 MST 2006")
-				if !hc.GraceMode {
-					hc.determineFailure()
-					metricHealthcheckRanProcess(hc.Name, hc.LastExitCode)
-				}
+				hc.runCheck()
 			}
 		}
 	}()
 }
 
+// runCheck does a single run of the check and records the result.
+// A check that can not be run counts as a critical failure, so the
+// agent does not keep reporting the last good state.
+func (hc *HealthCheck) runCheck() {
+	if hc.skipForDependency() {
+		return
+	}
+	logs.JSONLog(
+		"Attempting to run healthcheck",
+		logs.DEBUG,
+		logs.JSONAttributes{
+			"healthcheck_name": hc.Name,
+		},
+	)
+
+	started := time.Now()
+	exitcode := 1
+	check, err := hc.newRunner()
+	if err != nil {
+		logs.JSONLog(
+			"failed to create process",
+			logs.ERROR,
+			logs.JSONAttributes{
+				"healthcheck_name": hc.Name,
+				"error":            err.Error(),
+			},
+		)
+	} else {
+		exitcode, err = check.run()
+		if err == errProcessTimeout {
+			logs.JSONLog(
+				"healthcheck timed out",
+				logs.WARNING,
+				logs.JSONAttributes{
+					"healthcheck_name": hc.Name,
+					"timeout_seconds":  hc.TimeoutSeconds,
+				},
+			)
+			metrics.Incr("healthcheck_timeout", 1, metrics.Tags{"name": hc.Name})
+		} else if err != nil {
+			logs.JSONLog(
+				"failed to run process",
+				logs.ERROR,
+				logs.JSONAttributes{
+					"healthcheck_name": hc.Name,
+					"error":            err.Error(),
+				},
+			)
+			exitcode = 1
+		}
+	}
+	outcome := outcomeFor(exitcode, err)
+	state := hc.exitCodeStates.state(exitcode)
+	output := []string{}
+	switch {
+	case outcome == outcomeError:
+		state = config.StateCritical
+		output = []string{err.Error()}
+	case check != nil:
+		output = check.tail()
+	}
+
+	// The results are written under the lock as _status, metrics and the
+	// state manager read them from other go routines.
+	hc.lock.Lock()
+	hc.LastExitCode = exitcode
+	hc.LastOutcome = outcome
+	hc.LastState = state
+	hc.lastOutput = output
+	hc.LastRuntime = time.Now().Format("Mon Jan 2 15:04:05 -0700 MST 2006")
+	graceMode := hc.GraceMode
+	hc.lock.Unlock()
+
+	if p, ok := check.(*Process); ok {
+		if hc.outputMode == config.OutputModeNagios {
+			hc.recordNagiosOutput(parseNagiosOutput(p.output()))
+		}
+	}
+	if !graceMode {
+		hc.determineFailure()
+		metricHealthcheckRanProcess(hc.Name, exitcode)
+		if degradedState(state) {
+			metricHealthcheckDegraded(hc.Name, state)
+		}
+	}
+	promCheckRuns.Add(1, metrics.Tags{"name": hc.Name, "outcome": outcome})
+	promCheckDuration.Observe(time.Since(started).Seconds(), metrics.Tags{"name": hc.Name})
+	hc.updatePromMetrics()
+}
+
+// skipForDependency tells the caller to skip this run of the check because a
+// check that it depends on is failing. The failure and recovery counters are
+// left alone while the check is skipped, but the result of the last run is cleared.
+func (hc *HealthCheck) skipForDependency() bool {
+	dependency := ""
+	if len(hc.DependsOn) > 0 && hc.failingCheck != nil {
+		dependency = hc.failingCheck(hc.DependsOn)
+	}
+	hc.lock.Lock()
+	changed := dependency != hc.FailedDependency
+	hc.FailedDependency = dependency
+	if dependency != "" {
+		hc.LastOutcome = outcomeSkippedDependencyFailed
+		hc.LastState = stateSkipped
+		hc.LastExitCode = -1
+		hc.StatusText = ""
+		hc.lastOutput = []string{}
+	}
+	hc.lock.Unlock()
+	if changed {
+		if dependency == "" {
+			logs.JSONLog(
+				"Resuming healthcheck, its dependencies are no longer failing",
+				logs.INFO,
+				logs.JSONAttributes{"healthcheck_name": hc.Name},
+			)
+		} else {
+			logs.JSONLog(
+				"Skipping healthcheck while a dependency is failing",
+				logs.INFO,
+				logs.JSONAttributes{
+					"healthcheck_name": hc.Name,
+					"dependency":       dependency,
+				},
+			)
+		}
+	}
+	if dependency == "" {
+		return false
+	}
+	metrics.Incr("healthcheck_skipped", 1, metrics.Tags{"name": hc.Name, "dependency": dependency})
+	promCheckRuns.Add(1, metrics.Tags{"name": hc.Name, "outcome": outcomeSkippedDependencyFailed})
+	promCheckState.Delete(metrics.Tags{"name": hc.Name})
+	hc.updatePromMetrics()
+	return true
+}
+
+func (hc *HealthCheck) setGraceMode(action bool) {
+	hc.lock.Lock()
+	hc.GraceMode = action
+	hc.lock.Unlock()
+	hc.updatePromMetrics()
+}
+
+// deletePromMetrics removes the Prometheus series for a check that no longer exists.
+func (hc *HealthCheck) deletePromMetrics() {
+	tags := metrics.Tags{"name": hc.Name}
+	promCheckLastExitCode.Delete(tags)
+	promCheckFailures.Delete(tags)
+	promCheckRecoveryAttempts.Delete(tags)
+	promCheckGraceMode.Delete(tags)
+	promCheckState.Delete(tags)
+	promCheckPerfData.DeleteMatching(tags)
+}
+
+// updatePromMetrics sets the Prometheus gauges that describe the state of the check.
+// The caller must not hold the lock.
+func (hc *HealthCheck) updatePromMetrics() {
+	tags := metrics.Tags{"name": hc.Name}
+	hc.lock.RLock()
+	graceMode := 0.0
+	if hc.GraceMode {
+		graceMode = 1
+	}
+	counters := hc.countersLocked()
+	lastState := hc.LastState
+	hc.lock.RUnlock()
+	promCheckLastExitCode.Set(float64(counters.LastExitCode), tags)
+	promCheckFailures.Set(float64(counters.FailureSinceLastRecovery), tags)
+	promCheckRecoveryAttempts.Set(float64(counters.RecoveryAttempt), tags)
+	promCheckGraceMode.Set(graceMode, tags)
+	for value, state := range nagiosStates {
+		if lastState == state {
+			promCheckState.Set(float64(value), tags)
+		}
+	}
+}
+
+// MarshalJSON holds the lock while the state of the check is read, as the
+// check updates it from its own go routine.
+func (hc *HealthCheck) MarshalJSON() ([]byte, error) {
+	type healthCheck HealthCheck
+	hc.lock.RLock()
+	defer hc.lock.RUnlock()
+	return json.Marshal((*healthCheck)(hc))
+}
+
+// status returns the failure state of the check.
+func (hc *HealthCheck) status() CheckStatus {
+	hc.lock.RLock()
+	defer hc.lock.RUnlock()
+	return CheckStatus{
+		Failing:       hc.FailureSinceLastRecovery > 0,
+		StableFailure: hc.FailureSinceLastRecovery > hc.AllowedFailures,
+	}
+}
+
+// degraded tells the caller if the last run of the check was a warning or unknown.
+// Checks in grace mode are not considered.
+func (hc *HealthCheck) degraded() bool {
+	hc.lock.RLock()
+	defer hc.lock.RUnlock()
+	return !hc.GraceMode && degradedState(hc.LastState)
+}
+
+// counters returns the counters of the check.
+func (hc *HealthCheck) counters() CheckCounters {
+	hc.lock.RLock()
+	defer hc.lock.RUnlock()
+	return hc.countersLocked()
+}
+
+// countersLocked returns the counters of the check. The caller must hold the lock.
+func (hc *HealthCheck) countersLocked() CheckCounters {
+	return CheckCounters{
+		LastExitCode:             hc.LastExitCode,
+		TotalFailureCount:        hc.TotalFailureCount,
+		RecoveryAttempt:          hc.RecoveryAttempt,
+		FailureSinceLastRecovery: hc.FailureSinceLastRecovery,
+	}
+}
+
+// restoreCounters sets the counters of the check. A check that was past its
+// allowed failures has already published its stable failure, so it is not
+// published again until the check recovers.
+func (hc *HealthCheck) restoreCounters(c CheckCounters) {
+	hc.lock.Lock()
+	hc.LastExitCode = c.LastExitCode
+	hc.TotalFailureCount = c.TotalFailureCount
+	hc.RecoveryAttempt = c.RecoveryAttempt
+	hc.FailureSinceLastRecovery = c.FailureSinceLastRecovery
+	hc.stableFailurePublished = c.FailureSinceLastRecovery > hc.AllowedFailures
+	hc.lock.Unlock()
+	hc.updatePromMetrics()
+}
+
+// describeFailure adds the details of the check to the failure context.
+func (hc *HealthCheck) describeFailure(fc FailureContext) FailureContext {
+	hc.lock.RLock()
+	defer hc.lock.RUnlock()
+	fc.CheckName = hc.Name
+	fc.LastExitCode = hc.LastExitCode
+	fc.LastState = hc.LastState
+	fc.LastRunTime = hc.LastRuntime
+	fc.OutputTail = append([]string{}, hc.lastOutput...)
+	fc.FailureCount = hc.TotalFailureCount
+	fc.FailuresSinceLastRecovery = hc.FailureSinceLastRecovery
+	fc.AllowedFailures = hc.AllowedFailures
+	return fc
+}
+
+// determineFailure counts the result of the last run. Remediation and the
+// stable failures and recoveries are sent on once the lock is released.
 func (hc *HealthCheck) determineFailure() {
-	// Was the last check a failure
-	if hc.LastExitCode != 0 {
+	remediate, failed, recovered := hc.countResult()
+	if remediate {
+		hc.Remediation.start(hc.Name)
+	}
+	if failed {
+		hc.failedChan <- hc.Name
+	}
+	if recovered && hc.recoveredChan != nil {
+		hc.recoveredChan <- hc.Name
+	}
+}
+
+// countResult updates the failure and recovery counters with the result of the last run.
+// It tells the caller if remediation is due and if a stable failure or recovery needs sending.
+func (hc *HealthCheck) countResult() (remediate, failed, recovered bool) {
+	hc.lock.Lock()
+	defer hc.lock.Unlock()
+	// Was the last check a failure. Only critical states count as failures,
+	// warnings are reported but count as a success here. A check that could
+	// not be run is a failure whatever its exit code maps to.
+	if hc.LastOutcome == outcomeError || hc.exitCodeStates.state(hc.LastExitCode) == config.StateCritical {
 		hc.TotalFailureCount++
 		hc.FailureSinceLastRecovery++
 
+		// Try to fix the check before it becomes a stable failure. The threshold
+		// is never above allowed failures, so the check runs again before a
+		// stable failure can be published.
+		remediate = hc.Remediation.due(hc.FailureSinceLastRecovery)
+
 		// Is the failure count now higher than allowed failures?
-		if hc.FailureSinceLastRecovery > hc.AllowedFailures {
+		// The stable failure is only published once until the check recovers,
+		// as checks keep running after a stable failure when the agent is recoverable.
+		if hc.FailureSinceLastRecovery > hc.AllowedFailures && !hc.stableFailurePublished {
 			// If so consider this a stable failure
-			hc.failedChan <- hc.Name
+			hc.stableFailurePublished = true
+			failed = true
 		}
 		// A failure will reset the recovery back to 0 to stop flapping checks.
 		// Checks should be stable and if they flap its just as bad as failures.
@@ -151,7 +538,7 @@ func (hc *HealthCheck) determineFailure() {
 			hc.RecoveryAttempt = 0
 		}
 
-		return
+		return remediate, failed, false
 	}
 
 	// If the failure count is higher than zero, we need to see if we need to reset it as a
@@ -163,8 +550,11 @@ func (hc *HealthCheck) determineFailure() {
 			// reset counters and move on.
 			hc.FailureSinceLastRecovery = 0
 			hc.RecoveryAttempt = 0
+			hc.stableFailurePublished = false
+			recovered = true
 		}
 	}
+	return false, false, recovered
 }
 
 // Stop will instruct the health check to stop running on the interval.
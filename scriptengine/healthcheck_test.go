@@ -3,6 +3,8 @@ package scriptengine
 import (
 	"testing"
 	"time"
+
+	"github.com/morfien101/asg-healthcheck-agent/config"
 )
 
 // Test to see if a failure with no recovery works
@@ -123,3 +125,124 @@ func TestBashOnHealthCheck(t *testing.T) {
 	}()
 	<-dead
 }
+
+func TestExitCodeStates(t *testing.T) {
+	binary := newExitCodeStates(nil, false)
+	mapped := newExitCodeStates(map[string]string{"4": "warning", "2": "unknown"}, false)
+	warning := newExitCodeStates(map[string]string{"4": "warning"}, false)
+	nagiosMode := newExitCodeStates(nil, true)
+	nagiosMapped := newExitCodeStates(map[string]string{"4": "warning"}, true)
+	empty := newExitCodeStates(map[string]string{}, false)
+
+	tests := []struct {
+		states   exitCodeStates
+		exitcode int
+		expected string
+	}{
+		{binary, 0, "ok"},
+		{binary, 1, "critical"},
+		{binary, 3, "critical"},
+		{mapped, 0, "ok"},
+		{mapped, 1, "critical"},
+		{mapped, 2, "unknown"},
+		{mapped, 3, "critical"},
+		{mapped, 4, "warning"},
+		{mapped, 124, "critical"},
+		// Mapping one code leaves the others alone, so 1 is still a failure.
+		{warning, 0, "ok"},
+		{warning, 1, "critical"},
+		{warning, 4, "warning"},
+		{nagiosMode, 1, "warning"},
+		{nagiosMode, 2, "critical"},
+		{nagiosMode, 3, "unknown"},
+		{nagiosMapped, 1, "warning"},
+		{nagiosMapped, 4, "warning"},
+		{nagiosMapped, 124, "critical"},
+		{empty, 0, "ok"},
+		{empty, 1, "critical"},
+	}
+	for _, test := range tests {
+		if got := test.states.state(test.exitcode); got != test.expected {
+			t.Errorf("Exit code %d: expected %s, got %s", test.exitcode, test.expected, got)
+		}
+	}
+}
+
+func TestWarningOnHealthCheck(t *testing.T) {
+	failchan := make(chan string, 1)
+	hc := HealthCheck{
+		LastExitCode:    1,
+		AllowedFailures: 0,
+		failedChan:      failchan,
+		exitCodeStates:  newExitCodeStates(nil, true),
+	}
+
+	hc.determineFailure()
+
+	select {
+	case b := <-failchan:
+		t.Errorf("Got a %s on failure channel, warnings should not fail", b)
+	default:
+	}
+	if hc.FailureSinceLastRecovery != 0 {
+		t.Error("Warnings should not count as failures")
+	}
+
+	hc.LastExitCode = 2
+	hc.determineFailure()
+	select {
+	case <-failchan:
+	default:
+		t.Error("Expected a critical state to cause a stable failure")
+	}
+}
+
+func TestStableFailurePublishedOnce(t *testing.T) {
+	failchan := make(chan string, 3)
+	recoverchan := make(chan string, 1)
+	hc := HealthCheck{
+		LastExitCode:       1,
+		AllowedFailures:    0,
+		RecoveriesRequired: 1,
+		failedChan:         failchan,
+		recoveredChan:      recoverchan,
+	}
+	hc.determineFailure()
+	hc.determineFailure()
+	hc.determineFailure()
+	if len(failchan) != 1 {
+		t.Errorf("Expected one stable failure until the check recovers, got %d", len(failchan))
+	}
+
+	hc.LastExitCode = 0
+	hc.determineFailure()
+	hc.LastExitCode = 1
+	hc.determineFailure()
+	if len(failchan) != 2 {
+		t.Errorf("Expected a new stable failure after the recovery, got %d", len(failchan))
+	}
+}
+
+func TestErrorOnHealthCheck(t *testing.T) {
+	failchan := make(chan string, 1)
+	hc := newHealthCheck(failchan, nil, config.HealthCheck{
+		Name:           "missing",
+		Bin:            "/does/not/exist",
+		FreqSeconds:    1,
+		ExitCodeStates: map[string]string{"1": "ok"},
+	})
+	hc.setGraceMode(false)
+
+	// The check keeps running and the errors count as failures.
+	hc.runCheck()
+	hc.runCheck()
+	if hc.LastOutcome != outcomeError || hc.LastState != config.StateCritical || hc.FailureSinceLastRecovery != 2 {
+		t.Errorf("Expected the error to count as a critical failure, got %s %s %d",
+			hc.LastOutcome, hc.LastState, hc.FailureSinceLastRecovery)
+	}
+	select {
+	case <-failchan:
+	default:
+		t.Error("Expected the error to cause a stable failure")
+	}
+}
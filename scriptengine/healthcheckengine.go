@@ -1,61 +1,165 @@
 package scriptengine
 
 import (
+	"encoding/json"
+	"reflect"
+	"sync"
+
 	"github.com/morfien101/asg-healthcheck-agent/config"
 )
 
 type HealthCheckEngineInterface interface {
-	Start(chan<- string)
+	Start(failures, recoveries chan<- string)
 	SetGraceMode(bool)
 	Stop()
+	Reload([]config.HealthCheck) ReloadSummary
+	Counters() map[string]CheckCounters
+	RestoreCounters(map[string]CheckCounters)
+	Degraded() bool
+	CheckStatuses() map[string]CheckStatus
+	DescribeFailure(checkName string, fc FailureContext) FailureContext
+	RootCause(checkName string) string
+}
+
+// CheckCounters are the values of a health check that need to survive a restart.
+type CheckCounters struct {
+	LastExitCode             int  `json:"last_exit_code"`
+	TotalFailureCount        uint `json:"failure_count"`
+	RecoveryAttempt          uint `json:"recovery_attempt"`
+	FailureSinceLastRecovery uint `json:"failures_since_last_recovery"`
+}
+
+// CheckStatus tells the StateManager if a health check is failing.
+type CheckStatus struct {
+	// Failing is true while the check has failures that it has not yet
+	// recovered from, by meeting its recovery_success_count.
+	Failing bool
+	// StableFailure is true while the check has failed more than its allowed
+	// failures and has not yet recovered.
+	StableFailure bool
+}
+
+// ReloadSummary lists the names of the health checks affected by a reload.
+type ReloadSummary struct {
+	Added     []string `json:"added"`
+	Removed   []string `json:"removed"`
+	Replaced  []string `json:"replaced"`
+	Unchanged []string `json:"unchanged"`
+}
+
+// Changed tells the caller if the reload made any difference to the running checks.
+func (rs ReloadSummary) Changed() bool {
+	return len(rs.Added)+len(rs.Removed)+len(rs.Replaced) > 0
 }
 
 // HealthCheckEngine is used to run the health checks.
-// It will send a message on the externalFailureChannel when a stable failure is found.
+// It will send a message on the externalFailureChannel when a stable failure is found
+// and on the recovery channel when a failing check has recovered.
 type HealthCheckEngine struct {
-	internalFailureChan chan string
-	HealthChecks        []*HealthCheck `json:"health_checks"`
+	internalFailureChan  chan string
+	internalRecoveryChan chan string
+	HealthChecks         []*HealthCheck `json:"health_checks"`
+	running              bool
+	graceMode            bool
+	lock                 sync.RWMutex
 }
 
 // NewHealthCheckEngine return a new a pointer struct will run health checks
 func NewHealthCheckEngine(cfg []config.HealthCheck) *HealthCheckEngine {
 	hce := &HealthCheckEngine{
-		internalFailureChan: make(chan string, 1),
-		HealthChecks:        []*HealthCheck{},
+		internalFailureChan:  make(chan string, 1),
+		internalRecoveryChan: make(chan string, 1),
+		HealthChecks:         []*HealthCheck{},
+		graceMode:            true,
 	}
 	for _, healthCheckConfig := range cfg {
-		hce.HealthChecks = append(
-			hce.HealthChecks,
-			newHealthCheck(hce.internalFailureChan, healthCheckConfig),
-		)
+		hce.HealthChecks = append(hce.HealthChecks, hce.newHealthCheck(healthCheckConfig))
 	}
 
 	return hce
 }
 
+// newHealthCheck creates a health check that can see the other checks in the
+// engine, to find out if its dependencies are failing.
+func (hce *HealthCheckEngine) newHealthCheck(cfg config.HealthCheck) *HealthCheck {
+	hc := newHealthCheck(hce.internalFailureChan, hce.internalRecoveryChan, cfg)
+	hc.failingCheck = hce.failingCheck
+	return hc
+}
+
+// failingCheck returns the first of the named checks that is failing, or an
+// empty string if none of them are.
+func (hce *HealthCheckEngine) failingCheck(names []string) string {
+	hce.lock.RLock()
+	defer hce.lock.RUnlock()
+	for _, name := range names {
+		if hc := hce.find(name); hc != nil && hc.status().Failing {
+			return name
+		}
+	}
+	return ""
+}
+
+// find returns the named check or nil. The caller must hold the lock.
+func (hce *HealthCheckEngine) find(name string) *HealthCheck {
+	for _, hc := range hce.HealthChecks {
+		if hc.Name == name {
+			return hc
+		}
+	}
+	return nil
+}
+
+// MarshalJSON holds the lock while the health checks are read, as they
+// could be swapped out by a reload.
+func (hce *HealthCheckEngine) MarshalJSON() ([]byte, error) {
+	hce.lock.RLock()
+	defer hce.lock.RUnlock()
+	return json.Marshal(struct {
+		HealthChecks []*HealthCheck `json:"health_checks"`
+	}{
+		HealthChecks: hce.HealthChecks,
+	})
+}
+
 // SetGraceMode will tell the engine to forward on stable failures to the state
 // manager via the channel. This is used to allow the grace period when checks
 // might fail because the servier is not ready to service traffic.
 func (hce *HealthCheckEngine) SetGraceMode(action bool) {
+	hce.lock.Lock()
+	defer hce.lock.Unlock()
+	hce.graceMode = action
 	for _, hc := range hce.HealthChecks {
-		hc.GraceMode = action
+		hc.setGraceMode(action)
 	}
 }
 
-// Start instructs the health check engine to start running checks and to collect the failures.
-// Failures are only forwarded once ProcessFailure is set to true
-func (hce *HealthCheckEngine) Start(ExternalFailureChannel chan<- string) {
-	// Plumb pipes for sending failures onwards.
+// Start instructs the health check engine to start running checks and to collect the failures
+// and recoveries. Failures are only forwarded once grace mode is turned off.
+func (hce *HealthCheckEngine) Start(ExternalFailureChannel, ExternalRecoveryChannel chan<- string) {
+	hce.lock.Lock()
+	defer hce.lock.Unlock()
+	// Plumb pipes for sending failures and recoveries onwards.
+	// Checks keep running after a stable failure when the agent is
+	// recoverable, so this needs to keep forwarding.
 	go func() {
-		select {
-		case FailureName, ok := <-hce.internalFailureChan:
-			if !ok {
-				return
+		for {
+			select {
+			case FailureName, ok := <-hce.internalFailureChan:
+				if !ok {
+					return
+				}
+				ExternalFailureChannel <- FailureName
+			case RecoveredName, ok := <-hce.internalRecoveryChan:
+				if !ok {
+					return
+				}
+				ExternalRecoveryChannel <- RecoveredName
 			}
-			ExternalFailureChannel <- FailureName
 		}
 	}()
 	// Start the health checks
+	hce.running = true
 	for _, hc := range hce.HealthChecks {
 		hc.Start()
 	}
@@ -65,7 +169,155 @@ func (hce *HealthCheckEngine) Start(ExternalFailureChannel chan<- string) {
 // It will also set the processFailure to false, to stop any future failures from
 // coming in.
 func (hce *HealthCheckEngine) Stop() {
+	hce.lock.Lock()
+	defer hce.lock.Unlock()
+	hce.running = false
 	for _, hc := range hce.HealthChecks {
 		hc.Stop()
 	}
 }
+
+// Reload compares the new configuration with the current health checks by name.
+// New checks are added, missing checks are stopped and checks with a changed
+// configuration are replaced. Unchanged checks are left running with their
+// counters intact. New and replaced checks take on the current grace mode and
+// are only started if the engine is running.
+func (hce *HealthCheckEngine) Reload(cfg []config.HealthCheck) ReloadSummary {
+	hce.lock.Lock()
+	defer hce.lock.Unlock()
+
+	summary := ReloadSummary{
+		Added:     []string{},
+		Removed:   []string{},
+		Replaced:  []string{},
+		Unchanged: []string{},
+	}
+	current := map[string]*HealthCheck{}
+	for _, hc := range hce.HealthChecks {
+		current[hc.Name] = hc
+	}
+
+	newChecks := []*HealthCheck{}
+	for _, healthCheckConfig := range cfg {
+		existing, ok := current[healthCheckConfig.Name]
+		if ok {
+			delete(current, healthCheckConfig.Name)
+			if reflect.DeepEqual(existing.config, healthCheckConfig) {
+				summary.Unchanged = append(summary.Unchanged, existing.Name)
+				newChecks = append(newChecks, existing)
+				continue
+			}
+			existing.Stop()
+			summary.Replaced = append(summary.Replaced, existing.Name)
+		} else {
+			summary.Added = append(summary.Added, healthCheckConfig.Name)
+		}
+
+		hc := hce.newHealthCheck(healthCheckConfig)
+		hc.setGraceMode(hce.graceMode)
+		if hce.running {
+			hc.Start()
+		}
+		newChecks = append(newChecks, hc)
+	}
+
+	// Anything left over is no longer in the configuration.
+	for _, hc := range hce.HealthChecks {
+		if _, ok := current[hc.Name]; ok {
+			hc.Stop()
+			hc.deletePromMetrics()
+			summary.Removed = append(summary.Removed, hc.Name)
+		}
+	}
+	hce.HealthChecks = newChecks
+
+	return summary
+}
+
+// Counters returns the counters of each health check keyed by name.
+func (hce *HealthCheckEngine) Counters() map[string]CheckCounters {
+	hce.lock.RLock()
+	defer hce.lock.RUnlock()
+	counters := map[string]CheckCounters{}
+	for _, hc := range hce.HealthChecks {
+		counters[hc.Name] = hc.counters()
+	}
+	return counters
+}
+
+// RestoreCounters sets the counters of the health checks that have a matching name.
+// It is expected to be called before the engine is started.
+func (hce *HealthCheckEngine) RestoreCounters(counters map[string]CheckCounters) {
+	hce.lock.Lock()
+	defer hce.lock.Unlock()
+	for _, hc := range hce.HealthChecks {
+		c, ok := counters[hc.Name]
+		if !ok {
+			continue
+		}
+		hc.restoreCounters(c)
+	}
+}
+
+// Degraded tells the caller if any health check is currently in a warning or unknown state.
+// Checks in grace mode are not considered.
+func (hce *HealthCheckEngine) Degraded() bool {
+	hce.lock.RLock()
+	defer hce.lock.RUnlock()
+	for _, hc := range hce.HealthChecks {
+		if hc.degraded() {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckStatuses returns the status of each health check keyed by name.
+func (hce *HealthCheckEngine) CheckStatuses() map[string]CheckStatus {
+	hce.lock.RLock()
+	defer hce.lock.RUnlock()
+	statuses := map[string]CheckStatus{}
+	for _, hc := range hce.HealthChecks {
+		statuses[hc.Name] = hc.status()
+	}
+	return statuses
+}
+
+// DescribeFailure adds the details of the named check to the failure context.
+// The context is returned unchanged if there is no check with that name.
+func (hce *HealthCheckEngine) DescribeFailure(checkName string, fc FailureContext) FailureContext {
+	hce.lock.RLock()
+	defer hce.lock.RUnlock()
+	if hc := hce.find(checkName); hc != nil {
+		return hc.describeFailure(fc)
+	}
+	return fc
+}
+
+// RootCause follows the dependencies of the named check while they are failing
+// and returns the last failing check it finds. The named check is returned if
+// none of its dependencies are failing.
+func (hce *HealthCheckEngine) RootCause(checkName string) string {
+	hce.lock.RLock()
+	defer hce.lock.RUnlock()
+	rootCause := checkName
+	seen := map[string]bool{checkName: true}
+	for {
+		hc := hce.find(rootCause)
+		if hc == nil {
+			return rootCause
+		}
+		next := ""
+		for _, dependency := range hc.DependsOn {
+			if dep := hce.find(dependency); dep != nil && dep.status().Failing && !seen[dependency] {
+				next = dependency
+				break
+			}
+		}
+		if next == "" {
+			return rootCause
+		}
+		seen[next] = true
+		rootCause = next
+	}
+}
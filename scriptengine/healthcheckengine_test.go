@@ -0,0 +1,106 @@
+package scriptengine
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/morfien101/asg-healthcheck-agent/config"
+)
+
+func TestHealthCheckEngineReload(t *testing.T) {
+	check := func(name string, freq uint) config.HealthCheck {
+		return config.HealthCheck{Name: name, Bin: "/bin/true", FreqSeconds: freq}
+	}
+	hce := NewHealthCheckEngine([]config.HealthCheck{check("a", 1), check("b", 1), check("c", 1)})
+	hce.HealthChecks[0].TotalFailureCount = 5
+	hce.SetGraceMode(false)
+
+	summary := hce.Reload([]config.HealthCheck{check("d", 1), check("a", 1), check("b", 2)})
+
+	expected := ReloadSummary{
+		Added:     []string{"d"},
+		Removed:   []string{"c"},
+		Replaced:  []string{"b"},
+		Unchanged: []string{"a"},
+	}
+	if !reflect.DeepEqual(summary, expected) {
+		t.Errorf("Expected summary %+v, got %+v", expected, summary)
+	}
+
+	names := []string{}
+	for _, hc := range hce.HealthChecks {
+		names = append(names, hc.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"d", "a", "b"}) {
+		t.Errorf("Checks should follow the order of the new configuration, got %v", names)
+	}
+	if hce.HealthChecks[1].TotalFailureCount != 5 {
+		t.Error("Unchanged checks should keep their counters")
+	}
+	if hce.HealthChecks[0].GraceMode || hce.HealthChecks[2].GraceMode {
+		t.Error("New checks should take on the grace mode of the engine")
+	}
+
+	if hce.Reload([]config.HealthCheck{check("d", 1), check("a", 1), check("b", 2)}).Changed() {
+		t.Error("Reloading the same configuration should not change anything")
+	}
+}
+
+func TestHealthCheckDependencies(t *testing.T) {
+	failing := func(name string, allowedFailures uint, dependsOn ...string) config.HealthCheck {
+		return config.HealthCheck{Name: name, Bin: "/bin/false", FreqSeconds: 1, AllowedFailures: allowedFailures, DependsOn: dependsOn}
+	}
+	hce := NewHealthCheckEngine([]config.HealthCheck{failing("proxy", 10), failing("app", 10, "proxy"), failing("web", 10, "app")})
+	hce.SetGraceMode(false)
+	proxy, app := hce.HealthChecks[0], hce.HealthChecks[1]
+
+	// app fails before the proxy does, so that failure still counts.
+	app.runCheck()
+	proxy.runCheck()
+	app.LastState = config.StateWarning
+	app.runCheck()
+	if app.FailureSinceLastRecovery != 1 || app.LastOutcome != outcomeSkippedDependencyFailed || app.FailedDependency != "proxy" {
+		t.Errorf("Expected app to be skipped without counting a failure, got %d %s %q",
+			app.FailureSinceLastRecovery, app.LastOutcome, app.FailedDependency)
+	}
+	if app.LastState != stateSkipped || app.LastExitCode != -1 || hce.Degraded() {
+		t.Errorf("Expected the skipped check to not report its last state, got %s %d", app.LastState, app.LastExitCode)
+	}
+	if cause := hce.RootCause("web"); cause != "proxy" {
+		t.Errorf("Expected proxy to be the root cause, got %s", cause)
+	}
+	b, err := json.Marshal(hce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"last_outcome":"skipped_dependency_failed"`) {
+		t.Errorf("Expected the skipped check in the status, got %s", b)
+	}
+
+	proxy.FailureSinceLastRecovery = 0
+	app.runCheck()
+	if app.FailureSinceLastRecovery != 2 || app.LastOutcome != outcomeFailure || app.FailedDependency != "" {
+		t.Errorf("Expected app to run once the proxy recovered, got %d %s %q",
+			app.FailureSinceLastRecovery, app.LastOutcome, app.FailedDependency)
+	}
+	if cause := hce.RootCause("web"); cause != "app" {
+		t.Errorf("Expected app to be the root cause, got %s", cause)
+	}
+
+	// A dependency that allows more failures than the check still stops it
+	// from becoming a stable failure first.
+	hce = NewHealthCheckEngine([]config.HealthCheck{failing("proxy", 3), failing("app", 0, "proxy")})
+	hce.SetGraceMode(false)
+	proxy, app = hce.HealthChecks[0], hce.HealthChecks[1]
+	proxy.runCheck()
+	app.runCheck()
+	if app.FailureSinceLastRecovery != 0 || app.FailedDependency != "proxy" {
+		t.Errorf("Expected app to be skipped while the proxy is failing, got %d %q",
+			app.FailureSinceLastRecovery, app.FailedDependency)
+	}
+	if cause := hce.RootCause("app"); cause != "proxy" {
+		t.Errorf("Expected proxy to be the root cause, got %s", cause)
+	}
+}
@@ -0,0 +1,110 @@
+package scriptengine
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/morfien101/asg-healthcheck-agent/config"
+)
+
+// Reasons given in the hook report for a hook failing or being skipped.
+const (
+	reasonRetriesExhausted = "retries_exhausted"
+	reasonNotRetryable     = "exit_code_not_retryable"
+	reasonDeadlinePassed   = "deadline_passed"
+	reasonAlreadyCompleted = "already_completed"
+	reasonChainAborted     = "chain_aborted"
+	reasonJumpedOver       = "jumped_over"
+	reasonRunIfNotMet      = "run_if_not_met"
+)
+
+// HookReport describes a run of a hook chain. It lists what ran, what was skipped and why.
+type HookReport struct {
+	IncidentID string       `json:"incident_id"`
+	Reason     string       `json:"reason"`
+	StartedAt  string       `json:"started_at"`
+	FinishedAt string       `json:"finished_at,omitempty"`
+	Aborted    bool         `json:"aborted"`
+	Hooks      []HookResult `json:"hooks"`
+}
+
+// HookResult is what happened to a single hook in the chain.
+type HookResult struct {
+	Name       string `json:"name"`
+	Outcome    string `json:"outcome"`
+	Reason     string `json:"reason,omitempty"`
+	Attempts   uint   `json:"attempts"`
+	ExitCode   int    `json:"exit_code"`
+	StartedAt  string `json:"started_at,omitempty"`
+	FinishedAt string `json:"finished_at,omitempty"`
+	// Results of the last attempt of an elb_deregister hook.
+	TargetGroups []TargetGroupResult `json:"target_groups,omitempty"`
+}
+
+// TargetGroupResult is what happened when deregistering from a single target group.
+type TargetGroupResult struct {
+	TargetGroupArn string `json:"target_group_arn"`
+	// unused once the targets have drained, draining if the drain timed out,
+	// not_registered if the instance was not in the group or failed.
+	State   string `json:"state"`
+	Targets int    `json:"targets"`
+	Error   string `json:"error,omitempty"`
+}
+
+func newHookReport(fc FailureContext) HookReport {
+	return HookReport{
+		IncidentID: fc.IncidentID,
+		Reason:     fc.Reason,
+		StartedAt:  time.Now().UTC().Format(time.RFC3339),
+		Hooks:      []HookResult{},
+	}
+}
+
+func skippedHook(name, reason string) HookResult {
+	return HookResult{
+		Name:     name,
+		Outcome:  config.HookOutcomeSkipped,
+		Reason:   reason,
+		ExitCode: -1,
+	}
+}
+
+// result finds the result of a hook in the report.
+func (hr HookReport) result(name string) (HookResult, bool) {
+	for _, result := range hr.Hooks {
+		if result.Name == name {
+			return result, true
+		}
+	}
+	return HookResult{}, false
+}
+
+// unmetCondition returns a description of the first run_if condition that is not met.
+// An empty string means the hook can run.
+func (hr HookReport) unmetCondition(conditions []config.HookCondition) string {
+	for _, condition := range conditions {
+		outcome := "not run"
+		if result, ok := hr.result(condition.Hook); ok {
+			outcome = result.Outcome
+		}
+		if outcome != condition.Outcome {
+			return fmt.Sprintf("%s: %s was %s, not %s", reasonRunIfNotMet, condition.Hook, outcome, condition.Outcome)
+		}
+	}
+	return ""
+}
+
+// jumpTarget returns the hook to jump to if the on_failure policy is jump_to.
+func jumpTarget(onFailure string) (string, bool) {
+	if !strings.HasPrefix(onFailure, config.OnFailureJumpTo) {
+		return "", false
+	}
+	return strings.TrimPrefix(onFailure, config.OnFailureJumpTo), true
+}
+
+func (hr HookReport) copy() *HookReport {
+	c := hr
+	c.Hooks = append([]HookResult{}, hr.Hooks...)
+	return &c
+}
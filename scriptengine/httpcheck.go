@@ -0,0 +1,139 @@
+package scriptengine
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/morfien101/asg-healthcheck-agent/config"
+	"github.com/morfien101/asg-healthcheck-agent/logs"
+)
+
+const (
+	defaultHTTPCheckTimeout = 5 * time.Second
+	// Only this much of the body is read when looking for the body regex.
+	maxHTTPCheckBodyBytes = 1024 * 1024
+)
+
+// httpCheck makes a HTTP request and reports the result as if it were
+// a process that exited. 0 is success and 1 is a failure.
+type httpCheck struct {
+	name          string
+	url           string
+	method        string
+	headers       map[string]string
+	expectedCodes []int
+	bodyRegex     *regexp.Regexp
+	client        *http.Client
+	// Why the last run failed, empty if it passed.
+	failure string
+}
+
+// checkTimeout is used if the http block does not have its own timeout.
+func newHTTPCheck(name string, cfg *config.HTTPCheckConfig, checkTimeout uint) (*httpCheck, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("http check %s has no http configuration", name)
+	}
+	check := &httpCheck{
+		name:          name,
+		url:           cfg.URL,
+		method:        cfg.Method,
+		headers:       cfg.Headers,
+		expectedCodes: cfg.ExpectedStatusCodes,
+		client:        &http.Client{Timeout: defaultHTTPCheckTimeout},
+	}
+	if check.method == "" {
+		check.method = http.MethodGet
+	}
+	if len(check.expectedCodes) == 0 {
+		check.expectedCodes = []int{http.StatusOK}
+	}
+	if cfg.TimeoutSeconds > 0 {
+		check.client.Timeout = time.Duration(cfg.TimeoutSeconds) * time.Second
+	} else if checkTimeout > 0 {
+		check.client.Timeout = time.Duration(checkTimeout) * time.Second
+	}
+	if cfg.BodyRegex != "" {
+		re, err := regexp.Compile(cfg.BodyRegex)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile body_regex for http check %s. Error: %s", name, err)
+		}
+		check.bodyRegex = re
+	}
+
+	return check, nil
+}
+
+func (c *httpCheck) run() (exitcode int, err error) {
+	c.failure = ""
+	req, err := http.NewRequest(c.method, c.url, nil)
+	if err != nil {
+		c.logFailure(fmt.Sprintf("failed to create request. Error: %s", err))
+		return 1, nil
+	}
+	for key, value := range c.headers {
+		if http.CanonicalHeaderKey(key) == "Host" {
+			req.Host = value
+			continue
+		}
+		req.Header.Set(key, value)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.logFailure(err.Error())
+		return 1, nil
+	}
+	defer resp.Body.Close()
+
+	if !c.expectedStatus(resp.StatusCode) {
+		c.logFailure(fmt.Sprintf("unexpected status code %d", resp.StatusCode))
+		// Drain the body so that the connection can be reused.
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxHTTPCheckBodyBytes))
+		return 1, nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxHTTPCheckBodyBytes))
+	if err != nil {
+		c.logFailure(fmt.Sprintf("failed to read response body. Error: %s", err))
+		return 1, nil
+	}
+	if c.bodyRegex != nil && !c.bodyRegex.Match(body) {
+		c.logFailure("response body did not match body_regex")
+		return 1, nil
+	}
+
+	return 0, nil
+}
+
+func (c *httpCheck) expectedStatus(code int) bool {
+	for _, expected := range c.expectedCodes {
+		if code == expected {
+			return true
+		}
+	}
+	return false
+}
+
+// tail gives back why the last run failed, so the hooks know what happened.
+func (c *httpCheck) tail() []string {
+	if c.failure == "" {
+		return []string{}
+	}
+	return []string{c.failure}
+}
+
+func (c *httpCheck) logFailure(reason string) {
+	c.failure = reason
+	logs.JSONLog(
+		reason,
+		logs.WARNING,
+		logs.JSONAttributes{
+			"healthcheck_name": c.name,
+			"url":              c.url,
+		},
+	)
+}
@@ -0,0 +1,103 @@
+package scriptengine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/morfien101/asg-healthcheck-agent/config"
+)
+
+func TestHTTPCheck(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Check") != "yes" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/ok":
+			w.Write([]byte(`{"status":"ok"}`))
+		case "/created":
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		cfg      config.HTTPCheckConfig
+		expected int
+	}{
+		{
+			name:     "ok",
+			cfg:      config.HTTPCheckConfig{URL: srv.URL + "/ok", Headers: map[string]string{"X-Check": "yes"}},
+			expected: 0,
+		},
+		{
+			name:     "missing header",
+			cfg:      config.HTTPCheckConfig{URL: srv.URL + "/ok"},
+			expected: 1,
+		},
+		{
+			name:     "bad status",
+			cfg:      config.HTTPCheckConfig{URL: srv.URL + "/down", Headers: map[string]string{"X-Check": "yes"}},
+			expected: 1,
+		},
+		{
+			name: "expected status",
+			cfg: config.HTTPCheckConfig{
+				URL:                 srv.URL + "/created",
+				Headers:             map[string]string{"X-Check": "yes"},
+				ExpectedStatusCodes: []int{200, 201},
+			},
+			expected: 0,
+		},
+		{
+			name: "body matches",
+			cfg: config.HTTPCheckConfig{
+				URL:       srv.URL + "/ok",
+				Headers:   map[string]string{"X-Check": "yes"},
+				BodyRegex: `"status":\s*"ok"`,
+			},
+			expected: 0,
+		},
+		{
+			name: "body does not match",
+			cfg: config.HTTPCheckConfig{
+				URL:       srv.URL + "/ok",
+				Headers:   map[string]string{"X-Check": "yes"},
+				BodyRegex: `"status":\s*"fail"`,
+			},
+			expected: 1,
+		},
+		{
+			name:     "connection refused",
+			cfg:      config.HTTPCheckConfig{URL: "http://127.0.0.1:1/", TimeoutSeconds: 1},
+			expected: 1,
+		},
+	}
+
+	for _, test := range tests {
+		cfg := test.cfg
+		check, err := newHTTPCheck(test.name, &cfg, 0)
+		if err != nil {
+			t.Fatalf("%s: failed to create check. Error: %s", test.name, err)
+		}
+		exitcode, err := check.run()
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		}
+		if exitcode != test.expected {
+			t.Errorf("%s: expected exit code %d, got %d", test.name, test.expected, exitcode)
+		}
+	}
+}
+
+func TestHTTPCheckBadRegex(t *testing.T) {
+	_, err := newHTTPCheck("bad", &config.HTTPCheckConfig{URL: "http://127.0.0.1/", BodyRegex: "("}, 0)
+	if err == nil {
+		t.Error("Expected an error for an invalid body_regex")
+	}
+}
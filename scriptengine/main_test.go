@@ -0,0 +1,13 @@
+package scriptengine
+
+import (
+	"os"
+	"testing"
+
+	"github.com/morfien101/asg-healthcheck-agent/logs"
+)
+
+func TestMain(m *testing.M) {
+	logs.DefaultLogger = logs.NewFakeLogger(false)
+	os.Exit(m.Run())
+}
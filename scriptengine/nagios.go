@@ -0,0 +1,172 @@
+package scriptengine
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/morfien101/asg-healthcheck-agent/logs"
+	"github.com/morfien101/asg-healthcheck-agent/metrics"
+)
+
+// perfData is a single value from the performance data of a Nagios plugin.
+// Only the label, value and unit of measurement are kept.
+type perfData struct {
+	Label string  `json:"label"`
+	Value float64 `json:"value"`
+	UOM   string  `json:"uom,omitempty"`
+}
+
+// nagiosOutput is the parsed output of a Nagios plugin.
+type nagiosOutput struct {
+	StatusText string
+	LongText   []string
+	PerfData   []perfData
+	// Perf data items that could not be parsed.
+	Invalid []string
+}
+
+// parseNagiosOutput follows the plugin output spec. The first line is the
+// status text, optionally followed by | and perf data. Following lines are
+// long text until a line holding a |, after which everything is perf data.
+func parseNagiosOutput(lines []string) nagiosOutput {
+	out := nagiosOutput{}
+	if len(lines) == 0 {
+		return out
+	}
+	perf := []string{}
+
+	text, data := splitPerfData(lines[0])
+	out.StatusText = text
+	perf = append(perf, data)
+
+	inPerfData := false
+	for _, line := range lines[1:] {
+		if inPerfData {
+			perf = append(perf, line)
+			continue
+		}
+		if strings.Contains(line, "|") {
+			text, data := splitPerfData(line)
+			if text != "" {
+				out.LongText = append(out.LongText, text)
+			}
+			perf = append(perf, data)
+			inPerfData = true
+			continue
+		}
+		out.LongText = append(out.LongText, line)
+	}
+
+	for _, item := range splitPerfItems(strings.Join(perf, " ")) {
+		pd, err := parsePerfItem(item)
+		if err != nil {
+			out.Invalid = append(out.Invalid, item)
+			continue
+		}
+		// Undetermined values are valid but have nothing to report.
+		if pd != nil {
+			out.PerfData = append(out.PerfData, *pd)
+		}
+	}
+
+	return out
+}
+
+func splitPerfData(line string) (text, data string) {
+	parts := strings.SplitN(line, "|", 2)
+	text = strings.TrimSpace(parts[0])
+	if len(parts) == 2 {
+		data = strings.TrimSpace(parts[1])
+	}
+	return text, data
+}
+
+// splitPerfItems splits on spaces, except for spaces inside single quoted labels.
+func splitPerfItems(data string) []string {
+	items := []string{}
+	current := strings.Builder{}
+	quoted := false
+	for _, r := range data {
+		switch {
+		case r == '\'':
+			quoted = !quoted
+			current.WriteRune(r)
+		case (r == ' ' || r == '\t') && !quoted:
+			if current.Len() > 0 {
+				items = append(items, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if current.Len() > 0 {
+		items = append(items, current.String())
+	}
+	return items
+}
+
+// parsePerfItem parses 'label'=value[UOM];[warn];[crit];[min];[max]
+// nil is returned for values that are undetermined (U).
+func parsePerfItem(item string) (*perfData, error) {
+	i := strings.LastIndex(item, "=")
+	if i < 1 {
+		return nil, fmt.Errorf("missing label or value")
+	}
+	label := strings.Trim(item[:i], "'")
+	value := strings.SplitN(item[i+1:], ";", 2)[0]
+	if value == "U" {
+		return nil, nil
+	}
+
+	end := len(value)
+	for end > 0 && !strings.ContainsAny(value[end-1:end], "0123456789.") {
+		end--
+	}
+	f, err := strconv.ParseFloat(value[:end], 64)
+	if err != nil {
+		return nil, err
+	}
+	return &perfData{Label: label, Value: f, UOM: value[end:]}, nil
+}
+
+var promCheckPerfData = metrics.NewPromGauge(
+	"healthcheck_perfdata",
+	"Performance data reported by a health check in nagios output mode.",
+)
+
+// recordNagiosOutput keeps the status text and sends the perf data on as gauges.
+func (hc *HealthCheck) recordNagiosOutput(out nagiosOutput) {
+	hc.lock.Lock()
+	hc.StatusText = out.StatusText
+	hc.lock.Unlock()
+	if len(out.LongText) > 0 {
+		logs.JSONLog(
+			strings.Join(out.LongText, "\n"),
+			logs.DEBUG,
+			logs.JSONAttributes{
+				"healthcheck_name": hc.Name,
+			},
+		)
+	}
+	for _, item := range out.Invalid {
+		logs.JSONLog(
+			"Ignoring invalid perf data",
+			logs.DEBUG,
+			logs.JSONAttributes{
+				"healthcheck_name": hc.Name,
+				"perf_data":        item,
+			},
+		)
+	}
+	for _, pd := range out.PerfData {
+		tags := metrics.Tags{
+			"name":  hc.Name,
+			"label": pd.Label,
+			"uom":   pd.UOM,
+		}
+		metrics.FGauge("healthcheck_perfdata", pd.Value, tags)
+		promCheckPerfData.Set(pd.Value, tags)
+	}
+}
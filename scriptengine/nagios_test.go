@@ -0,0 +1,83 @@
+package scriptengine
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/morfien101/asg-healthcheck-agent/config"
+)
+
+func TestParseNagiosOutput(t *testing.T) {
+	out := parseNagiosOutput([]string{
+		"DISK OK - free space: / 3326 MB (56%); | /=2643MB;5948;5958;0;5968",
+		"/ 15272 MB (77%);",
+		"/boot 68 MB (69%);",
+		"/home 69357 MB (27%); | /boot=68MB;88;93;0;98",
+		"/home=69357MB;253404;253409;0;253414",
+		"'var log'=818MB;970;975;0;980 load=U invalid",
+	})
+
+	if out.StatusText != "DISK OK - free space: / 3326 MB (56%);" {
+		t.Errorf("Unexpected status text %q", out.StatusText)
+	}
+	expectedLong := []string{"/ 15272 MB (77%);", "/boot 68 MB (69%);", "/home 69357 MB (27%);"}
+	if !reflect.DeepEqual(out.LongText, expectedLong) {
+		t.Errorf("Unexpected long text %q", out.LongText)
+	}
+	expectedPerf := []perfData{
+		{Label: "/", Value: 2643, UOM: "MB"},
+		{Label: "/boot", Value: 68, UOM: "MB"},
+		{Label: "/home", Value: 69357, UOM: "MB"},
+		{Label: "var log", Value: 818, UOM: "MB"},
+	}
+	if !reflect.DeepEqual(out.PerfData, expectedPerf) {
+		t.Errorf("Unexpected perf data %+v", out.PerfData)
+	}
+	if !reflect.DeepEqual(out.Invalid, []string{"invalid"}) {
+		t.Errorf("Unexpected invalid items %q", out.Invalid)
+	}
+}
+
+func TestParsePerfItem(t *testing.T) {
+	tests := []struct {
+		item     string
+		expected perfData
+	}{
+		{"time=0.002s;;;0", perfData{Label: "time", Value: 0.002, UOM: "s"}},
+		{"used=10%", perfData{Label: "used", Value: 10, UOM: "%"}},
+		{"temp=-5", perfData{Label: "temp", Value: -5}},
+		{"'a=b'=3c", perfData{Label: "a=b", Value: 3, UOM: "c"}},
+	}
+	for _, test := range tests {
+		pd, err := parsePerfItem(test.item)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.item, err)
+			continue
+		}
+		if *pd != test.expected {
+			t.Errorf("%s: expected %+v, got %+v", test.item, test.expected, *pd)
+		}
+	}
+}
+
+func TestNagiosHealthCheck(t *testing.T) {
+	hc := newHealthCheck(make(chan string, 1), make(chan string, 1), config.HealthCheck{
+		Name:        "nagios",
+		Bin:         "/bin/sh",
+		Args:        []string{"-c", "echo 'LOAD WARNING - load average: 5.1 | load1=5.1;4;8;0'; exit 1"},
+		FreqSeconds: 1,
+		OutputMode:  config.OutputModeNagios,
+	})
+	hc.setGraceMode(false)
+
+	hc.runCheck()
+	if hc.LastState != config.StateWarning {
+		t.Errorf("Expected state %s, got %s", config.StateWarning, hc.LastState)
+	}
+	if hc.StatusText != "LOAD WARNING - load average: 5.1" {
+		t.Errorf("Unexpected status text %q", hc.StatusText)
+	}
+	if hc.FailureSinceLastRecovery != 0 {
+		t.Error("Warnings should not count as failures")
+	}
+}
@@ -2,10 +2,14 @@ package scriptengine
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
-	"io"
+	"os"
 	"os/exec"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/morfien101/asg-healthcheck-agent/logs"
 )
@@ -13,8 +17,21 @@ import (
 const (
 	stdoutString = "stdout"
 	stderrString = "stderr"
+	// timeoutExitCode is given back for processes that are killed because they
+	// ran for too long. It is the same code that coreutils timeout uses.
+	timeoutExitCode = 124
+	// Only this many lines of stdout are kept for each run of a process.
+	maxCapturedLines = 100
+	// Only this many lines of combined stdout and stderr are kept for the tail.
+	maxTailLines = 20
+	// How long to keep reading output after the process has exited.
+	outputDrainTimeout = time.Second
 )
 
+// errProcessTimeout is returned from run when the process was killed because it
+// ran for longer than the timeout allowed.
+var errProcessTimeout = errors.New("process timed out")
+
 type ProcessInterface interface {
 	run()
 }
@@ -22,32 +39,94 @@ type ProcessInterface interface {
 type Process struct {
 	name        string
 	proc        *exec.Cmd
-	stopLogging chan bool
+	timeout     time.Duration
+	stdoutRead  *os.File
+	stdoutWrite *os.File
+	stderrRead  *os.File
+	stderrWrite *os.File
+	// logStdout can be turned off when stdout is parsed rather than logged.
+	logStdout   bool
+	stdoutLines []string
+	tailLines   []string
+	outputLock  sync.Mutex
+	pumping     sync.WaitGroup
 }
 
 // Setup Process will link create the process object and also link the stdout and stderr.
+// A timeout of 0 will let the process run for as long as it wants.
 // An error is returned if anything fails.
-func newProcess(name, bin string, args ...string) (*Process, error) {
+func newProcess(name string, timeout time.Duration, bin string, args ...string) (*Process, error) {
 	proc := &Process{
-		name: name,
-		proc: exec.Command(bin, args...),
+		name:      name,
+		proc:      exec.Command(bin, args...),
+		timeout:   timeout,
+		logStdout: true,
 	}
-
-	procStdOut, err := proc.proc.StdoutPipe()
+	// The process gets its own group so that any children it spawns can be
+	// killed along with it.
+	setProcessGroup(proc.proc)
+
+	// os.Pipe is used over StdoutPipe as Wait would close the read side
+	// of the pipes, possibly before we have read all of the output.
+	var err error
+	proc.stdoutRead, proc.stdoutWrite, err = os.Pipe()
 	if err != nil {
 		return nil, fmt.Errorf("Failed to connect to stdout pipe. Error: %s", err)
 	}
-
-	procStdErr, err := proc.proc.StderrPipe()
+	proc.stderrRead, proc.stderrWrite, err = os.Pipe()
 	if err != nil {
+		proc.stdoutRead.Close()
+		proc.stdoutWrite.Close()
 		return nil, fmt.Errorf("Failed to connect to stderr pipe. Error: %s", err)
 	}
-	go proc.pumpLogs(procStdOut, procStdErr)
+	proc.proc.Stdout = proc.stdoutWrite
+	proc.proc.Stderr = proc.stderrWrite
 
 	return proc, nil
 }
 
-func (proc *Process) pumpLogs(stdout, stderr io.ReadCloser) {
+// output returns the lines written to stdout by the process. Only the last
+// maxCapturedLines are kept.
+func (proc *Process) output() []string {
+	proc.outputLock.Lock()
+	defer proc.outputLock.Unlock()
+	return append([]string{}, proc.stdoutLines...)
+}
+
+// tail returns the last lines written to either stdout or stderr by the process.
+func (proc *Process) tail() []string {
+	proc.outputLock.Lock()
+	defer proc.outputLock.Unlock()
+	return append([]string{}, proc.tailLines...)
+}
+
+func (proc *Process) captureLine(line, pipe string) {
+	proc.outputLock.Lock()
+	defer proc.outputLock.Unlock()
+	proc.tailLines = keepLast(append(proc.tailLines, line), maxTailLines)
+	if pipe == stdoutString {
+		proc.stdoutLines = keepLast(append(proc.stdoutLines, line), maxCapturedLines)
+	}
+}
+
+func keepLast(lines []string, max int) []string {
+	if len(lines) > max {
+		return lines[len(lines)-max:]
+	}
+	return lines
+}
+
+// setEnvironment adds variables to the environment that the process inherits from the agent.
+func (proc *Process) setEnvironment(env []string) {
+	proc.proc.Env = append(os.Environ(), env...)
+}
+
+// setStdin gives the process data to read on stdin.
+func (proc *Process) setStdin(data []byte) {
+	proc.proc.Stdin = bytes.NewReader(data)
+}
+
+func (proc *Process) pumpLogs() {
 	sendLog := func(message string, pipe string) {
 		sev := logs.WARNING
 		if pipe == stderrString {
@@ -63,43 +142,93 @@ func (proc *Process) pumpLogs(stdout, stderr io.ReadCloser) {
 		)
 	}
 
-	proc.stopLogging = make(chan bool, 1)
-	go func() {
-		<-proc.stopLogging
-		defer stdout.Close()
-		defer stderr.Close()
-	}()
-
-	stdOutScanner := bufio.NewScanner(stdout)
-	stdErrScanner := bufio.NewScanner(stderr)
+	stdOutScanner := bufio.NewScanner(proc.stdoutRead)
+	stdErrScanner := bufio.NewScanner(proc.stderrRead)
 
+	proc.pumping.Add(2)
 	go func() {
+		defer proc.pumping.Done()
 		for stdOutScanner.Scan() {
-			sendLog(stdOutScanner.Text(), stdoutString)
+			proc.captureLine(stdOutScanner.Text(), stdoutString)
+			if proc.logStdout {
+				sendLog(stdOutScanner.Text(), stdoutString)
+			}
 		}
 	}()
 	go func() {
+		defer proc.pumping.Done()
 		for stdErrScanner.Scan() {
+			proc.captureLine(stdErrScanner.Text(), stderrString)
 			sendLog(stdErrScanner.Text(), stderrString)
 		}
 	}()
 }
 
+// closePipes waits for the output to be read and then closes the read side
+// of the pipes. Children that are still holding the pipes open are only given
+// outputDrainTimeout before the pipes are closed on them.
+func (proc *Process) closePipes() {
+	drained := make(chan struct{})
+	go func() {
+		proc.pumping.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(outputDrainTimeout):
+	}
+	proc.stdoutRead.Close()
+	proc.stderrRead.Close()
+}
+
 func (proc *Process) run() (exitcode int, err error) {
 	// Everything is bad until the process exits successfully.
 	exitcode = 1
-	if err := proc.proc.Start(); err != nil {
+	err = proc.proc.Start()
+	// The child has its own copy of the write side of the pipes now.
+	// Closing ours means that the readers will see EOF once the child is done.
+	proc.stdoutWrite.Close()
+	proc.stderrWrite.Close()
+	if err != nil {
+		proc.stdoutRead.Close()
+		proc.stderrRead.Close()
 		return 1, err
 	}
+	proc.pumpLogs()
+	defer proc.closePipes()
+
 	// Wait for the process to finish
 	procComplete := make(chan error, 1)
 	go func() {
 		procComplete <- proc.proc.Wait()
-		// Close the pipes that redirect std out and err
-		proc.stopLogging <- true
 	}()
 
-	exitError := <-procComplete
+	var timeout <-chan time.Time
+	if proc.timeout > 0 {
+		timer := time.NewTimer(proc.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var exitError error
+	select {
+	case exitError = <-procComplete:
+	case <-timeout:
+		if err := killProcessGroup(proc.proc); err != nil {
+			logs.JSONLog(
+				"Failed to kill process group",
+				logs.ERROR,
+				logs.JSONAttributes{
+					"error":        err.Error(),
+					"process_name": proc.name,
+				},
+			)
+		}
+		// Wait for the process to be reaped.
+		<-procComplete
+		return timeoutExitCode, errProcessTimeout
+	}
+
 	if exiterr, ok := exitError.(*exec.ExitError); ok {
 		// The program has exited with an exit code != 0
 
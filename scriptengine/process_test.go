@@ -0,0 +1,20 @@
+package scriptengine
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProcessWithinTimeout(t *testing.T) {
+	p, err := newProcess("fast", 5*time.Second, "/bin/sh", "-c", "exit 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exitcode, err := p.run()
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if exitcode != 3 {
+		t.Errorf("Expected exit code 3, got %d", exitcode)
+	}
+}
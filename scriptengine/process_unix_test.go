@@ -0,0 +1,60 @@
+//go:build !windows
+// +build !windows
+
+package scriptengine
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestProcessTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "process")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pidFile := filepath.Join(dir, "child.pid")
+
+	// The background sleep is a child of the shell. Its pid is written out so
+	// that the test can see it was killed along with the shell.
+	p, err := newProcess("timeout", time.Second, "/bin/sh", "-c", "sleep 30 & echo $! > "+pidFile+"; sleep 30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	exitcode, err := p.run()
+	if err != errProcessTimeout {
+		t.Errorf("Expected a timeout error, got %v", err)
+	}
+	if exitcode != timeoutExitCode {
+		t.Errorf("Expected exit code %d, got %d", timeoutExitCode, exitcode)
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("Process took %s to be killed", took)
+	}
+
+	b, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The killed child is reaped by init, which can take a moment.
+	deadline := time.Now().Add(5 * time.Second)
+	for syscall.Kill(pid, 0) == nil {
+		if time.Now().After(deadline) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("Expected the child process %d to be killed", pid)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build windows
+// +build windows
+
+package scriptengine
+
+import "os/exec"
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup can only kill the process itself on windows.
+// Children of the process may be left running.
+func killProcessGroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	return cmd.Process.Kill()
+}
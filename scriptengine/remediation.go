@@ -0,0 +1,178 @@
+package scriptengine
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/morfien101/asg-healthcheck-agent/config"
+	"github.com/morfien101/asg-healthcheck-agent/logs"
+	"github.com/morfien101/asg-healthcheck-agent/metrics"
+)
+
+// Outcomes of a remediation attempt.
+const (
+	remediationSuccess = "success"
+	remediationFailure = "failure"
+	remediationSkipped = "skipped_budget_exhausted"
+)
+
+// remediation runs commands that may fix a failing check before it becomes a
+// stable failure. The exported fields are shown in _status.
+type remediation struct {
+	AfterFailures      uint   `json:"after_failures"`
+	MaxPerHour         uint   `json:"max_per_hour"`
+	Attempts           uint   `json:"attempts"`
+	SkippedAttempts    uint   `json:"skipped_attempts"`
+	LastAttemptTime    string `json:"last_attempt_time"`
+	LastAttemptOutcome string `json:"last_attempt_outcome"`
+	actions            []config.RemediationAction
+	// Times of the attempts in the last hour, used for the budget.
+	recentAttempts []time.Time
+	// running is true while an attempt is in progress.
+	running bool
+	// lock guards the attempts. It is not held while the actions run.
+	lock sync.Mutex
+}
+
+func newRemediation(cfg *config.RemediationConfig) *remediation {
+	if cfg == nil {
+		return nil
+	}
+	return &remediation{
+		AfterFailures:      cfg.AfterFailures,
+		MaxPerHour:         cfg.MaxPerHour,
+		LastAttemptTime:    "never",
+		LastAttemptOutcome: outcomeNever,
+		actions:            cfg.Actions,
+	}
+}
+
+var promRemediationAttempts = metrics.NewPromCounter(
+	"healthcheck_remediation_attempts_total",
+	"Number of remediation attempts for a health check by outcome.",
+)
+
+func metricRemediation(name, outcome string) {
+	tags := metrics.Tags{
+		"name":    name,
+		"outcome": outcome,
+	}
+	metrics.Incr("healthcheck_remediation", 1, tags)
+	promRemediationAttempts.Add(1, tags)
+}
+
+// due tells the caller if the failures have just reached the threshold.
+// It will only be true once for each run of failures.
+func (r *remediation) due(failures uint) bool {
+	return r != nil && failures == r.AfterFailures
+}
+
+// MarshalJSON holds the lock while the attempts are read.
+func (r *remediation) MarshalJSON() ([]byte, error) {
+	type attempts remediation
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return json.Marshal((*attempts)(r))
+}
+
+// budgetAvailable drops attempts older than an hour and checks if there is room for another.
+func (r *remediation) budgetAvailable(now time.Time) bool {
+	recent := []time.Time{}
+	for _, attempt := range r.recentAttempts {
+		if now.Sub(attempt) < time.Hour {
+			recent = append(recent, attempt)
+		}
+	}
+	r.recentAttempts = recent
+	return r.MaxPerHour == 0 || uint(len(r.recentAttempts)) < r.MaxPerHour
+}
+
+// start runs the actions in their own go routine, so a slow action does not
+// stop the check from running on its schedule or delay a stable failure.
+// A new attempt is not started while the last one is still running.
+func (r *remediation) start(checkName string) {
+	r.lock.Lock()
+	if r.running {
+		r.lock.Unlock()
+		logs.JSONLog(
+			"Skipping remediation, the last attempt is still running",
+			logs.WARNING,
+			logs.JSONAttributes{"healthcheck_name": checkName},
+		)
+		return
+	}
+	r.running = true
+	r.lock.Unlock()
+	go func() {
+		r.run(checkName)
+		r.lock.Lock()
+		r.running = false
+		r.lock.Unlock()
+	}()
+}
+
+// run will run each of the actions in order. Failed actions are logged and
+// the remaining actions are still run.
+func (r *remediation) run(checkName string) {
+	now := time.Now()
+	r.lock.Lock()
+	r.LastAttemptTime = now.Format("Mon Jan 2 15:04:05 -0700 MST 2006")
+	if !r.budgetAvailable(now) {
+		r.SkippedAttempts++
+		r.LastAttemptOutcome = remediationSkipped
+		r.lock.Unlock()
+		logs.JSONLog(
+			"Skipping remediation, the hourly budget has been used",
+			logs.WARNING,
+			logs.JSONAttributes{
+				"healthcheck_name": checkName,
+				"max_per_hour":     r.MaxPerHour,
+			},
+		)
+		metricRemediation(checkName, remediationSkipped)
+		return
+	}
+	r.recentAttempts = append(r.recentAttempts, now)
+	r.Attempts++
+	r.lock.Unlock()
+
+	outcome := remediationSuccess
+	for _, action := range r.actions {
+		if !runRemediationAction(checkName, action) {
+			outcome = remediationFailure
+		}
+	}
+	r.lock.Lock()
+	r.LastAttemptOutcome = outcome
+	r.lock.Unlock()
+	metricRemediation(checkName, outcome)
+}
+
+func runRemediationAction(checkName string, action config.RemediationAction) bool {
+	attributes := logs.JSONAttributes{
+		"healthcheck_name": checkName,
+		"remediation_name": action.Name,
+	}
+	logs.JSONLog("Running remediation action", logs.INFO, attributes)
+
+	p, err := newProcess(action.Name, time.Duration(action.TimeoutSeconds)*time.Second, action.Bin, action.Args...)
+	if err != nil {
+		attributes["error"] = err.Error()
+		logs.JSONLog("Failed to create remediation process", logs.ERROR, attributes)
+		return false
+	}
+	exitcode, err := p.run()
+	if err != nil {
+		attributes["error"] = err.Error()
+		logs.JSONLog("Failed to run remediation action", logs.ERROR, attributes)
+		return false
+	}
+	if exitcode != 0 {
+		attributes["exitcode"] = exitcode
+		logs.JSONLog("Remediation action exited bad", logs.WARNING, attributes)
+		return false
+	}
+	logs.JSONLog("Remediation action ran successfully", logs.INFO, attributes)
+	return true
+}
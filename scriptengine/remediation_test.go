@@ -0,0 +1,133 @@
+package scriptengine
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/morfien101/asg-healthcheck-agent/config"
+)
+
+func TestRemediationBeforeStableFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remediation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	actionLog := filepath.Join(dir, "actions.log")
+
+	failchan := make(chan string, 1)
+	hc := &HealthCheck{
+		Name:            "remediate",
+		LastExitCode:    1,
+		AllowedFailures: 2,
+		failedChan:      failchan,
+		Remediation: newRemediation(&config.RemediationConfig{
+			AfterFailures: 1,
+			MaxPerHour:    1,
+			Actions: []config.RemediationAction{
+				{Name: "first", Bin: "/bin/sh", Args: []string{"-c", "echo first >> " + actionLog}},
+				{Name: "second", Bin: "/bin/sh", Args: []string{"-c", "echo second >> " + actionLog + "; exit 1"}},
+			},
+		}),
+	}
+
+	hc.determineFailure()
+	waitForRemediation(t, hc.Remediation)
+	b, err := ioutil.ReadFile(actionLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "first\nsecond\n" {
+		t.Errorf("Expected the actions to run in order, got %q", string(b))
+	}
+	if hc.Remediation.Attempts != 1 || hc.Remediation.LastAttemptOutcome != remediationFailure {
+		t.Errorf("Unexpected remediation status %+v", hc.Remediation)
+	}
+
+	// Still failing after the remediation, this should become a stable failure.
+	hc.determineFailure()
+	hc.determineFailure()
+	select {
+	case <-failchan:
+	default:
+		t.Error("Expected a stable failure once the check kept failing")
+	}
+	if hc.Remediation.Attempts != 1 {
+		t.Errorf("Expected remediation to run once per run of failures, ran %d times", hc.Remediation.Attempts)
+	}
+}
+
+func TestRemediationInBackground(t *testing.T) {
+	failchan := make(chan string, 1)
+	hc := &HealthCheck{
+		Name:            "slow",
+		LastExitCode:    1,
+		AllowedFailures: 1,
+		failedChan:      failchan,
+		Remediation: newRemediation(&config.RemediationConfig{
+			AfterFailures: 1,
+			Actions:       []config.RemediationAction{{Name: "slow", Bin: "/bin/sleep", Args: []string{"2"}}},
+		}),
+	}
+
+	// The check keeps running and the stable failure is not held up by the action.
+	start := time.Now()
+	hc.determineFailure()
+	hc.determineFailure()
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("Expected the remediation not to block the check, took %s", took)
+	}
+	select {
+	case <-failchan:
+	default:
+		t.Error("Expected a stable failure while the remediation was running")
+	}
+	waitForRemediation(t, hc.Remediation)
+	if hc.Remediation.Attempts != 1 || hc.Remediation.LastAttemptOutcome != remediationSuccess {
+		t.Errorf("Unexpected remediation status %+v", hc.Remediation)
+	}
+}
+
+// waitForRemediation waits for the attempt started by the check to finish.
+func waitForRemediation(t *testing.T, r *remediation) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.lock.Lock()
+		running := r.running
+		r.lock.Unlock()
+		if !running {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the remediation")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestRemediationBudget(t *testing.T) {
+	r := newRemediation(&config.RemediationConfig{
+		AfterFailures: 1,
+		MaxPerHour:    2,
+		Actions:       []config.RemediationAction{{Name: "true", Bin: "/bin/true"}},
+	})
+	for i := 0; i < 3; i++ {
+		r.run("budget")
+	}
+	if r.Attempts != 2 || r.SkippedAttempts != 1 {
+		t.Errorf("Expected 2 attempts and 1 skipped, got %d and %d", r.Attempts, r.SkippedAttempts)
+	}
+	if !strings.HasPrefix(r.LastAttemptOutcome, "skipped") {
+		t.Errorf("Expected the last attempt to be skipped, got %s", r.LastAttemptOutcome)
+	}
+
+	// Attempts older than an hour no longer count.
+	r.recentAttempts = []time.Time{time.Now().Add(-2 * time.Hour), time.Now().Add(-61 * time.Minute)}
+	if !r.budgetAvailable(time.Now()) {
+		t.Error("Expected the budget to be available again after an hour")
+	}
+}
@@ -0,0 +1,93 @@
+package scriptengine
+
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/morfien101/asg-healthcheck-agent/config"
+)
+
+const defaultBackoffMultiplier = 2
+
+// maxDelay is the longest delay a time.Duration can hold.
+const maxDelay = time.Duration(math.MaxInt64)
+
+// retryPolicy works out how long a hook waits before it is retried and
+// if it should be retried at all.
+type retryPolicy struct {
+	backoff    string
+	initial    time.Duration
+	multiplier float64
+	max        time.Duration
+	jitter     bool
+	retryOn    map[int]bool
+}
+
+// newRetryPolicy builds the policy for a hook. Hooks without a retry_policy
+// wait seconds_between_retries between each attempt, as they always have.
+func newRetryPolicy(cfg config.FailureHook) retryPolicy {
+	rp := retryPolicy{
+		backoff:    config.BackoffFixed,
+		initial:    time.Duration(cfg.WaitSecondsBetweenRetries) * time.Second,
+		multiplier: defaultBackoffMultiplier,
+	}
+	if cfg.RetryPolicy == nil {
+		return rp
+	}
+	if cfg.RetryPolicy.Backoff != "" {
+		rp.backoff = cfg.RetryPolicy.Backoff
+	}
+	if cfg.RetryPolicy.InitialDelaySeconds != 0 {
+		rp.initial = time.Duration(cfg.RetryPolicy.InitialDelaySeconds) * time.Second
+	}
+	if cfg.RetryPolicy.Multiplier != 0 {
+		rp.multiplier = cfg.RetryPolicy.Multiplier
+	}
+	rp.max = time.Duration(cfg.RetryPolicy.MaxDelaySeconds) * time.Second
+	rp.jitter = cfg.RetryPolicy.Jitter
+	if len(cfg.RetryPolicy.RetryOnExitCodes) > 0 {
+		rp.retryOn = map[int]bool{}
+		for _, code := range cfg.RetryPolicy.RetryOnExitCodes {
+			rp.retryOn[code] = true
+		}
+	}
+	return rp
+}
+
+// delay is how long to wait before the given retry, starting at 1.
+func (rp retryPolicy) delay(retry uint) time.Duration {
+	if retry == 0 {
+		return 0
+	}
+	delay := float64(rp.initial)
+	switch rp.backoff {
+	case config.BackoffLinear:
+		delay *= float64(retry)
+	case config.BackoffExponential:
+		delay *= math.Pow(rp.multiplier, float64(retry-1))
+	}
+	if rp.max > 0 && delay > float64(rp.max) {
+		delay = float64(rp.max)
+	}
+	// Exponential backoff without a cap can get big enough to overflow.
+	// float64(maxDelay) rounds up past maxDelay, so it can not be converted back.
+	d := maxDelay
+	if delay < float64(maxDelay) {
+		d = time.Duration(delay)
+	}
+	if rp.jitter && d > 0 {
+		n := int64(d)
+		if d < maxDelay {
+			// Include d itself.
+			n++
+		}
+		d = time.Duration(rand.Int63n(n))
+	}
+	return d
+}
+
+// retryable tells the caller if a hook that exited with exitcode should be tried again.
+func (rp retryPolicy) retryable(exitcode int) bool {
+	return rp.retryOn == nil || rp.retryOn[exitcode]
+}
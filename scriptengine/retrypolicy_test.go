@@ -0,0 +1,93 @@
+package scriptengine
+
+import (
+	"testing"
+	"time"
+
+	"github.com/morfien101/asg-healthcheck-agent/config"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      config.FailureHook
+		expected []time.Duration
+	}{
+		{
+			name:     "no policy",
+			cfg:      config.FailureHook{WaitSecondsBetweenRetries: 3},
+			expected: []time.Duration{3 * time.Second, 3 * time.Second, 3 * time.Second},
+		},
+		{
+			name: "linear",
+			cfg: config.FailureHook{RetryPolicy: &config.RetryPolicy{
+				Backoff:             config.BackoffLinear,
+				InitialDelaySeconds: 2,
+			}},
+			expected: []time.Duration{2 * time.Second, 4 * time.Second, 6 * time.Second},
+		},
+		{
+			name: "exponential with a cap",
+			cfg: config.FailureHook{RetryPolicy: &config.RetryPolicy{
+				Backoff:             config.BackoffExponential,
+				InitialDelaySeconds: 1,
+				MaxDelaySeconds:     5,
+			}},
+			expected: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second},
+		},
+	}
+	for _, test := range tests {
+		rp := newRetryPolicy(test.cfg)
+		for i, expected := range test.expected {
+			if got := rp.delay(uint(i + 1)); got != expected {
+				t.Errorf("%s: retry %d expected %s, got %s", test.name, i+1, expected, got)
+			}
+		}
+	}
+}
+
+func TestRetryPolicyJitter(t *testing.T) {
+	rp := newRetryPolicy(config.FailureHook{RetryPolicy: &config.RetryPolicy{
+		Backoff:             config.BackoffExponential,
+		InitialDelaySeconds: 1,
+		Jitter:              true,
+	}})
+	for i := 0; i < 100; i++ {
+		if d := rp.delay(4); d < 0 || d > 8*time.Second {
+			t.Fatalf("Expected a delay between 0 and 8s, got %s", d)
+		}
+	}
+}
+
+func TestRetryPolicyDelayOverflow(t *testing.T) {
+	cfg := config.FailureHook{RetryPolicy: &config.RetryPolicy{
+		Backoff:             config.BackoffExponential,
+		InitialDelaySeconds: 1,
+	}}
+	rp := newRetryPolicy(cfg)
+	if d := rp.delay(10000); d != maxDelay {
+		t.Errorf("Expected an uncapped delay to stop at %s, got %s", maxDelay, d)
+	}
+
+	cfg.RetryPolicy.Jitter = true
+	rp = newRetryPolicy(cfg)
+	for i := 0; i < 100; i++ {
+		if d := rp.delay(10000); d < 0 {
+			t.Fatalf("Expected a positive delay with jitter, got %s", d)
+		}
+	}
+}
+
+func TestRetryOnExitCodes(t *testing.T) {
+	fh := newFailureHook(config.FailureHook{
+		Name:        "throttled",
+		Bin:         "/bin/sh",
+		Args:        []string{"-c", "exit 2"},
+		MaxRetry:    5,
+		RetryPolicy: &config.RetryPolicy{RetryOnExitCodes: []int{75}},
+	})
+	result := fh.run(NewFailureContext(ReasonStableFailure), time.Time{})
+	if result.Attempts != 1 || result.Reason != reasonNotRetryable {
+		t.Errorf("Expected one attempt that was not retried, got %+v", result)
+	}
+}
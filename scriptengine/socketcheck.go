@@ -0,0 +1,103 @@
+package scriptengine
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/morfien101/asg-healthcheck-agent/config"
+	"github.com/morfien101/asg-healthcheck-agent/logs"
+)
+
+const defaultSocketCheckTimeout = 5 * time.Second
+
+// socketCheck connects to a tcp or unix socket and reports the result as
+// if it were a process that exited. 0 is success and 1 is a failure.
+type socketCheck struct {
+	name           string
+	network        string
+	address        string
+	payload        []byte
+	expectedPrefix []byte
+	timeout        time.Duration
+	// Why the last run failed, empty if it passed.
+	failure string
+}
+
+// checkTimeout is used if the socket block does not have its own timeout.
+func newSocketCheck(name, network string, cfg *config.SocketCheckConfig, checkTimeout uint) (*socketCheck, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("%s check %s has no socket configuration", network, name)
+	}
+	check := &socketCheck{
+		name:           name,
+		network:        network,
+		address:        cfg.Address,
+		payload:        []byte(cfg.Payload),
+		expectedPrefix: []byte(cfg.ExpectedResponsePrefix),
+		timeout:        defaultSocketCheckTimeout,
+	}
+	if cfg.TimeoutSeconds > 0 {
+		check.timeout = time.Duration(cfg.TimeoutSeconds) * time.Second
+	} else if checkTimeout > 0 {
+		check.timeout = time.Duration(checkTimeout) * time.Second
+	}
+
+	return check, nil
+}
+
+func (c *socketCheck) run() (exitcode int, err error) {
+	c.failure = ""
+	// The deadline covers the whole conversation, not just the dial.
+	deadline := time.Now().Add(c.timeout)
+	conn, err := net.DialTimeout(c.network, c.address, c.timeout)
+	if err != nil {
+		c.logFailure(err.Error())
+		return 1, nil
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+
+	if len(c.payload) > 0 {
+		if _, err := conn.Write(c.payload); err != nil {
+			c.logFailure(fmt.Sprintf("failed to send payload. Error: %s", err))
+			return 1, nil
+		}
+	}
+
+	if len(c.expectedPrefix) > 0 {
+		response := make([]byte, len(c.expectedPrefix))
+		if _, err := io.ReadFull(conn, response); err != nil {
+			c.logFailure(fmt.Sprintf("failed to read response. Error: %s", err))
+			return 1, nil
+		}
+		if !bytes.Equal(response, c.expectedPrefix) {
+			c.logFailure(fmt.Sprintf("unexpected response %q", response))
+			return 1, nil
+		}
+	}
+
+	return 0, nil
+}
+
+// tail gives back why the last run failed, so the hooks know what happened.
+func (c *socketCheck) tail() []string {
+	if c.failure == "" {
+		return []string{}
+	}
+	return []string{c.failure}
+}
+
+func (c *socketCheck) logFailure(reason string) {
+	c.failure = reason
+	logs.JSONLog(
+		reason,
+		logs.WARNING,
+		logs.JSONAttributes{
+			"healthcheck_name": c.name,
+			"address":          c.address,
+		},
+	)
+}
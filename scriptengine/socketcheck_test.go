@@ -0,0 +1,105 @@
+package scriptengine
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/morfien101/asg-healthcheck-agent/config"
+)
+
+// pingServer answers PING with +PONG, much like redis would.
+func pingServer(t *testing.T, l net.Listener) {
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				line, err := bufio.NewReader(conn).ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == "PING\r\n" {
+					conn.Write([]byte("+PONG\r\n"))
+					return
+				}
+				conn.Write([]byte("-ERR\r\n"))
+			}(conn)
+		}
+	}()
+}
+
+func TestTCPCheck(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	pingServer(t, l)
+
+	tests := []struct {
+		name     string
+		cfg      config.SocketCheckConfig
+		expected int
+	}{
+		{"connect", config.SocketCheckConfig{Address: l.Addr().String()}, 0},
+		{"ping", config.SocketCheckConfig{Address: l.Addr().String(), Payload: "PING\r\n", ExpectedResponsePrefix: "+PONG"}, 0},
+		{"bad response", config.SocketCheckConfig{Address: l.Addr().String(), Payload: "HELLO\r\n", ExpectedResponsePrefix: "+PONG"}, 1},
+		{"refused", config.SocketCheckConfig{Address: "127.0.0.1:1", TimeoutSeconds: 1}, 1},
+	}
+	for _, test := range tests {
+		cfg := test.cfg
+		check, err := newSocketCheck(test.name, config.CheckTypeTCP, &cfg, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exitcode, err := check.run()
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		}
+		if exitcode != test.expected {
+			t.Errorf("%s: expected exit code %d, got %d", test.name, test.expected, exitcode)
+		}
+	}
+}
+
+func TestUnixCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socketcheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.sock")
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	pingServer(t, l)
+
+	check, err := newSocketCheck("unix", config.CheckTypeUnix, &config.SocketCheckConfig{
+		Address:                path,
+		Payload:                "PING\r\n",
+		ExpectedResponsePrefix: "+PONG",
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exitcode, _ := check.run(); exitcode != 0 {
+		t.Errorf("Expected exit code 0, got %d", exitcode)
+	}
+
+	missing, _ := newSocketCheck("missing", config.CheckTypeUnix, &config.SocketCheckConfig{
+		Address: filepath.Join(dir, "missing.sock"),
+	}, 0)
+	if exitcode, _ := missing.run(); exitcode != 1 {
+		t.Errorf("Expected exit code 1 for a missing socket, got %d", exitcode)
+	}
+}
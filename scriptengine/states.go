@@ -0,0 +1,61 @@
+package scriptengine
+
+import (
+	"strconv"
+
+	"github.com/morfien101/asg-healthcheck-agent/config"
+)
+
+// nagiosStates are the states given to exit codes by the Nagios plugin conventions.
+var nagiosStates = map[int]string{
+	0: config.StateOK,
+	1: config.StateWarning,
+	2: config.StateCritical,
+	3: config.StateUnknown,
+}
+
+// exitCodeStates turns an exit code into a state.
+type exitCodeStates struct {
+	nagios    bool
+	overrides map[int]string
+}
+
+// newExitCodeStates builds the mapping from the configuration. Codes that are
+// not in the configuration follow the Nagios conventions if nagios is true,
+// otherwise 0 is ok and everything else is critical. Invalid codes are ignored
+// as they are caught when the configuration is validated.
+func newExitCodeStates(cfg map[string]string, nagios bool) exitCodeStates {
+	states := exitCodeStates{nagios: nagios}
+	if len(cfg) == 0 {
+		return states
+	}
+	states.overrides = map[int]string{}
+	for code, state := range cfg {
+		if i, err := strconv.Atoi(code); err == nil {
+			states.overrides[i] = state
+		}
+	}
+	return states
+}
+
+func (ecs exitCodeStates) state(exitcode int) string {
+	if state, ok := ecs.overrides[exitcode]; ok {
+		return state
+	}
+	if ecs.nagios {
+		if state, ok := nagiosStates[exitcode]; ok {
+			return state
+		}
+		return config.StateCritical
+	}
+	if exitcode == 0 {
+		return config.StateOK
+	}
+	return config.StateCritical
+}
+
+// degradedState tells the caller if the state means the check is degraded
+// but not failing.
+func degradedState(state string) bool {
+	return state == config.StateWarning || state == config.StateUnknown
+}
@@ -0,0 +1,210 @@
+package scriptengine
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"text/template"
+	"time"
+
+	"github.com/morfien101/asg-healthcheck-agent/config"
+	"github.com/morfien101/asg-healthcheck-agent/identity"
+	"github.com/morfien101/asg-healthcheck-agent/logs"
+)
+
+const (
+	// Webhooks without a timeout give up after this long.
+	defaultWebhookTimeout         = 10 * time.Second
+	defaultWebhookSignatureHeader = "X-ASG-HC-Signature"
+	// Only this much of the response is kept for the logs.
+	maxWebhookResponseBytes = 1024
+)
+
+// webhookHook posts the failure context to a URL.
+type webhookHook struct {
+	name            string
+	url             string
+	headers         map[string]string
+	template        *template.Template
+	secret          []byte
+	signatureHeader string
+	client          *http.Client
+}
+
+// webhookTemplateFuncs are the functions that can be used in a webhook template.
+// json writes a value as JSON, so strings are quoted and escaped.
+var webhookTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// ParseWebhookTemplate parses a webhook template with the functions that can be used in it.
+func ParseWebhookTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(webhookTemplateFuncs).Parse(text)
+}
+
+// ValidateFailureHooks looks for problems in the failure, recovery and termination
+// hooks that can only be found by the scriptengine, like webhook templates that
+// do not parse.
+func ValidateFailureHooks(cfg config.Config) config.ValidationErrors {
+	var errs config.ValidationErrors
+	chains := []struct {
+		path  string
+		hooks []config.FailureHook
+	}{
+		{"failure_hooks", cfg.FailureHooks},
+		{"recovery_hooks", cfg.RecoveryHooks},
+		{"termination_hooks", cfg.TerminationHooks},
+	}
+	for _, chain := range chains {
+		for i, fh := range chain.hooks {
+			if fh.Type != config.HookTypeWebhook || fh.Webhook == nil || fh.Webhook.Template == "" {
+				continue
+			}
+			if _, err := ParseWebhookTemplate(fh.Name, fh.Webhook.Template); err != nil {
+				errs = append(errs, config.ValidationError{
+					Path:    fmt.Sprintf("%s[%d].webhook.template", chain.path, i),
+					Message: fmt.Sprintf("is not a valid template. Error: %s", err),
+				})
+			}
+		}
+	}
+	return errs
+}
+
+func newWebhookHook(name string, cfg *config.WebhookHookConfig) (*webhookHook, error) {
+	h := &webhookHook{
+		name:            name,
+		signatureHeader: defaultWebhookSignatureHeader,
+		client:          &http.Client{},
+	}
+	if cfg == nil {
+		return h, nil
+	}
+	h.url = cfg.URL
+	h.headers = cfg.Headers
+	if cfg.Template != "" {
+		t, err := ParseWebhookTemplate(name, cfg.Template)
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhook template. Error: %s", err)
+		}
+		h.template = t
+	}
+	if cfg.Secret != "" {
+		h.secret = []byte(cfg.Secret)
+	}
+	if cfg.SignatureHeader != "" {
+		h.signatureHeader = cfg.SignatureHeader
+	}
+	return h, nil
+}
+
+// redactWebhook copies the webhook settings for _status without the secret,
+// header values or the URL path, which often holds a token.
+func redactWebhook(cfg *config.WebhookHookConfig) *config.WebhookHookConfig {
+	if cfg == nil {
+		return nil
+	}
+	redacted := *cfg
+	if u, err := url.Parse(cfg.URL); err == nil && u.Host != "" {
+		redacted.URL = u.Scheme + "://" + u.Host
+	}
+	if len(cfg.Headers) > 0 {
+		redacted.Headers = map[string]string{}
+		for key := range cfg.Headers {
+			redacted.Headers[key] = "redacted"
+		}
+	}
+	if cfg.Secret != "" {
+		redacted.Secret = "redacted"
+	}
+	return &redacted
+}
+
+// hostnameIdentity is sent as the instance when identity discovery is not
+// enabled, as only the hostname is known without it.
+func hostnameIdentity() *identity.Identity {
+	instance := &identity.Identity{}
+	instance.Hostname, _ = os.Hostname()
+	return instance
+}
+
+// body makes the JSON body from the template, or the whole payload without one.
+func (h *webhookHook) body(payload hookInput) ([]byte, error) {
+	if h.template == nil {
+		return json.Marshal(payload)
+	}
+	buf := &bytes.Buffer{}
+	if err := h.template.Execute(buf, payload); err != nil {
+		return nil, fmt.Errorf("failed to render the webhook template. Error: %s", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// sign gives back the HMAC-SHA256 of the body.
+func (h *webhookHook) sign(body []byte) string {
+	mac := hmac.New(sha256.New, h.secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (h *webhookHook) run(input hookInput, timeout time.Duration) (int, error) {
+	ctx, cancel := nativeHookContext(timeout, defaultWebhookTimeout)
+	defer cancel()
+	payload := input
+	if payload.Instance == nil {
+		payload.Instance = hostnameIdentity()
+	}
+	err := h.send(ctx, payload)
+	return nativeHookResult(ctx, h.name, input, err)
+}
+
+func (h *webhookHook) send(ctx context.Context, payload hookInput) error {
+	body, err := h.body(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range h.headers {
+		req.Header.Set(key, value)
+	}
+	if len(h.secret) > 0 {
+		req.Header.Set(h.signatureHeader, h.sign(body))
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	response, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxWebhookResponseBytes))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status code %d: %s", resp.StatusCode, bytes.TrimSpace(response))
+	}
+	logs.JSONLog(
+		"Webhook sent",
+		logs.INFO,
+		logs.JSONAttributes{
+			"failure_hook_name": h.name,
+			"incident_id":       payload.IncidentID,
+			"status_code":       resp.StatusCode,
+		},
+	)
+	return nil
+}
@@ -0,0 +1,188 @@
+package scriptengine
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/morfien101/asg-healthcheck-agent/config"
+	"github.com/morfien101/asg-healthcheck-agent/identity"
+)
+
+// webhookReceiver records the requests it is sent. The first failures
+// requests get a 500.
+type webhookReceiver struct {
+	*httptest.Server
+	failures int
+	bodies   []string
+	headers  []http.Header
+	lock     sync.Mutex
+}
+
+func newWebhookReceiver(failures int) *webhookReceiver {
+	wr := &webhookReceiver{failures: failures}
+	wr.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		wr.lock.Lock()
+		defer wr.lock.Unlock()
+		wr.bodies = append(wr.bodies, string(body))
+		wr.headers = append(wr.headers, r.Header)
+		if len(wr.bodies) <= wr.failures {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	return wr
+}
+
+func TestWebhookHook(t *testing.T) {
+	identity.Set(&identity.Identity{InstanceID: "i-0123456789", AvailabilityZone: "eu-west-1a"})
+	defer identity.Set(nil)
+	wr := newWebhookReceiver(1)
+	defer wr.Close()
+
+	fhe := NewFailureHookEngine([]config.FailureHook{
+		{
+			Name:     "notify",
+			Type:     config.HookTypeWebhook,
+			MaxRetry: 1,
+			Webhook: &config.WebhookHookConfig{
+				URL:      wr.URL + "/hooks/token",
+				Headers:  map[string]string{"Authorization": "Bearer token"},
+				Template: `{"text": {{json (printf "%s failed on %s" .CheckName .Instance.InstanceID)}}, "incident": {{json .IncidentID}}}`,
+				Secret:   "secret",
+			},
+		},
+	})
+	fc := NewFailureContext(ReasonStableFailure)
+	fc.CheckName = `web "app"`
+	result := fhe.RunHooks(fc).Hooks[0]
+	if result.Outcome != config.HookOutcomeSucceeded || result.Attempts != 2 {
+		t.Fatalf("Expected the webhook to succeed on the retry, got %+v", result)
+	}
+
+	body := wr.bodies[1]
+	payload := map[string]string{}
+	if err := json.Unmarshal([]byte(body), &payload); err != nil {
+		t.Fatalf("Expected the template to make valid JSON, got %s. Error: %s", body, err)
+	}
+	if payload["text"] != `web "app" failed on i-0123456789` || payload["incident"] != fc.IncidentID {
+		t.Errorf("Unexpected payload %s", body)
+	}
+	header := wr.headers[1]
+	if header.Get("Authorization") != "Bearer token" || header.Get("Content-Type") != "application/json" {
+		t.Errorf("Expected the configured headers, got %v", header)
+	}
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(body))
+	if signature := "sha256=" + hex.EncodeToString(mac.Sum(nil)); header.Get("X-ASG-HC-Signature") != signature {
+		t.Errorf("Expected signature %s, got %s", signature, header.Get("X-ASG-HC-Signature"))
+	}
+
+	b, err := json.Marshal(fhe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := string(b); strings.Contains(status, "token") || strings.Contains(status, `"secret":"secret"`) {
+		t.Errorf("Expected the webhook secrets to be redacted, got %s", status)
+	}
+}
+
+func TestWebhookHookDefaultPayload(t *testing.T) {
+	identity.Set(&identity.Identity{InstanceID: "i-0123456789", AvailabilityZone: "eu-west-1a"})
+	defer identity.Set(nil)
+	wr := newWebhookReceiver(0)
+	defer wr.Close()
+
+	h, err := newWebhookHook("notify", &config.WebhookHookConfig{URL: wr.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc := NewFailureContext(ReasonStableFailure)
+	fc.CheckName = "web"
+	fc.LastExitCode = 2
+	fc.OutputTail = []string{"connection refused"}
+	if exitcode, err := h.run(newHookInput(fc, "notify", 1), 0); exitcode != 0 || err != nil {
+		t.Fatalf("Expected the webhook to succeed, got %d. Error: %v", exitcode, err)
+	}
+	payload := struct {
+		IncidentID   string            `json:"incident_id"`
+		CheckName    string            `json:"check_name"`
+		LastExitCode int               `json:"last_exit_code"`
+		OutputTail   []string          `json:"output_tail"`
+		HookName     string            `json:"hook_name"`
+		Instance     identity.Identity `json:"instance"`
+	}{}
+	if err := json.Unmarshal([]byte(wr.bodies[0]), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.IncidentID != fc.IncidentID || payload.CheckName != "web" || payload.LastExitCode != 2 ||
+		len(payload.OutputTail) != 1 || payload.HookName != "notify" {
+		t.Errorf("Expected the failure context in the payload, got %s", wr.bodies[0])
+	}
+	if payload.Instance.InstanceID != "i-0123456789" || payload.Instance.AvailabilityZone != "eu-west-1a" {
+		t.Errorf("Expected the instance identity in the payload, got %+v", payload.Instance)
+	}
+	if wr.headers[0].Get("X-ASG-HC-Signature") != "" {
+		t.Error("Expected no signature without a secret")
+	}
+
+	// Without identity discovery only the hostname is sent.
+	identity.Set(nil)
+	if exitcode, err := h.run(newHookInput(fc, "notify", 1), 0); exitcode != 0 || err != nil {
+		t.Fatalf("Expected the webhook to succeed, got %d. Error: %v", exitcode, err)
+	}
+	hostname, _ := os.Hostname()
+	payload.Instance = identity.Identity{}
+	if err := json.Unmarshal([]byte(wr.bodies[1]), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Instance.Hostname != hostname || payload.Instance.InstanceID != "" {
+		t.Errorf("Expected only the hostname in the payload, got %+v", payload.Instance)
+	}
+
+	wr.failures = 10
+	if exitcode, _ := h.run(newHookInput(fc, "notify", 1), 0); exitcode != 1 {
+		t.Errorf("Expected a 500 to fail the webhook, got %d", exitcode)
+	}
+}
+
+func TestWebhookHookInvalidTemplate(t *testing.T) {
+	if _, err := ParseWebhookTemplate("notify", `{"text": {{json .CheckName}}}`); err != nil {
+		t.Errorf("Expected json to be usable in a template. Error: %s", err)
+	}
+	// Templates are checked when the configuration is loaded, but a hook made
+	// without that check fails to run rather than panic.
+	fh := newFailureHook(config.FailureHook{
+		Name:    "notify",
+		Type:    config.HookTypeWebhook,
+		Webhook: &config.WebhookHookConfig{URL: "http://127.0.0.1", Template: "{{upper .CheckName}}"},
+	})
+	if _, err := fh.newAttempt(newHookInput(NewFailureContext(ReasonStableFailure), "notify", 1), 0); err == nil {
+		t.Error("Expected the invalid template to stop the hook from running")
+	}
+}
+
+func TestValidateFailureHooks(t *testing.T) {
+	webhook := func(template string) config.FailureHook {
+		return config.FailureHook{
+			Name:    "notify",
+			Type:    config.HookTypeWebhook,
+			Webhook: &config.WebhookHookConfig{URL: "http://127.0.0.1", Template: template},
+		}
+	}
+	errs := ValidateFailureHooks(config.Config{
+		FailureHooks:     []config.FailureHook{webhook(`{"text": {{json .CheckName}}}`), webhook("")},
+		TerminationHooks: []config.FailureHook{webhook("{{upper .CheckName}}")},
+	})
+	if len(errs) != 1 || errs[0].Path != "termination_hooks[0].webhook.template" {
+		t.Errorf("Expected only the template using an unknown function to be a problem, got %v", errs)
+	}
+}
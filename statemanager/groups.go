@@ -0,0 +1,164 @@
+package statemanager
+
+import (
+	"github.com/morfien101/asg-healthcheck-agent/config"
+	"github.com/morfien101/asg-healthcheck-agent/metrics"
+	"github.com/morfien101/asg-healthcheck-agent/scriptengine"
+)
+
+var (
+	promGroupFailing = metrics.NewPromGauge(
+		"check_group_failing",
+		"1 if the policy of the check group is met by stably failing health checks.",
+	)
+	promGroupFailingChecks = metrics.NewPromGauge(
+		"check_group_failing_checks",
+		"Number of stably failing health checks in the check group.",
+	)
+)
+
+// GroupState is the state of a check group. It is shown in _status.
+type GroupState struct {
+	Name             string   `json:"name"`
+	Policy           string   `json:"policy"`
+	FailuresRequired uint     `json:"failures_required"`
+	Checks           []string `json:"checks"`
+	FailingChecks    []string `json:"failing_checks"`
+	Failing          bool     `json:"failing"`
+}
+
+// evaluateGroup applies the policy of the group. failing tells it which
+// checks count as failing.
+func evaluateGroup(group config.CheckGroup, failing func(checkName string) bool) GroupState {
+	state := GroupState{
+		Name:             group.Name,
+		Policy:           group.Policy,
+		FailuresRequired: group.FailuresRequired(),
+		Checks:           group.Checks,
+		FailingChecks:    []string{},
+	}
+	if state.Policy == "" {
+		state.Policy = config.GroupPolicyAny
+	}
+	for _, check := range group.Checks {
+		if failing(check) {
+			state.FailingChecks = append(state.FailingChecks, check)
+		}
+	}
+	state.Failing = uint(len(state.FailingChecks)) >= state.FailuresRequired
+	return state
+}
+
+// groupFor returns the group that the health check is in.
+func (sm *StateManager) groupFor(checkName string) (config.CheckGroup, bool) {
+	sm.lock.RLock()
+	defer sm.lock.RUnlock()
+	for _, group := range sm.checkGroups {
+		for _, check := range group.Checks {
+			if check == checkName {
+				return group, true
+			}
+		}
+	}
+	return config.CheckGroup{}, false
+}
+
+// GroupStates returns the state of each check group using the stable failures
+// of the health checks.
+func (sm *StateManager) GroupStates() []GroupState {
+	sm.lock.RLock()
+	groups := sm.checkGroups
+	sm.lock.RUnlock()
+	statuses := sm.HealthCheckEngine.CheckStatuses()
+	states := []GroupState{}
+	for _, group := range groups {
+		states = append(states, evaluateGroup(group, func(checkName string) bool {
+			return statuses[checkName].StableFailure
+		}))
+	}
+	return states
+}
+
+// checksFailing tells the caller if any health check has failures that it has
+// not yet recovered from. Checks in a group only count while there are enough
+// of them failing to meet the policy of the group.
+func (sm *StateManager) checksFailing() bool {
+	sm.lock.RLock()
+	groups := sm.checkGroups
+	sm.lock.RUnlock()
+	statuses := sm.HealthCheckEngine.CheckStatuses()
+	grouped := map[string]bool{}
+	for _, group := range groups {
+		state := evaluateGroup(group, func(checkName string) bool {
+			return statuses[checkName].Failing
+		})
+		if state.Failing {
+			return true
+		}
+		for _, check := range group.Checks {
+			grouped[check] = true
+		}
+	}
+	for name, status := range statuses {
+		if !grouped[name] && status.Failing {
+			return true
+		}
+	}
+	return false
+}
+
+// updateGroupMetrics sends the state of each check group.
+func (sm *StateManager) updateGroupMetrics() {
+	for _, state := range sm.GroupStates() {
+		tags := metrics.Tags{"group": state.Name}
+		failing := int64(0)
+		if state.Failing {
+			failing = 1
+		}
+		metrics.Gauge("check_group_failing", failing, tags)
+		metrics.Gauge("check_group_failing_checks", int64(len(state.FailingChecks)), tags)
+		promGroupFailing.Set(float64(failing), tags)
+		promGroupFailingChecks.Set(float64(len(state.FailingChecks)), tags)
+	}
+}
+
+// setCheckGroups replaces the check groups. The Prometheus series of groups
+// that no longer exist are removed.
+func (sm *StateManager) setCheckGroups(groups []config.CheckGroup) {
+	sm.lock.Lock()
+	previous := sm.checkGroups
+	sm.checkGroups = groups
+	sm.lock.Unlock()
+	current := map[string]bool{}
+	for _, group := range groups {
+		current[group.Name] = true
+	}
+	for _, group := range previous {
+		if !current[group.Name] {
+			tags := metrics.Tags{"group": group.Name}
+			promGroupFailing.Delete(tags)
+			promGroupFailingChecks.Delete(tags)
+		}
+	}
+	sm.updateGroupMetrics()
+}
+
+// describeGroupFailure adds the group to the failure context of a stable failure.
+// false is returned if the check is in a group that does not yet meet its policy.
+func (sm *StateManager) describeGroupFailure(checkName string, fc *scriptengine.FailureContext) bool {
+	group, ok := sm.groupFor(checkName)
+	if !ok {
+		return true
+	}
+	statuses := sm.HealthCheckEngine.CheckStatuses()
+	state := evaluateGroup(group, func(name string) bool {
+		// The check has just sent a stable failure, even if its status has
+		// not caught up.
+		return name == checkName || statuses[name].StableFailure
+	})
+	if !state.Failing {
+		return false
+	}
+	fc.Group = group.Name
+	return true
+}
@@ -0,0 +1,155 @@
+package statemanager
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/morfien101/asg-healthcheck-agent/logs"
+	"github.com/morfien101/asg-healthcheck-agent/scriptengine"
+)
+
+// How often the health check counters are written to the state file.
+const stateSaveInterval = time.Second * 10
+
+// persistedState is what is written to the state file.
+type persistedState struct {
+	Healthy               bool                                  `json:"healthy"`
+	StableFailureTime     string                                `json:"stable_failure_time,omitempty"`
+	StableFailureCause    string                                `json:"stable_failure_cause,omitempty"`
+	FailureContext        *scriptengine.FailureContext          `json:"failure_context,omitempty"`
+	FailureHooksCompleted bool                                  `json:"failure_hooks_completed"`
+	CompletedFailureHooks []string                              `json:"completed_failure_hooks"`
+	FailureHookReport     *scriptengine.HookReport              `json:"failure_hook_report,omitempty"`
+	HealthChecks          map[string]scriptengine.CheckCounters `json:"health_checks"`
+	SavedAt               string                                `json:"saved_at"`
+}
+
+func (sm *StateManager) currentState() persistedState {
+	sm.lock.RLock()
+	defer sm.lock.RUnlock()
+	var fc *scriptengine.FailureContext
+	if !sm.Healthy {
+		failureContext := sm.failureContext
+		fc = &failureContext
+	}
+	return persistedState{
+		FailureContext:        fc,
+		Healthy:               sm.Healthy,
+		StableFailureTime:     sm.StableFailureTime,
+		StableFailureCause:    sm.StableFailureCause,
+		FailureHooksCompleted: sm.failureHooksCompleted,
+		CompletedFailureHooks: sm.FailureHookEngine.CompletedHooks(),
+		FailureHookReport:     sm.FailureHookEngine.LastReport(),
+		HealthChecks:          sm.HealthCheckEngine.Counters(),
+		SavedAt:               time.Now().Format(time.RFC3339),
+	}
+}
+
+// saveState writes the current state to the state file, if one is configured.
+// The file is written to a temporary file first and then moved into place
+// so that a crash mid write does not leave a corrupt file behind.
+func (sm *StateManager) saveState() {
+	if sm.stateFile == "" {
+		return
+	}
+	sm.saveLock.Lock()
+	defer sm.saveLock.Unlock()
+
+	logError := func(err error) {
+		logs.JSONLog(
+			"Failed to save state file",
+			logs.ERROR,
+			logs.JSONAttributes{
+				"error":      err.Error(),
+				"state_file": sm.stateFile,
+			},
+		)
+	}
+
+	b, err := json.Marshal(sm.currentState())
+	if err != nil {
+		logError(err)
+		return
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(sm.stateFile), filepath.Base(sm.stateFile)+".tmp")
+	if err != nil {
+		logError(err)
+		return
+	}
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), sm.stateFile)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		logError(err)
+	}
+}
+
+// loadState reads the state file. nil is returned if there is no state to restore.
+func (sm *StateManager) loadState() *persistedState {
+	if sm.stateFile == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(sm.stateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logs.JSONLog(
+				"Failed to read state file, starting with a fresh state",
+				logs.ERROR,
+				logs.JSONAttributes{
+					"error":      err.Error(),
+					"state_file": sm.stateFile,
+				},
+			)
+		}
+		return nil
+	}
+	state := &persistedState{}
+	if err := json.Unmarshal(b, state); err != nil {
+		logs.JSONLog(
+			"Failed to decode state file, starting with a fresh state",
+			logs.ERROR,
+			logs.JSONAttributes{
+				"error":      err.Error(),
+				"state_file": sm.stateFile,
+			},
+		)
+		return nil
+	}
+	return state
+}
+
+// startStateSaver will save the state on an interval until the returned
+// channel is closed. The state is saved one last time when it stops.
+func (sm *StateManager) startStateSaver() chan struct{} {
+	stopChan := make(chan struct{}, 1)
+	if sm.stateFile == "" {
+		return stopChan
+	}
+	ticker := time.NewTicker(stateSaveInterval)
+	go func() {
+		for {
+			select {
+			case _, ok := <-stopChan:
+				if !ok {
+					ticker.Stop()
+					sm.saveState()
+					return
+				}
+			case <-ticker.C:
+				sm.saveState()
+			}
+		}
+	}()
+	return stopChan
+}
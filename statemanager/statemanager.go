@@ -1,10 +1,14 @@
 package statemanager
 
 import (
+	"encoding/json"
 	"fmt"
 	"math/rand"
+	"sync"
 	"time"
 
+	"github.com/morfien101/asg-healthcheck-agent/config"
+	"github.com/morfien101/asg-healthcheck-agent/identity"
 	"github.com/morfien101/asg-healthcheck-agent/logs"
 	"github.com/morfien101/asg-healthcheck-agent/metrics"
 	"github.com/morfien101/asg-healthcheck-agent/scriptengine"
@@ -21,43 +25,118 @@ import (
 // the life cycle hook to proceed.
 // If not then the ASG will just terminate the instance at will and the hooks will not have time
 // in some cases to complete.
+//
+// A recoverable agent keeps running the health checks after a stable failure. Once every
+// check has recovered, the health changes back to HEALTHY and the recovery hooks are run.
+//
+// The termination hooks are run once when the auto scaling group moves the instance to
+// Terminated, whatever the health is. This covers scale in of healthy instances.
+
+// TargetLifecycleTerminated is the target lifecycle state of an instance that
+// the auto scaling group is terminating.
+const TargetLifecycleTerminated = "Terminated"
+
+// Overall states of the agent.
+const (
+	StateHealthy  = "healthy"
+	StateDegraded = "degraded"
+	StateSick     = "sick"
+)
+
+var (
+	promHealthy     = metrics.NewPromGauge("healthy", "1 if the agent considers the instance healthy.")
+	promDegraded    = metrics.NewPromGauge("degraded", "1 if a health check is in a warning or unknown state.")
+	promTransitions = metrics.NewPromCounter("state_transitions_total", "Number of times the agent changed between healthy and sick.")
+)
 
 type StateManager struct {
 	failureChan         chan string
+	recoveryChan        chan string
+	externalChan        chan scriptengine.FailureContext
+	terminationChan     chan struct{}
 	exitChan            chan error
 	metricHeartBeatChan chan struct{}
+	stateSaverChan      chan struct{}
 	// We may not want to run the hooks if we get a signal to terminate.
 	runFailureHooksOnSignal bool
 	runFailureHooks         bool
+	failureHooksCompleted   bool
+	terminationHooksStarted bool
+	recoverable             bool
+	checkGroups             []config.CheckGroup
+	failureContext          scriptengine.FailureContext
+	stateFile               string
+	lock                    sync.RWMutex
+	saveLock                sync.Mutex
 	Healthy                 bool                                    `json:"healthy"`
+	StableFailureTime       string                                  `json:"stable_failure_time,omitempty"`
+	StableFailureCause      string                                  `json:"stable_failure_cause,omitempty"`
+	IncidentID              string                                  `json:"incident_id,omitempty"`
+	LastRecoveryTime        string                                  `json:"last_recovery_time,omitempty"`
+	TargetLifecycleState    string                                  `json:"target_lifecycle_state,omitempty"`
+	Identity                *identity.Identity                      `json:"identity,omitempty"`
 	HealthCheckEngine       scriptengine.HealthCheckEngineInterface `json:"health_checks"`
 	FailureHookEngine       scriptengine.FailureHookEngineInterface `json:"failure_hooks"`
+	RecoveryHookEngine      scriptengine.FailureHookEngineInterface `json:"recovery_hooks"`
+	TerminationHookEngine   scriptengine.FailureHookEngineInterface `json:"termination_hooks"`
 }
 
 // New returns a StateManager that has been populated the with the supplied values.
 func New(
 	hce scriptengine.HealthCheckEngineInterface,
 	fhe scriptengine.FailureHookEngineInterface,
-	runHooksOnSignal bool,
-	runHooks bool,
-) StateManager {
-	sm := StateManager{
+	rhe scriptengine.FailureHookEngineInterface,
+	the scriptengine.FailureHookEngineInterface,
+	cfg config.Config,
+) *StateManager {
+	sm := &StateManager{
 		Healthy:                 true,
 		failureChan:             make(chan string, 1),
+		recoveryChan:            make(chan string, 1),
+		externalChan:            make(chan scriptengine.FailureContext, 1),
+		terminationChan:         make(chan struct{}, 1),
 		exitChan:                make(chan error, 1),
-		runFailureHooksOnSignal: runHooksOnSignal,
-		runFailureHooks:         runHooks,
+		runFailureHooksOnSignal: cfg.RunFailureHooksOnTermSignal,
+		runFailureHooks:         cfg.RunFailureHooks,
+		recoverable:             cfg.Recoverable,
+		checkGroups:             cfg.CheckGroups,
+		stateFile:               cfg.StateFile,
 		HealthCheckEngine:       hce,
 		FailureHookEngine:       fhe,
+		RecoveryHookEngine:      rhe,
+		TerminationHookEngine:   the,
+		Identity:                identity.Current(),
 	}
+	sm.FailureHookEngine.SetDeadline(cfg.FailureHooksDeadlineSeconds)
+	promHealthy.Set(1, metrics.Tags{})
+	promDegraded.Set(0, metrics.Tags{})
 
 	return sm
 }
 
 // Start will run the underlying processes to enable health monitoring.
+// If a state file is configured and it holds a stable failure, the health checks
+// are not started unless the agent is recoverable. The failure hooks that did
+// not complete are run.
 func (sm *StateManager) Start(gracePeriod uint) <-chan error {
+	sm.FailureHookEngine.OnHookCompleted(func(string) { sm.saveState() })
+	sm.metricHeartBeatChan = sm.startMetricsHeartBeat()
+	sm.stateSaverChan = sm.startStateSaver()
+	restoredFailure := false
+	if state := sm.loadState(); state != nil {
+		restoredFailure = sm.restoreState(state)
+		if restoredFailure && !sm.recoverable {
+			go func() {
+				sm.processStableFailure()
+				// Keep listening so the termination hooks can still run.
+				sm.readFromFailChan()
+			}()
+			return sm.exitChan
+		}
+	}
+
 	// Start the underlying processes
-	sm.HealthCheckEngine.Start(sm.failureChan)
+	sm.HealthCheckEngine.Start(sm.failureChan, sm.recoveryChan)
 
 	go func() {
 		if gracePeriod > 0 {
@@ -66,11 +145,64 @@ func (sm *StateManager) Start(gracePeriod uint) <-chan error {
 		sm.HealthCheckEngine.SetGraceMode(false)
 	}()
 
-	go sm.readFromFailChan()
-	sm.metricHeartBeatChan = sm.startMetricsHeartBeat()
+	go func() {
+		// Hooks are run from the same go routine that handles failures and
+		// recoveries so that they can not overlap.
+		if restoredFailure {
+			sm.processStableFailure()
+		}
+		sm.readFromFailChan()
+	}()
 	return sm.exitChan
 }
 
+// restoreState applies a state that was saved before the agent restarted.
+// true is returned if the saved state was a stable failure.
+func (sm *StateManager) restoreState(state *persistedState) bool {
+	sm.HealthCheckEngine.RestoreCounters(state.HealthChecks)
+	if state.Healthy {
+		logs.JSONLog(
+			"Restored health check counters from state file",
+			logs.INFO,
+			logs.JSONAttributes{"state_file": sm.stateFile},
+		)
+		return false
+	}
+
+	sm.lock.Lock()
+	sm.Healthy = false
+	sm.StableFailureTime = state.StableFailureTime
+	sm.StableFailureCause = state.StableFailureCause
+	sm.failureHooksCompleted = state.FailureHooksCompleted
+	if state.FailureContext != nil {
+		sm.failureContext = *state.FailureContext
+	} else {
+		// State files written before the failure context was saved.
+		sm.failureContext = scriptengine.NewFailureContext(scriptengine.ReasonStableFailure)
+		sm.failureContext.CheckName = state.StableFailureCause
+	}
+	sm.IncidentID = sm.failureContext.IncidentID
+	sm.lock.Unlock()
+	promHealthy.Set(0, metrics.Tags{})
+	sm.FailureHookEngine.SetCompletedHooks(state.CompletedFailureHooks)
+	if state.FailureHookReport != nil {
+		sm.FailureHookEngine.RestoreReport(*state.FailureHookReport)
+	}
+
+	logs.JSONLog(
+		"Restored stable failure from state file",
+		logs.WARNING,
+		logs.JSONAttributes{
+			"check_name":              state.StableFailureCause,
+			"incident_id":             sm.IncidentID,
+			"stable_failure_time":     state.StableFailureTime,
+			"failure_hooks_completed": state.FailureHooksCompleted,
+			"completed_failure_hooks": state.CompletedFailureHooks,
+		},
+	)
+	return true
+}
+
 // Stop will tell the statemanager to stop the healthcheck engine and depending on the config
 // for termination signal handleing, it will also run the failure hooks.
 // It maybe undesirable for failure hooks to be run on a termination signal as it is a
@@ -79,12 +211,63 @@ func (sm *StateManager) Start(gracePeriod uint) <-chan error {
 // time for the program.
 func (sm *StateManager) Stop(singalTermination bool) {
 	sm.HealthCheckEngine.Stop()
+	sm.lock.RLock()
+	runFailureHooksOnSignal := sm.runFailureHooksOnSignal
+	sm.lock.RUnlock()
 	if singalTermination {
-		if sm.runFailureHooksOnSignal {
-			sm.FailureHookEngine.RunHooks()
+		if runFailureHooksOnSignal {
+			report := sm.FailureHookEngine.RunHooks(scriptengine.NewFailureContext(scriptengine.ReasonTerminationSignal))
+			logHookReport("Failure hooks finished", report)
 		}
 	}
 	close(sm.metricHeartBeatChan)
+	close(sm.stateSaverChan)
+}
+
+// Reload applies a new configuration to the health checks and hooks.
+// Checks that have not changed keep their counters. Once a stable failure has
+// been detected the reload is ignored as the failure hooks have already been triggered,
+// unless the agent is recoverable. Changes to recoverable require a restart.
+// false is returned if the reload was ignored.
+func (sm *StateManager) Reload(cfg config.Config) bool {
+	if !sm.isHealthy() && !sm.recoverable {
+		logs.JSONLog(
+			"Ignoring configuration reload, a stable failure has already been detected",
+			logs.WARNING,
+			logs.JSONAttributes{},
+		)
+		return false
+	}
+	summary := sm.HealthCheckEngine.Reload(cfg.HealthChecks)
+	sm.FailureHookEngine.Reload(cfg.FailureHooks)
+	sm.FailureHookEngine.SetDeadline(cfg.FailureHooksDeadlineSeconds)
+	sm.RecoveryHookEngine.Reload(cfg.RecoveryHooks)
+	sm.TerminationHookEngine.Reload(cfg.TerminationHooks)
+	sm.setCheckGroups(cfg.CheckGroups)
+	sm.lock.Lock()
+	sm.runFailureHooksOnSignal = cfg.RunFailureHooksOnTermSignal
+	sm.runFailureHooks = cfg.RunFailureHooks
+	sm.lock.Unlock()
+
+	logs.JSONLog(
+		"Configuration reloaded",
+		logs.INFO,
+		logs.JSONAttributes{
+			"health_checks_added":     summary.Added,
+			"health_checks_removed":   summary.Removed,
+			"health_checks_replaced":  summary.Replaced,
+			"health_checks_unchanged": summary.Unchanged,
+		},
+	)
+
+	// The failing checks may have been removed or regrouped, so see if we have recovered.
+	if !sm.isHealthy() {
+		select {
+		case sm.recoveryChan <- "":
+		default:
+		}
+	}
+	return true
 }
 
 func (sm *StateManager) readFromFailChan() {
@@ -92,41 +275,299 @@ func (sm *StateManager) readFromFailChan() {
 		select {
 		case failureName := <-sm.failureChan:
 			sm.actionFailure(failureName)
+		case recoveredName := <-sm.recoveryChan:
+			sm.actionRecovery(recoveredName)
+		case fc := <-sm.externalChan:
+			sm.stableFailure(fc.Reason, fc)
+		case <-sm.terminationChan:
+			sm.runTerminationHooks()
 		}
 	}
 }
 
-func (sm *StateManager) actionFailure(failureCause string) {
+// TargetLifecycleStateChanged records the auto scaling target lifecycle state of the
+// instance. The termination hooks are started the first time it is Terminated.
+func (sm *StateManager) TargetLifecycleStateChanged(state string) {
+	sm.lock.Lock()
+	previous := sm.TargetLifecycleState
+	sm.TargetLifecycleState = state
+	start := state == TargetLifecycleTerminated && !sm.terminationHooksStarted
+	if start {
+		sm.terminationHooksStarted = true
+	}
+	sm.lock.Unlock()
+	logs.JSONLog(
+		"Target lifecycle state changed",
+		logs.INFO,
+		logs.JSONAttributes{
+			"previous_state": previous,
+			"state":          state,
+		},
+	)
+	if start {
+		sm.terminationChan <- struct{}{}
+	}
+}
+
+// runTerminationHooks runs the termination hooks for a new incident.
+func (sm *StateManager) runTerminationHooks() {
+	fc := scriptengine.NewFailureContext(scriptengine.ReasonTargetLifecycleTerminated)
+	logs.JSONLog(
+		"Instance is being terminated by the auto scaling group, running termination hooks",
+		logs.WARNING,
+		logs.JSONAttributes{"incident_id": fc.IncidentID},
+	)
+	logHookReport("Termination hooks finished", sm.TerminationHookEngine.RunHooks(fc))
+}
+
+// ExternalFailure causes a stable failure for something other than a health check,
+// like a spot interruption notice. The reason is used as the cause and the details
+// are given to the hooks as the output tail. These failures do not recover.
+// false is returned if another failure is already waiting to be handled, so
+// the caller can try again.
+func (sm *StateManager) ExternalFailure(reason string, details []string) bool {
+	fc := scriptengine.NewFailureContext(reason)
+	fc.OutputTail = details
+	select {
+	case sm.externalChan <- fc:
+		return true
+	default:
+		logs.JSONLog(
+			"Failure not accepted, another is already waiting to be handled",
+			logs.WARNING,
+			logs.JSONAttributes{"reason": reason},
+		)
+		return false
+	}
+}
+
+// State returns the overall state of the agent. Healthy instances are degraded if
+// any health check is in a warning or unknown state.
+func (sm *StateManager) State() string {
+	if !sm.isHealthy() {
+		return StateSick
+	}
+	if sm.HealthCheckEngine.Degraded() {
+		return StateDegraded
+	}
+	return StateHealthy
+}
+
+// MarshalJSON adds the overall state and the state of the check groups to the JSON output.
+// The fields are copied under the lock and marshalled once it is released.
+func (sm *StateManager) MarshalJSON() ([]byte, error) {
+	state := sm.State()
+	checkGroups := sm.GroupStates()
+	sm.lock.RLock()
+	snapshot := struct {
+		State                 string                                  `json:"state"`
+		CheckGroups           []GroupState                            `json:"check_groups,omitempty"`
+		Healthy               bool                                    `json:"healthy"`
+		StableFailureTime     string                                  `json:"stable_failure_time,omitempty"`
+		StableFailureCause    string                                  `json:"stable_failure_cause,omitempty"`
+		IncidentID            string                                  `json:"incident_id,omitempty"`
+		LastRecoveryTime      string                                  `json:"last_recovery_time,omitempty"`
+		TargetLifecycleState  string                                  `json:"target_lifecycle_state,omitempty"`
+		Identity              *identity.Identity                      `json:"identity,omitempty"`
+		HealthCheckEngine     scriptengine.HealthCheckEngineInterface `json:"health_checks"`
+		FailureHookEngine     scriptengine.FailureHookEngineInterface `json:"failure_hooks"`
+		RecoveryHookEngine    scriptengine.FailureHookEngineInterface `json:"recovery_hooks"`
+		TerminationHookEngine scriptengine.FailureHookEngineInterface `json:"termination_hooks"`
+	}{
+		State:                 state,
+		CheckGroups:           checkGroups,
+		Healthy:               sm.Healthy,
+		StableFailureTime:     sm.StableFailureTime,
+		StableFailureCause:    sm.StableFailureCause,
+		IncidentID:            sm.IncidentID,
+		LastRecoveryTime:      sm.LastRecoveryTime,
+		TargetLifecycleState:  sm.TargetLifecycleState,
+		Identity:              sm.Identity,
+		HealthCheckEngine:     sm.HealthCheckEngine,
+		FailureHookEngine:     sm.FailureHookEngine,
+		RecoveryHookEngine:    sm.RecoveryHookEngine,
+		TerminationHookEngine: sm.TerminationHookEngine,
+	}
+	sm.lock.RUnlock()
+	return json.Marshal(snapshot)
+}
+
+func (sm *StateManager) isHealthy() bool {
+	sm.lock.RLock()
+	defer sm.lock.RUnlock()
+	return sm.Healthy
+}
+
+// actionFailure is called each time a check has a stable failure. Checks in a
+// group only cause a stable failure once the policy of the group is met. The
+// failure is reported against the failing dependency of the check, if it has one.
+func (sm *StateManager) actionFailure(checkName string) {
+	fc := scriptengine.NewFailureContext(scriptengine.ReasonStableFailure)
+	if !sm.describeGroupFailure(checkName, &fc) {
+		logs.JSONLog(
+			"Stable failure does not meet the policy of its check group",
+			logs.DEBUG,
+			logs.JSONAttributes{"check_name": checkName},
+		)
+		return
+	}
+	failureCause := sm.HealthCheckEngine.RootCause(checkName)
+	if failureCause != checkName && sm.isHealthy() {
+		logs.JSONLog(
+			"Stable failure is caused by a failing dependency",
+			logs.INFO,
+			logs.JSONAttributes{
+				"check_name": checkName,
+				"root_cause": failureCause,
+			},
+		)
+	}
+	fc = sm.HealthCheckEngine.DescribeFailure(failureCause, fc)
+	sm.stableFailure(failureCause, fc)
+}
+
+// stableFailure changes the health to sick and runs the failure hooks.
+// It does nothing if the health is already sick.
+func (sm *StateManager) stableFailure(failureCause string, fc scriptengine.FailureContext) {
+	sm.lock.Lock()
 	if !sm.Healthy {
+		sm.lock.Unlock()
 		return
 	}
 	// Got a stable failure.
 	// Set Healthy false
 	sm.Healthy = false
+	sm.StableFailureTime = time.Now().Format("Mon Jan 2 15:04:05 -0700 MST 2006")
+	sm.StableFailureCause = failureCause
+	sm.failureContext = fc
+	sm.IncidentID = fc.IncidentID
+	sm.lock.Unlock()
+	promHealthy.Set(0, metrics.Tags{})
+	metricTransition(StateSick)
 	logs.JSONLog(
 		"Stable failure detected",
 		logs.WARNING,
 		logs.JSONAttributes{
-			"check_name": failureCause,
+			"check_name":  failureCause,
+			"group":       fc.Group,
+			"incident_id": fc.IncidentID,
+			"reason":      fc.Reason,
+			"recoverable": sm.recoverable,
 		},
 	)
-	sm.HealthCheckEngine.Stop()
+	if !sm.recoverable {
+		sm.HealthCheckEngine.Stop()
+	}
+	sm.saveState()
+	sm.processStableFailure()
+}
+
+// actionRecovery is called each time a check recovers. The agent only goes
+// back to healthy once no check is failing, or for checks in a group, once too
+// few are failing to meet the policy of the group.
+func (sm *StateManager) actionRecovery(checkName string) {
+	if sm.isHealthy() || sm.checksFailing() {
+		return
+	}
+	sm.lock.Lock()
+	if sm.failureContext.Reason != scriptengine.ReasonStableFailure {
+		// The health checks did not cause the failure, so they can not recover from it.
+		sm.lock.Unlock()
+		return
+	}
+	failureCause := sm.StableFailureCause
+	// The recovery hooks get the same incident as the failure hooks did.
+	fc := sm.failureContext
+	sm.Healthy = true
+	sm.LastRecoveryTime = time.Now().Format("Mon Jan 2 15:04:05 -0700 MST 2006")
+	sm.StableFailureTime = ""
+	sm.StableFailureCause = ""
+	sm.IncidentID = ""
+	sm.failureContext = scriptengine.FailureContext{}
+	sm.failureHooksCompleted = false
+	sm.lock.Unlock()
+	fc = sm.HealthCheckEngine.DescribeFailure(failureCause, fc)
+	fc.Reason = scriptengine.ReasonRecovered
+	// The failure hooks need to run again on the next stable failure.
+	sm.FailureHookEngine.SetCompletedHooks(nil)
+	promHealthy.Set(1, metrics.Tags{})
+	metricTransition(StateHealthy)
+	logs.JSONLog(
+		"Recovered from stable failure",
+		logs.INFO,
+		logs.JSONAttributes{
+			"check_name":           checkName,
+			"incident_id":          fc.IncidentID,
+			"stable_failure_cause": failureCause,
+		},
+	)
+	sm.saveState()
+	sm.RecoveryHookEngine.SetCompletedHooks(nil)
+	logHookReport("Recovery hooks finished", sm.RecoveryHookEngine.RunHooks(fc))
+}
+
+// logHookReport logs a summary of a run of hooks. The full report is in _status.
+func logHookReport(message string, report scriptengine.HookReport) {
+	outcomes := map[string]string{}
+	for _, result := range report.Hooks {
+		outcomes[result.Name] = result.Outcome
+	}
+	logs.JSONLog(
+		message,
+		logs.INFO,
+		logs.JSONAttributes{
+			"incident_id": report.IncidentID,
+			"aborted":     report.Aborted,
+			"outcomes":    outcomes,
+		},
+	)
+}
+
+func metricTransition(state string) {
+	tags := metrics.Tags{"state": state}
+	metrics.Incr("state_transition", 1, tags)
+	promTransitions.Add(1, tags)
+}
+
+// processStableFailure runs the failure hooks, unless they have already completed,
+// then closes the exit chan. Recoverable agents keep running so the exit chan is left open.
+func (sm *StateManager) processStableFailure() {
+	sm.lock.RLock()
+	hooksCompleted := sm.failureHooksCompleted
+	runFailureHooks := sm.runFailureHooks
+	fc := sm.failureContext
+	sm.lock.RUnlock()
 	// Process failure hooks
-	if sm.runFailureHooks {
-		sm.FailureHookEngine.RunHooks()
+	if runFailureHooks && !hooksCompleted {
+		report := sm.FailureHookEngine.RunHooks(fc)
+		logHookReport("Failure hooks finished", report)
+		sm.lock.Lock()
+		sm.failureHooksCompleted = true
+		sm.lock.Unlock()
+		sm.saveState()
+	}
+	if sm.recoverable {
+		return
 	}
 	// We are finished so we can close the exit chan to indicate this.
 	close(sm.exitChan)
 }
 
+func (sm *StateManager) updateDegradedMetric() {
+	degraded := 0.0
+	if sm.State() == StateDegraded {
+		degraded = 1
+	}
+	promDegraded.Set(degraded, metrics.Tags{})
+}
+
 func (sm *StateManager) startMetricsHeartBeat() chan struct{} {
 	rand.Seed(time.Now().Unix())
 	ticker := time.NewTicker(time.Second * 5)
 	stopChan := make(chan struct{}, 1)
 	go func() {
 		metricName := "heartbeat"
-		tags := metrics.Tags{"healthy": fmt.Sprintf("%v", sm.Healthy)}
-		metrics.Gauge(metricName, 0, tags)
+		metrics.Gauge(metricName, 0, metrics.Tags{"healthy": fmt.Sprintf("%v", sm.isHealthy())})
 		for {
 			select {
 			case _, ok := <-stopChan:
@@ -135,7 +576,11 @@ func (sm *StateManager) startMetricsHeartBeat() chan struct{} {
 					return
 				}
 			case <-ticker.C:
+				// Recoverable agents can change health, so the tags are built every time.
+				tags := metrics.Tags{"healthy": fmt.Sprintf("%v", sm.isHealthy())}
 				metrics.Gauge(metricName, rand.Int63n(100), tags)
+				sm.updateDegradedMetric()
+				sm.updateGroupMetrics()
 			}
 		}
 	}()
@@ -0,0 +1,500 @@
+package statemanager
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/morfien101/asg-healthcheck-agent/config"
+	"github.com/morfien101/asg-healthcheck-agent/logs"
+	"github.com/morfien101/asg-healthcheck-agent/scriptengine"
+)
+
+func TestMain(m *testing.M) {
+	logs.DefaultLogger = logs.NewFakeLogger(false)
+	os.Exit(m.Run())
+}
+
+func TestStatePersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statemanager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hookLog := filepath.Join(dir, "hooks.log")
+
+	cfg := config.Config{
+		RunFailureHooks: true,
+		StateFile:       filepath.Join(dir, "state.json"),
+		HealthChecks: []config.HealthCheck{
+			{Name: "check", Bin: "/bin/true", FreqSeconds: 60},
+		},
+		FailureHooks: []config.FailureHook{
+			{Name: "hook", Bin: "/bin/sh", Args: []string{"-c", "echo ran >> " + hookLog}},
+		},
+	}
+	newStateManager := func() *StateManager {
+		return New(
+			scriptengine.NewHealthCheckEngine(cfg.HealthChecks),
+			scriptengine.NewFailureHookEngine(cfg.FailureHooks),
+			scriptengine.NewFailureHookEngine(cfg.RecoveryHooks),
+			scriptengine.NewFailureHookEngine(cfg.TerminationHooks),
+			cfg,
+		)
+	}
+
+	// First run detects a stable failure and runs the hooks.
+	sm := newStateManager()
+	exitChan := sm.Start(0)
+	sm.failureChan <- "check"
+	waitForExit(t, exitChan)
+	sm.Stop(false)
+
+	// Second run should restore the failure and not run the hooks again.
+	sm = newStateManager()
+	exitChan = sm.Start(0)
+	waitForExit(t, exitChan)
+	sm.Stop(false)
+
+	if sm.Healthy {
+		t.Error("Expected the stable failure to be restored")
+	}
+	if sm.StableFailureCause != "check" {
+		t.Errorf("Expected the failure cause to be restored, got %q", sm.StableFailureCause)
+	}
+	b, err := ioutil.ReadFile(hookLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runs := strings.Count(string(b), "ran"); runs != 1 {
+		t.Errorf("Expected the failure hook to run once, ran %d times", runs)
+	}
+
+	// A recoverable agent keeps running a check that was past its allowed
+	// failures. It must not publish the stable failure again after a restart.
+	cfg.Recoverable = true
+	cfg.HealthChecks = []config.HealthCheck{{Name: "check", Bin: "/bin/false", FreqSeconds: 1}}
+	state, err := json.Marshal(persistedState{
+		StableFailureCause:    "check",
+		FailureHooksCompleted: true,
+		HealthChecks: map[string]scriptengine.CheckCounters{
+			"check": {LastExitCode: 1, TotalFailureCount: 1, FailureSinceLastRecovery: 1},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(cfg.StateFile, state, 0600); err != nil {
+		t.Fatal(err)
+	}
+	hce := scriptengine.NewHealthCheckEngine(cfg.HealthChecks)
+	sm = New(
+		hce,
+		scriptengine.NewFailureHookEngine(cfg.FailureHooks),
+		scriptengine.NewFailureHookEngine(cfg.RecoveryHooks),
+		scriptengine.NewFailureHookEngine(cfg.TerminationHooks),
+		cfg,
+	)
+	if !sm.restoreState(sm.loadState()) {
+		t.Fatal("Expected the stable failure to be restored")
+	}
+	failures := make(chan string, 10)
+	hce.Start(failures, make(chan string, 10))
+	hce.SetGraceMode(false)
+	time.Sleep(2500 * time.Millisecond)
+	hce.Stop()
+	if len(failures) != 0 {
+		t.Errorf("Expected the restored stable failure not to be published again, got %d", len(failures))
+	}
+}
+
+func waitForExit(t *testing.T, exitChan <-chan error) {
+	select {
+	case <-exitChan:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for the failure hooks to finish")
+	}
+}
+
+func TestRecoverable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statemanager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	broken := filepath.Join(dir, "broken")
+	hookLog := filepath.Join(dir, "hooks.log")
+
+	cfg := config.Config{
+		RunFailureHooks: true,
+		Recoverable:     true,
+		HealthChecks: []config.HealthCheck{
+			{
+				Name:                 "check",
+				Bin:                  "/bin/sh",
+				Args:                 []string{"-c", "test ! -e " + broken},
+				FreqSeconds:          1,
+				RecoverySuccessCount: 1,
+			},
+		},
+		FailureHooks: []config.FailureHook{
+			{Name: "failed", Bin: "/bin/sh", Args: []string{"-c", "echo failed >> " + hookLog}},
+		},
+		RecoveryHooks: []config.FailureHook{
+			{Name: "recovered", Bin: "/bin/sh", Args: []string{"-c", "echo recovered >> " + hookLog}},
+		},
+	}
+	sm := New(
+		scriptengine.NewHealthCheckEngine(cfg.HealthChecks),
+		scriptengine.NewFailureHookEngine(cfg.FailureHooks),
+		scriptengine.NewFailureHookEngine(cfg.RecoveryHooks),
+		scriptengine.NewFailureHookEngine(cfg.TerminationHooks),
+		cfg,
+	)
+	sm.Start(0)
+	defer sm.Stop(false)
+
+	readHookLog := func() string {
+		b, _ := ioutil.ReadFile(hookLog)
+		return string(b)
+	}
+
+	// Fail and recover twice to make sure the hooks run on every transition.
+	for i := 1; i <= 2; i++ {
+		if err := ioutil.WriteFile(broken, []byte{}, 0644); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "a stable failure", func() bool {
+			return strings.Count(readHookLog(), "failed") == i
+		})
+		if sm.State() != StateSick {
+			t.Errorf("Expected state %s, got %s", StateSick, sm.State())
+		}
+
+		os.Remove(broken)
+		waitFor(t, "a recovery", func() bool {
+			return strings.Count(readHookLog(), "recovered") == i
+		})
+		if sm.State() != StateHealthy {
+			t.Errorf("Expected state %s, got %s", StateHealthy, sm.State())
+		}
+	}
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestExternalFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statemanager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hookLog := filepath.Join(dir, "hooks.log")
+
+	cfg := config.Config{
+		RunFailureHooks: true,
+		Recoverable:     true,
+		HealthChecks: []config.HealthCheck{
+			{Name: "check", Bin: "/bin/true", FreqSeconds: 60},
+		},
+		FailureHooks: []config.FailureHook{
+			{Name: "drain", Bin: "/bin/sh", Args: []string{"-c", `echo "$ASG_HC_REASON $ASG_HC_OUTPUT_TAIL" >> ` + hookLog}},
+		},
+	}
+	sm := New(
+		scriptengine.NewHealthCheckEngine(cfg.HealthChecks),
+		scriptengine.NewFailureHookEngine(cfg.FailureHooks),
+		scriptengine.NewFailureHookEngine(cfg.RecoveryHooks),
+		scriptengine.NewFailureHookEngine(cfg.TerminationHooks),
+		cfg,
+	)
+	sm.Start(0)
+	defer sm.Stop(false)
+
+	if !sm.ExternalFailure(scriptengine.ReasonSpotInterruption, []string{`{"action": "terminate"}`}) {
+		t.Fatal("Expected the failure to be accepted")
+	}
+	readHookLog := func() string {
+		b, _ := ioutil.ReadFile(hookLog)
+		return string(b)
+	}
+	waitFor(t, "the failure hooks", func() bool { return readHookLog() != "" })
+	if log := readHookLog(); log != "spot_interruption {\"action\": \"terminate\"}\n" {
+		t.Errorf("Expected the hooks to be given the notice, got %q", log)
+	}
+	if sm.State() != StateSick || sm.StableFailureCause != scriptengine.ReasonSpotInterruption {
+		t.Errorf("Expected to be sick because of the spot interruption, got %s %s", sm.State(), sm.StableFailureCause)
+	}
+
+	// The health checks are passing but can not recover from an interruption.
+	sm.recoveryChan <- "check"
+	time.Sleep(200 * time.Millisecond)
+	if sm.State() != StateSick {
+		t.Errorf("Expected to stay sick, got %s", sm.State())
+	}
+}
+
+func TestTerminationHooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statemanager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hookLog := filepath.Join(dir, "hooks.log")
+
+	cfg := config.Config{
+		RunFailureHooks: true,
+		HealthChecks: []config.HealthCheck{
+			{Name: "check", Bin: "/bin/true", FreqSeconds: 60},
+		},
+		TerminationHooks: []config.FailureHook{
+			{Name: "deregister", Bin: "/bin/sh", Args: []string{"-c", `echo "$ASG_HC_REASON" >> ` + hookLog}},
+		},
+	}
+	sm := New(
+		scriptengine.NewHealthCheckEngine(cfg.HealthChecks),
+		scriptengine.NewFailureHookEngine(cfg.FailureHooks),
+		scriptengine.NewFailureHookEngine(cfg.RecoveryHooks),
+		scriptengine.NewFailureHookEngine(cfg.TerminationHooks),
+		cfg,
+	)
+	sm.Start(0)
+	defer sm.Stop(false)
+
+	sm.TargetLifecycleStateChanged("InService")
+	sm.TargetLifecycleStateChanged(TargetLifecycleTerminated)
+	// A flapping state does not run the hooks again.
+	sm.TargetLifecycleStateChanged("InService")
+	sm.TargetLifecycleStateChanged(TargetLifecycleTerminated)
+
+	readHookLog := func() string {
+		b, _ := ioutil.ReadFile(hookLog)
+		return string(b)
+	}
+	waitFor(t, "the termination hooks", func() bool { return readHookLog() != "" })
+	time.Sleep(200 * time.Millisecond)
+	if log := readHookLog(); log != "target_lifecycle_terminated\n" {
+		t.Errorf("Expected the termination hooks to run once, got %q", log)
+	}
+	if sm.State() != StateHealthy {
+		t.Errorf("Expected the termination hooks to leave the health alone, got %s", sm.State())
+	}
+
+	b, err := json.Marshal(sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := string(b); !strings.Contains(status, `"target_lifecycle_state":"Terminated"`) ||
+		!strings.Contains(status, `"termination_hooks"`) {
+		t.Errorf("Expected the target lifecycle state and termination hooks in the status, got %s", status)
+	}
+}
+
+func TestCheckGroups(t *testing.T) {
+	cfg := config.Config{
+		Recoverable: true,
+		HealthChecks: []config.HealthCheck{
+			{Name: "db", Bin: "/bin/true", FreqSeconds: 60},
+			{Name: "cache", Bin: "/bin/true", FreqSeconds: 60},
+			{Name: "queue", Bin: "/bin/true", FreqSeconds: 60},
+			{Name: "app", Bin: "/bin/true", FreqSeconds: 60, AllowedFailures: 3},
+		},
+		CheckGroups: []config.CheckGroup{
+			{Name: "upstream", Checks: []string{"db", "cache", "queue"}, Policy: config.GroupPolicyQuorum, MinFailing: 2},
+		},
+	}
+	hce := scriptengine.NewHealthCheckEngine(cfg.HealthChecks)
+	sm := New(
+		hce,
+		scriptengine.NewFailureHookEngine(cfg.FailureHooks),
+		scriptengine.NewFailureHookEngine(cfg.RecoveryHooks),
+		scriptengine.NewFailureHookEngine(cfg.TerminationHooks),
+		cfg,
+	)
+	checks := map[string]*scriptengine.HealthCheck{}
+	for _, hc := range hce.HealthChecks {
+		checks[hc.Name] = hc
+	}
+
+	checks["db"].FailureSinceLastRecovery = 1
+	sm.actionFailure("db")
+	if sm.State() != StateHealthy {
+		t.Fatalf("Expected one of three upstream checks to be tolerated, got %s", sm.State())
+	}
+
+	checks["cache"].FailureSinceLastRecovery = 1
+	sm.actionFailure("cache")
+	if sm.State() != StateSick || sm.failureContext.Group != "upstream" || sm.StableFailureCause != "cache" {
+		t.Fatalf("Expected the quorum to cause a stable failure, got %s %q %q", sm.State(), sm.failureContext.Group, sm.StableFailureCause)
+	}
+	b, err := json.Marshal(sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := string(b); !strings.Contains(status, `"failing_checks":["db","cache"],"failing":true`) {
+		t.Errorf("Expected the group state in the status, got %s", status)
+	}
+
+	// Failures below the allowed failures of an ungrouped check stop the recovery.
+	checks["cache"].FailureSinceLastRecovery = 0
+	checks["app"].FailureSinceLastRecovery = 1
+	sm.actionRecovery("cache")
+	if sm.State() != StateSick {
+		t.Errorf("Expected app to stop the recovery, got %s", sm.State())
+	}
+
+	// db is still failing, but that is not enough to meet the policy.
+	checks["app"].FailureSinceLastRecovery = 0
+	sm.actionRecovery("app")
+	if sm.State() != StateHealthy {
+		t.Errorf("Expected to recover once the policy is no longer met, got %s", sm.State())
+	}
+	if states := sm.GroupStates(); len(states) != 1 || states[0].Failing || len(states[0].FailingChecks) != 1 {
+		t.Errorf("Expected only db to be failing, got %+v", states)
+	}
+}
+
+func TestFailureRootCause(t *testing.T) {
+	cfg := config.Config{
+		Recoverable: true,
+		HealthChecks: []config.HealthCheck{
+			{Name: "proxy", Bin: "/bin/true", FreqSeconds: 60, AllowedFailures: 3},
+			{Name: "app", Bin: "/bin/true", FreqSeconds: 60, DependsOn: []string{"proxy"}},
+		},
+	}
+	hce := scriptengine.NewHealthCheckEngine(cfg.HealthChecks)
+	sm := New(
+		hce,
+		scriptengine.NewFailureHookEngine(cfg.FailureHooks),
+		scriptengine.NewFailureHookEngine(cfg.RecoveryHooks),
+		scriptengine.NewFailureHookEngine(cfg.TerminationHooks),
+		cfg,
+	)
+	hce.HealthChecks[0].FailureSinceLastRecovery = 1
+	hce.HealthChecks[1].FailureSinceLastRecovery = 1
+
+	sm.actionFailure("app")
+	if sm.State() != StateSick || sm.StableFailureCause != "proxy" || sm.failureContext.CheckName != "proxy" {
+		t.Errorf("Expected the stable failure to be reported against proxy, got %s %q %q",
+			sm.State(), sm.StableFailureCause, sm.failureContext.CheckName)
+	}
+}
+
+func TestReloadWhileTerminationHooksRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statemanager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	started := filepath.Join(dir, "started")
+
+	cfg := config.Config{
+		RunFailureHooks: true,
+		HealthChecks: []config.HealthCheck{
+			{Name: "check", Bin: "/bin/true", FreqSeconds: 60},
+		},
+		TerminationHooks: []config.FailureHook{
+			{Name: "drain", Bin: "/bin/sh", Args: []string{"-c", "touch " + started + "; sleep 2"}},
+		},
+	}
+	sm := New(
+		scriptengine.NewHealthCheckEngine(cfg.HealthChecks),
+		scriptengine.NewFailureHookEngine(cfg.FailureHooks),
+		scriptengine.NewFailureHookEngine(cfg.RecoveryHooks),
+		scriptengine.NewFailureHookEngine(cfg.TerminationHooks),
+		cfg,
+	)
+	sm.Start(0)
+	defer sm.Stop(false)
+
+	sm.TargetLifecycleStateChanged(TargetLifecycleTerminated)
+	waitFor(t, "the termination hooks to start", func() bool {
+		_, err := os.Stat(started)
+		return err == nil
+	})
+
+	start := time.Now()
+	sm.Reload(cfg)
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("Expected the reload not to wait for the termination hooks, took %s", took)
+	}
+}
+
+func TestStatusWhileStateChanges(t *testing.T) {
+	cfg := config.Config{
+		HealthChecks: []config.HealthCheck{
+			{Name: "check", Bin: "/bin/true", FreqSeconds: 60},
+		},
+	}
+	sm := New(
+		scriptengine.NewHealthCheckEngine(cfg.HealthChecks),
+		scriptengine.NewFailureHookEngine(cfg.FailureHooks),
+		scriptengine.NewFailureHookEngine(cfg.RecoveryHooks),
+		scriptengine.NewFailureHookEngine(cfg.TerminationHooks),
+		cfg,
+	)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				sm.TargetLifecycleStateChanged("InService")
+				sm.TargetLifecycleStateChanged("Pending")
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if _, err := json.Marshal(sm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	<-done
+	sm.TargetLifecycleStateChanged("Pending")
+	b, err := json.Marshal(sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := string(b); !strings.HasPrefix(status, `{"state":"healthy",`) ||
+		!strings.Contains(status, `"target_lifecycle_state":"Pending"`) {
+		t.Errorf("Expected the state and target lifecycle state in the status, got %s", status)
+	}
+}
+
+func TestReloadIgnoredAfterStableFailure(t *testing.T) {
+	cfg := config.Config{
+		HealthChecks: []config.HealthCheck{
+			{Name: "check", Bin: "/bin/true", FreqSeconds: 60},
+		},
+	}
+	sm := New(
+		scriptengine.NewHealthCheckEngine(cfg.HealthChecks),
+		scriptengine.NewFailureHookEngine(cfg.FailureHooks),
+		scriptengine.NewFailureHookEngine(cfg.RecoveryHooks),
+		scriptengine.NewFailureHookEngine(cfg.TerminationHooks),
+		cfg,
+	)
+	if !sm.Reload(cfg) {
+		t.Error("Expected a healthy agent to take the reload")
+	}
+	sm.Healthy = false
+	if sm.Reload(cfg) {
+		t.Error("Expected a sick agent that can not recover to ignore the reload")
+	}
+}
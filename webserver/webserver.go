@@ -2,59 +2,140 @@ package webserver
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/morfien101/asg-healthcheck-agent/config"
 	"github.com/morfien101/asg-healthcheck-agent/logs"
+	"github.com/morfien101/asg-healthcheck-agent/metrics"
 	"github.com/morfien101/asg-healthcheck-agent/statemanager"
 )
 
 type HTTPEngine struct {
+	config       config.WebServerConfig
 	router       *mux.Router
 	server       *http.Server
 	stateManager *statemanager.StateManager
 	running      bool
+	// stopped is set if StopHTTPEngine is called before the server is started.
+	stopped bool
+	// lock guards server and stopped as Start runs in its own go routine.
+	lock sync.Mutex
 }
 
 func New(cfg config.WebServerConfig, sm *statemanager.StateManager) *HTTPEngine {
 	httpEngine := &HTTPEngine{
+		config:       cfg,
 		stateManager: sm,
 		router:       mux.NewRouter(),
 	}
 	httpEngine.router.HandleFunc("/_status", httpEngine.showStatus).Methods("Get")
+	httpEngine.router.HandleFunc("/metrics", httpEngine.showMetrics).Methods("Get")
 
 	return httpEngine
 }
 
+// Enabled tells the caller if the web server should be started.
+func (e *HTTPEngine) Enabled() bool {
+	return e.config.Enabled
+}
+
+// Start will start the web server using the address, port and TLS settings
+// from the configuration.
+// Should be used in a go routine.
+func (e *HTTPEngine) Start() error {
+	listenerAddress := net.JoinHostPort(e.config.Address, strconv.Itoa(int(e.config.Port)))
+	if e.config.UseTLS {
+		return e.StartHTTPSEngine(listenerAddress, e.config.TLSCertPath, e.config.TLSKeyPath)
+	}
+	return e.StartHTTPEngine(listenerAddress)
+}
+
 // StartHTTPEngine will start the web server in a nonTLS mode.
 // It also requires that the listening address be passes in as a string.
 // Should be used in a go routine.
 func (e *HTTPEngine) StartHTTPEngine(listenerAddress string) error {
 	// Start the HTTP Engine
-	e.server = &http.Server{Addr: listenerAddress, Handler: e.router}
-	return e.server.ListenAndServe()
+	server := &http.Server{Addr: listenerAddress, Handler: e.router}
+	if !e.setServer(server) {
+		return http.ErrServerClosed
+	}
+	return server.ListenAndServe()
 }
 
 // StartHTTPSEngine will start the web server with TLS support using the given cert and key values.
 // It also requires that the listening address be passes in as a string.
+// If a client CA bundle is configured, clients must present a certificate signed by it.
 // Should be used in a go routine.
 func (e *HTTPEngine) StartHTTPSEngine(listenerAddress, certPath, keyPath string) error {
+	tlsConfig, err := e.tlsConfig()
+	if err != nil {
+		return err
+	}
 	// Start the HTTP Engine
-	e.server = &http.Server{Addr: listenerAddress, Handler: e.router}
-	return e.server.ListenAndServeTLS(certPath, keyPath)
+	server := &http.Server{Addr: listenerAddress, Handler: e.router, TLSConfig: tlsConfig}
+	if !e.setServer(server) {
+		return http.ErrServerClosed
+	}
+	return server.ListenAndServeTLS(certPath, keyPath)
+}
+
+// setServer keeps the server so that it can be stopped. It gives back false if
+// the engine has already been stopped and the server should not be started.
+func (e *HTTPEngine) setServer(server *http.Server) bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.stopped {
+		return false
+	}
+	e.server = server
+	return true
+}
+
+func (e *HTTPEngine) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if e.config.ClientCAPath == "" {
+		return tlsConfig, nil
+	}
+
+	caBytes, err := ioutil.ReadFile(e.config.ClientCAPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA bundle. Error: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caBytes) {
+		return nil, fmt.Errorf("no certificates found in client CA bundle %s", e.config.ClientCAPath)
+	}
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+
+	return tlsConfig, nil
 }
 
 // StopHTTPEngine will stop the web server grafefully.
 // It will give the server 5 seconds before just terminating it.
+// If the web server has not been started yet it will not be started later.
 func (e *HTTPEngine) StopHTTPEngine() error {
+	e.lock.Lock()
+	server := e.server
+	e.stopped = true
+	e.lock.Unlock()
+	if server == nil {
+		return nil
+	}
 	// Stop the HTTP Engine
 	ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancelFunc()
-	return e.server.Shutdown(ctx)
+	return server.Shutdown(ctx)
 }
 
 // ServeHTTP is used to allow the router to start accepting requests before the start is started up. This will help with testing.
@@ -70,20 +151,44 @@ func jsonMarshal(x interface{}) ([]byte, error) {
 	return json.MarshalIndent(x, "", "  ")
 }
 
+// marshal will use the pretty_json_responses config value to determine the output
+// format unless the requester has asked for something else using ?pretty in the query string.
+func (e *HTTPEngine) marshal(r *http.Request, x interface{}) ([]byte, error) {
+	pretty := e.config.PrettyJSON
+	if values, ok := r.URL.Query()["pretty"]; ok {
+		pretty = true
+		if len(values) > 0 && values[0] != "" {
+			if b, err := strconv.ParseBool(values[0]); err == nil {
+				pretty = b
+			}
+		}
+	}
+	if pretty {
+		return jsonMarshal(x)
+	}
+	return json.Marshal(x)
+}
+
 func printJSON(w http.ResponseWriter, jsonbytes []byte) (int, error) {
 	return fmt.Fprint(w, string(jsonbytes), "\n")
 }
 
 // showStatus will show the status of the sever
 func (e *HTTPEngine) showStatus(w http.ResponseWriter, r *http.Request) {
-	if !e.stateManager.Healthy {
-		w.WriteHeader(http.StatusInternalServerError)
+	statusCode := http.StatusOK
+	switch e.stateManager.State() {
+	case statemanager.StateSick:
+		statusCode = http.StatusInternalServerError
+	case statemanager.StateDegraded:
+		if e.config.DegradedStatusCode != 0 {
+			statusCode = e.config.DegradedStatusCode
+		}
 	}
 
-	respBytes, err := json.Marshal(e.stateManager)
+	respBytes, err := e.marshal(r, e.stateManager)
 	if err != nil {
 		respBytes = []byte("Internal server error")
-		w.WriteHeader(http.StatusInternalServerError)
+		statusCode = http.StatusInternalServerError
 		logs.JSONLog(
 			"Error decoding the state manager to JSON",
 			logs.ERROR,
@@ -91,5 +196,18 @@ func (e *HTTPEngine) showStatus(w http.ResponseWriter, r *http.Request) {
 		)
 	}
 	setContentJSON(w)
+	w.WriteHeader(statusCode)
 	fmt.Fprint(w, string(respBytes))
 }
+
+// showMetrics will show the metrics in the Prometheus text format
+func (e *HTTPEngine) showMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := metrics.WritePrometheus(w); err != nil {
+		logs.JSONLog(
+			"Error writing Prometheus metrics",
+			logs.ERROR,
+			logs.JSONAttributes{"error": err.Error()},
+		)
+	}
+}
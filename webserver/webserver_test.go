@@ -0,0 +1,124 @@
+package webserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/morfien101/asg-healthcheck-agent/config"
+	"github.com/morfien101/asg-healthcheck-agent/scriptengine"
+	"github.com/morfien101/asg-healthcheck-agent/statemanager"
+)
+
+func newTestEngine(cfg config.WebServerConfig) *HTTPEngine {
+	sm := statemanager.New(
+		scriptengine.NewHealthCheckEngine([]config.HealthCheck{}),
+		scriptengine.NewFailureHookEngine([]config.FailureHook{}),
+		scriptengine.NewFailureHookEngine([]config.FailureHook{}),
+		scriptengine.NewFailureHookEngine([]config.FailureHook{}),
+		config.Config{RunFailureHooks: true},
+	)
+	return New(cfg, sm)
+}
+
+func TestStatusPrettyJSON(t *testing.T) {
+	tests := []struct {
+		name       string
+		configured bool
+		query      string
+		pretty     bool
+	}{
+		{"config pretty", true, "", true},
+		{"config compact", false, "", false},
+		{"query pretty", false, "?pretty", true},
+		{"query pretty true", false, "?pretty=true", true},
+		{"query compact", true, "?pretty=false", false},
+	}
+
+	for _, test := range tests {
+		e := newTestEngine(config.WebServerConfig{PrettyJSON: test.configured})
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/_status"+test.query, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected status 200, got %d", test.name, w.Code)
+		}
+		if got := strings.Contains(w.Body.String(), "\n  "); got != test.pretty {
+			t.Errorf("%s: expected pretty output to be %v. Body: %s", test.name, test.pretty, w.Body.String())
+		}
+	}
+}
+
+func TestTLSConfigClientCA(t *testing.T) {
+	e := newTestEngine(config.WebServerConfig{ClientCAPath: "/does/not/exist.pem"})
+	if _, err := e.tlsConfig(); err == nil {
+		t.Error("Expected an error for a missing client CA bundle")
+	}
+
+	e = newTestEngine(config.WebServerConfig{})
+	tlsConfig, err := e.tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.ClientCAs != nil {
+		t.Error("Client certificates should not be required without a CA bundle")
+	}
+}
+
+func TestStopWhileStarting(t *testing.T) {
+	e := newTestEngine(config.WebServerConfig{Address: "127.0.0.1", Port: 0})
+	errs := make(chan error, 1)
+	go func() {
+		errs <- e.Start()
+	}()
+	if err := e.StopHTTPEngine(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errs:
+		if err != http.ErrServerClosed {
+			t.Errorf("Expected the server to be closed, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("The web server kept running after it was stopped")
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	e := newTestEngine(config.WebServerConfig{})
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", w.Code)
+	}
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("Unexpected content type %s", w.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(w.Body.String(), "asg_healthcheck_healthy 1\n") {
+		t.Errorf("Expected the healthy gauge in the output:\n%s", w.Body.String())
+	}
+}
+
+func TestDegradedStatusCode(t *testing.T) {
+	hce := scriptengine.NewHealthCheckEngine([]config.HealthCheck{{Name: "disk", Bin: "/bin/true", FreqSeconds: 1}})
+	hce.SetGraceMode(false)
+	hce.HealthChecks[0].LastState = config.StateWarning
+	sm := statemanager.New(
+		hce,
+		scriptengine.NewFailureHookEngine([]config.FailureHook{}),
+		scriptengine.NewFailureHookEngine([]config.FailureHook{}),
+		scriptengine.NewFailureHookEngine([]config.FailureHook{}),
+		config.Config{},
+	)
+	e := New(config.WebServerConfig{DegradedStatusCode: 299}, sm)
+
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/_status", nil))
+	if w.Code != 299 {
+		t.Errorf("Expected status 299, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), `"state":"degraded"`) {
+		t.Errorf("Expected a degraded state in the body:\n%s", w.Body.String())
+	}
+}